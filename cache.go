@@ -0,0 +1,61 @@
+package temper
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxNegativeCacheEntries is the most keys the negative cache holds before
+// it's emptied, so that checks of many distinct keys can't grow it forever.
+const maxNegativeCacheEntries = 1 << 16
+
+// A negativeCache caches the keys that were disabled when they were last
+// checked, so that checking them again skips hashing them and looking them up
+// in the filter. Each entry is only valid for the filter it was evaluated
+// against, and only until it expires.
+type negativeCache struct {
+	ttl time.Duration
+
+	// entries maps keys to their negativeEntry, and size is the number of
+	// entries.
+	entries sync.Map
+	size    atomic.Int64
+}
+
+// A negativeEntry is a key that was disabled in filter, which is cached until
+// expires.
+type negativeEntry struct {
+	filter  *filter
+	expires time.Time
+}
+
+// disabled returns true if the key is cached as disabled in f.
+func (nc *negativeCache) disabled(key string, f *filter, now time.Time) bool {
+	v, ok := nc.entries.Load(key)
+	if !ok {
+		return false
+	}
+	e := v.(negativeEntry)
+	return e.filter == f && now.Before(e.expires)
+}
+
+// add caches the key as disabled in f, emptying the cache first if it's full.
+func (nc *negativeCache) add(key string, f *filter, now time.Time) {
+	if nc.size.Load() >= maxNegativeCacheEntries {
+		nc.clear()
+	}
+	if _, loaded := nc.entries.Swap(key, negativeEntry{filter: f, expires: now.Add(nc.ttl)}); !loaded {
+		nc.size.Add(1)
+	}
+}
+
+// clear empties the cache.
+func (nc *negativeCache) clear() {
+	nc.entries.Range(func(key, _ any) bool {
+		if _, loaded := nc.entries.LoadAndDelete(key); loaded {
+			nc.size.Add(-1)
+		}
+		return true
+	})
+}
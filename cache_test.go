@@ -0,0 +1,72 @@
+package temper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClientCheck_NegativeCache(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{BaseURL: srv.URL, NegativeCacheTTL: time.Hour})
+
+	if v := c.Check("new_feature:user:1"); v {
+		t.Fatalf("expected new_feature:user:1 to be false but got %v", v)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Fatalf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	if _, ok := c.negative.entries.Load("temper_api_e2e:user:1"); ok {
+		t.Error("expected an enabled key not to be cached")
+	}
+
+	// Modifying the filter in place bypasses the cache's invalidation, so
+	// the cached result shows that the filter wasn't consulted.
+	c.filter.Load().insert([]byte("new_feature:user:1"))
+	if v := c.Check("new_feature:user:1"); v {
+		t.Errorf("expected the cached result for new_feature:user:1 but got %v", v)
+	}
+	if v := c.CheckSeeded("new_feature:user:1", "seed"); !v {
+		t.Errorf("expected a seeded check to skip the cache but got %v", v)
+	}
+
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if n := c.negative.size.Load(); n != 0 {
+		t.Errorf("expected the cache to be emptied by a new filter but it has %d entries", n)
+	}
+
+	c.Check("new_feature:user:1")
+	c.filter.Load().insert([]byte("new_feature:user:1"))
+	c.negative.entries.Store("new_feature:user:1", negativeEntry{filter: c.filter.Load(), expires: time.Now().Add(-time.Second)})
+	if v := c.Check("new_feature:user:1"); !v {
+		t.Errorf("expected an expired entry to be re-evaluated but got %v", v)
+	}
+}
+
+func Test_negativeCache_bounded(t *testing.T) {
+	nc := &negativeCache{ttl: time.Hour}
+	f := &filter{}
+	now := time.Now()
+	for i := range maxNegativeCacheEntries + 10 {
+		nc.add(strconv.Itoa(i), f, now)
+	}
+	if n := nc.size.Load(); n > maxNegativeCacheEntries {
+		t.Errorf("expected at most %d entries but got %d", maxNegativeCacheEntries, n)
+	}
+	if !nc.disabled(strconv.Itoa(maxNegativeCacheEntries+9), f, now) {
+		t.Error("expected the latest key to be cached")
+	}
+	if nc.disabled(strconv.Itoa(maxNegativeCacheEntries+9), &filter{}, now) {
+		t.Error("expected an entry not to apply to another filter")
+	}
+}
@@ -0,0 +1,1895 @@
+package temper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testFilterResp is the same filter response served by the mock Temper
+// backend in temper_test.go.
+var testFilterResp = []byte(`{"filter":"AAAAAAAAAAChyQAAAAAAAKHJAAAAAAAAONKlyQAAAAAIhwAAAAAAAAAAAAAAAAAAAAAAAAAAAABAnQAAAAAAAAAAAAAAAAAAAAAAAAAAAADLPwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAcdx5tgAAAACNEQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAPaPvckAAAAAAAAAAAAAAACSYQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA==","rollout":"ZPPzHfbwt2xk7lAWLwPCQgE+Qryr1ydL"}`)
+
+// newTestClient returns a client using the given secret key and options, with
+// its filter initialized from testFilterResp, and ready.
+func newTestClient(t *testing.T, secretKey string, opt *Option) *Client {
+	t.Helper()
+
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	c := newClient("FAKE_KEY", secretKey, opt)
+	c.filter.Store(f)
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+	return c
+}
+
+func TestClientCheck_StrictUnknownFeatures(t *testing.T) {
+	var unknown []string
+	c := newTestClient(t, "", &Option{
+		StrictUnknownFeatures: true,
+		UnknownFeatureHandler: func(feature string) {
+			unknown = append(unknown, feature)
+		},
+	})
+
+	if v := c.Check("temper_api_e2e_rollout:user:3"); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	if len(unknown) != 0 {
+		t.Fatalf("expected no unknown features but got %v", unknown)
+	}
+
+	if v := c.Check("temper_api_e2e_typo"); v {
+		t.Errorf("expected temper_api_e2e_typo to be false but got %v", v)
+	}
+	if len(unknown) != 1 || unknown[0] != "temper_api_e2e_typo" {
+		t.Fatalf("expected temper_api_e2e_typo to be unknown but got %v", unknown)
+	}
+	// A feature that's only enabled for specific actors is unknown for any
+	// other actor, unless it has a rollout entry.
+	unknown = nil
+	if v := c.Check("temper_api_e2e:user:2"); v {
+		t.Errorf("expected temper_api_e2e:user:2 to be false but got %v", v)
+	}
+	if len(unknown) != 1 {
+		t.Errorf("expected temper_api_e2e:user:2 to be unknown without a rollout entry but got %v", unknown)
+	}
+
+	f, err := NewFilterFromMap(map[string]bool{"targeted:user:1": true}, map[string]uint8{"targeted": 0})
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+	c.filter.Store(f.f)
+	unknown = nil
+	for key, want := range map[string]bool{"targeted:user:1": true, "targeted:user:2": false} {
+		if v := c.Check(key); v != want {
+			t.Errorf("expected %s to be %v but got %v", key, want, v)
+		}
+	}
+	if len(unknown) != 0 {
+		t.Errorf("expected a feature with a rollout entry to be known for every actor but got %v", unknown)
+	}
+
+	c.filter.Store(&filter{killed: map[uint64]struct{}{hash([]byte("killed_feature")): {}}})
+	if v := c.Check("killed_feature:user:1"); v || len(unknown) != 0 {
+		t.Errorf("expected a killed feature to be known and false but got %v, %v", v, unknown)
+	}
+}
+
+func TestClientCheck_StrictUnknownFeaturesPanics(t *testing.T) {
+	c := newTestClient(t, "", &Option{StrictUnknownFeatures: true})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected Check to panic for an unknown feature")
+		}
+	}()
+	c.Check("temper_api_e2e_typo")
+}
+
+func TestClientCheckGlobal_StrictUnknownFeatures(t *testing.T) {
+	f, err := NewFilterFromMap(
+		map[string]bool{"region:eu": true},
+		map[string]uint8{"maintenance:eu": 100},
+	)
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+
+	var unknown []string
+	c := NewClientWithFilter(f, &Option{
+		StrictUnknownFeatures: true,
+		UnknownFeatureHandler: func(feature string) {
+			unknown = append(unknown, feature)
+		},
+	})
+
+	for _, feature := range []string{"region:eu", "maintenance:eu"} {
+		if v := c.CheckGlobal(feature); !v {
+			t.Errorf("expected %s to be true but got %v", feature, v)
+		}
+	}
+	if len(unknown) != 0 {
+		t.Fatalf("expected no unknown features but got %v", unknown)
+	}
+
+	if v := c.CheckGlobal("maintenance:us"); v {
+		t.Errorf("expected maintenance:us to be false but got %v", v)
+	}
+	if len(unknown) != 1 || unknown[0] != "maintenance:us" {
+		t.Errorf("expected maintenance:us to be unknown but got %v", unknown)
+	}
+}
+
+func TestClientCheck_StrictUnknownFeaturesIgnoredWithSecretKey(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", &Option{
+		StrictUnknownFeatures: true,
+		UnknownFeatureHandler: func(feature string) {
+			t.Errorf("expected unknown feature %s to be ignored with a secret key", feature)
+		},
+	})
+
+	if v := c.Check("temper_api_e2e_typo"); v {
+		t.Errorf("expected temper_api_e2e_typo to be false but got %v", v)
+	}
+}
+
+func TestClientFetchFilter_OnFetch(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	var gotDuration time.Duration
+	var gotBytes, gotStatus int
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL: srv.URL,
+		OnFetch: func(duration time.Duration, bytes int, status int) {
+			gotDuration, gotBytes, gotStatus = duration, bytes, status
+		},
+	})
+
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if gotDuration <= 0 {
+		t.Errorf("expected a positive duration but got %s", gotDuration)
+	}
+	if gotBytes != len(testFilterResp) {
+		t.Errorf("expected %d bytes but got %d", len(testFilterResp), gotBytes)
+	}
+	if gotStatus != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, gotStatus)
+	}
+
+	fail.Store(true)
+	if err := c.fetchFilter(context.Background()); err == nil {
+		t.Fatal("expected an error fetching from an unavailable backend")
+	}
+	if gotStatus != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d but got %d", http.StatusServiceUnavailable, gotStatus)
+	}
+	if gotBytes != len("unavailable\n") {
+		t.Errorf("expected %d bytes but got %d", len("unavailable\n"), gotBytes)
+	}
+}
+
+func TestClientFetchFilter_OnFetchTrace(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+		// Trailing data the decoder never reads must be drained before the
+		// connection can be reused.
+		w.Write([]byte("\n\n"))
+	}))
+	defer srv.Close()
+
+	var traces []FetchTrace
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL: srv.URL,
+		OnFetchTrace: func(trace FetchTrace) {
+			traces = append(traces, trace)
+		},
+	})
+
+	for range 2 {
+		if err := c.fetchFilter(context.Background()); err != nil {
+			t.Fatalf("failed to fetch filter: %v", err)
+		}
+	}
+	if len(traces) != 2 {
+		t.Fatalf("expected 2 traces but got %d", len(traces))
+	}
+	if traces[0].Reused || traces[0].Connect <= 0 {
+		t.Errorf("expected the first fetch to dial a new connection but got %+v", traces[0])
+	}
+	if !traces[1].Reused || !traces[1].WasIdle || traces[1].Connect != 0 {
+		t.Errorf("expected the second fetch to reuse the idle connection but got %+v", traces[1])
+	}
+}
+
+func TestClientCheck_DefaultsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults.json")
+	if err := os.WriteFile(path, []byte(`{"local_feature":true,"temper_api_e2e":false}`), 0o644); err != nil {
+		t.Fatalf("failed to write defaults file: %v", err)
+	}
+
+	c := newTestClient(t, "", &Option{DefaultsFile: path})
+	if v := c.Check("local_feature:user:1"); !v {
+		t.Errorf("expected local_feature:user:1 to be true but got %v", v)
+	}
+	if v := c.CheckGlobal("local_feature"); !v {
+		t.Errorf("expected local_feature to be true but got %v", v)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false but got %v", v)
+	}
+	if v := c.Check("temper_api_e2e_rollout:user:3"); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+
+	// The defaults file is ignored when a secret key is provided.
+	c = newTestClient(t, "FAKE_SECRET", &Option{DefaultsFile: path})
+	if v := c.Check("local_feature:user:1"); v {
+		t.Errorf("expected local_feature:user:1 to be false but got %v", v)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+}
+
+// countingCache counts the number of times it's cleared.
+type countingCache struct {
+	cleared int
+}
+
+func (cc *countingCache) clear() {
+	cc.cleared++
+}
+
+func TestClientClearCaches(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", nil)
+
+	// Clearing without any caches is a no-op.
+	c.ClearCaches()
+
+	cc := &countingCache{}
+	c.caches = append(c.caches, cc)
+	c.ClearCaches()
+	if cc.cleared != 1 {
+		t.Errorf("expected cache to be cleared once but got %d", cc.cleared)
+	}
+}
+
+// recordingLogger records every message it's asked to log.
+type recordingLogger struct {
+	messages []string
+}
+
+func (rl *recordingLogger) Printf(format string, v ...any) {
+	rl.messages = append(rl.messages, fmt.Sprintf(format, v...))
+}
+
+func TestNewClient_DebugConfig(t *testing.T) {
+	logger := &recordingLogger{}
+	newClient("pk_0123456789", "sk_0123456789", &Option{Logger: logger})
+	if len(logger.messages) != 0 {
+		t.Fatalf("expected nothing to be logged without debug enabled but got %v", logger.messages)
+	}
+
+	newClient("pk_0123456789", "sk_0123456789", &Option{Logger: logger, Debug: true, BaseURL: "http://localhost"})
+	if len(logger.messages) != 1 {
+		t.Fatalf("expected the effective config to be logged but got %v", logger.messages)
+	}
+	msg := logger.messages[0]
+	if !strings.Contains(msg, "base_url=http://localhost") || !strings.Contains(msg, "poll_interval=1m0s") {
+		t.Errorf("expected the effective config in %q", msg)
+	}
+	if strings.Contains(msg, "sk_0123456789") || !strings.Contains(msg, "secret_key=sk_0...") {
+		t.Errorf("expected the secret key to be redacted in %q", msg)
+	}
+}
+
+func TestOptionSetDefaults_MinPollInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opt  Option
+		want time.Duration
+		warn bool
+	}{
+		{"default", Option{}, defaultPollInterval, false},
+		{"configured", Option{PollInterval: 5 * time.Second}, 5 * time.Second, false},
+		{"clamped", Option{PollInterval: time.Millisecond}, defaultMinPollInterval, true},
+		{"negative", Option{PollInterval: -time.Second}, defaultPollInterval, false},
+		{"half a second", Option{PollInterval: 500 * time.Millisecond}, 500 * time.Millisecond, false},
+		{"sub-second", Option{PollInterval: 500 * time.Millisecond, MinPollInterval: 100 * time.Millisecond}, 500 * time.Millisecond, false},
+		{"configured floor", Option{PollInterval: 100 * time.Millisecond, MinPollInterval: 50 * time.Millisecond}, 100 * time.Millisecond, false},
+		{"clamped to configured floor", Option{PollInterval: 10 * time.Millisecond, MinPollInterval: 50 * time.Millisecond}, 50 * time.Millisecond, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			tt.opt.Logger = logger
+			tt.opt.setDefaults()
+
+			if tt.opt.PollInterval != tt.want {
+				t.Errorf("expected poll interval %s but got %s", tt.want, tt.opt.PollInterval)
+			}
+			if warned := len(logger.messages) > 0; warned != tt.warn {
+				t.Errorf("expected warning to be %t but got messages %v", tt.warn, logger.messages)
+			}
+		})
+	}
+}
+
+func TestClientCheckIn(t *testing.T) {
+	tenantResp, err := json.Marshal(&FilterResponse{
+		Rollout: encodeRollouts(map[string]uint8{"tenant_feature": 100}),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode filter response: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/public/filter", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("tenant") == "b" {
+			w.Write(tenantResp)
+			return
+		}
+		w.Write(testFilterResp)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL: srv.URL,
+		Scopes: map[string]string{
+			"a":       "/api/public/filter?tenant=a",
+			"b":       "/api/public/filter?tenant=b",
+			"missing": "/missing",
+		},
+		Logger: &recordingLogger{},
+	})
+	c.initialFetch(context.Background())
+
+	if v := c.CheckIn("a", "temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true in scope a but got %v", v)
+	}
+	if v := c.CheckIn("b", "temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false in scope b but got %v", v)
+	}
+	if v := c.CheckIn("b", "tenant_feature:user:1"); !v {
+		t.Errorf("expected tenant_feature:user:1 to be true in scope b but got %v", v)
+	}
+	if v := c.CheckIn("missing", "temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false in a scope that failed to fetch but got %v", v)
+	}
+	if v := c.CheckIn("unknown", "temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false in an unknown scope but got %v", v)
+	}
+}
+
+func TestClientReady_cancelAbortsFetch(t *testing.T) {
+	aborted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL})
+	c.filter.Store(&filter{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.Ready(ctx); err == nil {
+		t.Fatal("expected an error when the context times out before the filter is ready")
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the in-flight fetch to be aborted when the context timed out")
+	}
+	if c.filter.Load().cap != 0 || c.filter.Load().rollouts != nil {
+		t.Error("expected no filter to be installed after the context timed out")
+	}
+}
+
+func TestClientReady(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL})
+	if err := c.Ready(context.Background()); err != nil {
+		t.Fatalf("expected the filter to be ready but got %v", err)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+
+	// Once ready, Ready returns immediately without fetching again.
+	srv.Close()
+	if err := c.Ready(context.Background()); err != nil {
+		t.Fatalf("expected the filter to still be ready but got %v", err)
+	}
+}
+
+func TestClientCheck_Overrides(t *testing.T) {
+	var auth atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"temper_api_e2e:user:1":false,"temper_api_e2e_rollout":false,"qa_only":true}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{OverridesURL: srv.URL + "/qa/overrides?session=1"})
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Fatalf("expected temper_api_e2e:user:1 to be true before fetching overrides but got %v", v)
+	}
+
+	if err := c.fetchOverrides(context.Background()); err != nil {
+		t.Fatalf("failed to fetch overrides: %v", err)
+	}
+	if got := auth.Load(); got != "Bearer FAKE_KEY" {
+		t.Errorf("expected overrides to be fetched with the publishable key but got %q", got)
+	}
+
+	for key, want := range map[string]bool{
+		"temper_api_e2e:user:1":           false,
+		"temper_api_e2e_rollout:user:3":   false,
+		"qa_only":                         true,
+		"temper_api_e2e_nonexistent_feat": false,
+	} {
+		if v := c.Check(key); v != want {
+			t.Errorf("expected %s to be %v but got %v", key, want, v)
+		}
+	}
+}
+
+func TestClientEvaluateAll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != featuresPath || r.Header.Get("Authorization") != "Bearer FAKE_SECRET" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"features":["temper_api_e2e","temper_api_e2e_rollout","temper_api_e2e_off"]}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{BaseURL: srv.URL})
+	got, err := c.EvaluateAll(context.Background(), "user", "1")
+	if err != nil {
+		t.Fatalf("failed to evaluate all features: %v", err)
+	}
+
+	expected := map[string]bool{
+		"temper_api_e2e":         true,
+		"temper_api_e2e_rollout": true,
+		"temper_api_e2e_off":     false,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+
+	c = newTestClient(t, "", &Option{BaseURL: srv.URL})
+	if _, err := c.EvaluateAll(context.Background(), "user", "1"); err == nil {
+		t.Error("expected an error evaluating all features without a secret key")
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	var maintenance atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"maintenance":%t}`, maintenance.Load())
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{OverridesURL: srv.URL})
+
+	var calls []bool
+	c.Watch("maintenance", func(enabled bool) {
+		calls = append(calls, enabled)
+	})
+
+	poll := func() {
+		t.Helper()
+		if err := c.fetchOverrides(context.Background()); err != nil {
+			t.Fatalf("failed to fetch overrides: %v", err)
+		}
+	}
+
+	poll()
+	if len(calls) != 0 {
+		t.Fatalf("expected no calls when the result didn't change but got %v", calls)
+	}
+
+	maintenance.Store(true)
+	poll()
+	poll()
+	maintenance.Store(false)
+	poll()
+
+	if !reflect.DeepEqual(calls, []bool{true, false}) {
+		t.Errorf("expected a call for each change but got %v", calls)
+	}
+}
+
+func TestClientWatch_Concurrent(t *testing.T) {
+	var polls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"maintenance":%t}`, polls.Add(1)%2 == 0)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{OverridesURL: srv.URL})
+
+	var calls atomic.Int64
+	c.Watch("maintenance", func(enabled bool) {
+		calls.Add(1)
+	})
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if err := c.fetchOverrides(context.Background()); err != nil {
+					t.Errorf("failed to fetch overrides: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls.Load() == 0 {
+		t.Error("expected the watcher to be called")
+	}
+}
+
+func TestClientWatch_UnknownFeaturePanics(t *testing.T) {
+	var panics atomic.Bool
+	c := newTestClient(t, "", &Option{
+		StrictUnknownFeatures: true,
+		UnknownFeatureHandler: func(feature string) {
+			if panics.Load() {
+				panic("unknown feature " + feature)
+			}
+		},
+	})
+	c.Watch("temper_api_e2e_typo", func(bool) {})
+
+	panics.Store(true)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected notifying watchers to panic")
+			}
+		}()
+		c.notifyWatchers()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.HasChanged("temper_api_e2e:user:1")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the watchers to be unlocked after a panic")
+	}
+}
+
+func TestClientHasChanged(t *testing.T) {
+	var maintenance atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"maintenance":%t}`, maintenance.Load())
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{OverridesURL: srv.URL})
+	if c.HasChanged("maintenance") {
+		t.Fatal("expected a newly watched key not to have changed")
+	}
+
+	poll := func(want bool) {
+		t.Helper()
+		if err := c.fetchOverrides(context.Background()); err != nil {
+			t.Fatalf("failed to fetch overrides: %v", err)
+		}
+		if v := c.HasChanged("maintenance"); v != want {
+			t.Errorf("expected HasChanged to be %v but got %v", want, v)
+		}
+	}
+
+	poll(false)
+	maintenance.Store(true)
+	poll(true)
+	poll(false)
+	maintenance.Store(false)
+	poll(true)
+}
+
+func TestClientFetchFilter_MaxResponseBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"filter":"%s"}`, strings.Repeat("A", 4<<20))
+	}))
+	defer srv.Close()
+
+	opt := &Option{BaseURL: srv.URL, MaxFilterBytes: 16, MaxRolloutEntries: 1, Logger: &recordingLogger{}}
+	c := newClient("FAKE_KEY", "FAKE_SECRET", opt)
+	err := c.fetchFilter(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("expected an error for a response over the limit but got %v", err)
+	}
+	if max := opt.maxResponseBytes(); max >= 4<<20 {
+		t.Errorf("expected the response limit to be derived from the options but got %d", max)
+	}
+}
+
+func TestClientFetchFilter_EndlessBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+		padding := []byte(strings.Repeat(" ", 1<<10))
+		for r.Context().Err() == nil {
+			if _, err := w.Write(padding); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, Logger: &recordingLogger{}})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fetchFilter(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("failed to fetch filter: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the fetch to return without draining an endless body")
+	}
+}
+
+func TestClientHealthy(t *testing.T) {
+	var garbage atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if garbage.Load() {
+			w.Write([]byte(`{"filter":"not base64"`))
+			return
+		}
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, MaxDecodeFailures: 3, Logger: &recordingLogger{}})
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+
+	garbage.Store(true)
+	for i := range 3 {
+		if !c.Healthy() {
+			t.Fatalf("expected the client to be healthy after %d decode failures", i)
+		}
+		if err := c.fetchFilter(context.Background()); err == nil {
+			t.Fatal("expected an error decoding a malformed filter")
+		}
+	}
+	if c.Healthy() {
+		t.Error("expected the client to be unhealthy after 3 decode failures")
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the last good filter to be used but got %v", v)
+	}
+
+	garbage.Store(false)
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if !c.Healthy() {
+		t.Error("expected the client to be healthy again after a good filter")
+	}
+}
+
+func TestClientFetchFilter_ExpectedEnvironment(t *testing.T) {
+	var header, field string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if header != "" {
+			w.Header().Set(environmentHeader, header)
+		}
+		resp := strings.TrimSuffix(string(testFilterResp), "}") + fmt.Sprintf(`,"environment":%q}`, field)
+		w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name          string
+		header, field string
+		ok            bool
+	}{
+		{"header", "production", "", true},
+		{"field", "", "production", true},
+		{"header takes precedence", "production", "staging", true},
+		{"mismatch", "staging", "", false},
+		{"missing", "", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			header, field = tt.header, tt.field
+
+			c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, ExpectedEnvironment: "production", Logger: &recordingLogger{}})
+			err := c.initialFetch(context.Background())
+			if tt.ok && err != nil {
+				t.Fatalf("expected no error but got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error for the wrong environment")
+			}
+			if v := c.Check("temper_api_e2e:user:1"); v != tt.ok {
+				t.Errorf("expected temper_api_e2e:user:1 to be %v but got %v", tt.ok, v)
+			}
+		})
+	}
+}
+
+// fakeFetcher is a FilterFetcher that returns fixed data.
+type fakeFetcher struct {
+	fr      *FilterResponse
+	err     error
+	fetches int
+}
+
+func (ff *fakeFetcher) Fetch(ctx context.Context) (*FilterResponse, error) {
+	ff.fetches++
+	return ff.fr, ff.err
+}
+
+func TestClientFetchFilter_Fetcher(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	fr.Environment = "staging"
+
+	ff := &fakeFetcher{fr: fr}
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: "http://127.0.0.1:0", Fetcher: ff, Logger: &recordingLogger{}})
+	if err := c.initialFetch(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if ff.fetches != 1 {
+		t.Errorf("expected the fetcher to be used once but got %d", ff.fetches)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+
+	ff.fr, ff.err = nil, errors.New("unavailable")
+	if err := c.fetchFilter(context.Background()); err == nil || !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected the fetcher's error but got %v", err)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the previous filter to be kept after an error but got %v", v)
+	}
+
+	ff.fr, ff.err = nil, nil
+	if err := c.fetchFilter(context.Background()); err == nil || !strings.Contains(err.Error(), "no filter response") {
+		t.Errorf("expected an error for a fetcher without a response but got %v", err)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the previous filter to be kept without a response but got %v", v)
+	}
+
+	c = newClient("FAKE_KEY", "FAKE_SECRET", &Option{Fetcher: &fakeFetcher{fr: fr}, ExpectedEnvironment: "production", Logger: &recordingLogger{}})
+	if err := c.initialFetch(context.Background()); err == nil {
+		t.Error("expected an error for the wrong environment from a custom fetcher")
+	}
+}
+
+func TestClientCheckAudited(t *testing.T) {
+	var audited []AuditResult
+	c := newTestClient(t, "FAKE_SECRET", &Option{
+		AlwaysOnActors: []string{"user:42"},
+		OnAudit: func(result AuditResult) {
+			audited = append(audited, result)
+		},
+	})
+	c.overrides.Store(&map[string]bool{"maintenance": true})
+
+	version := c.CurrentFilter().Version()
+	if version == "" {
+		t.Fatal("expected the filter to have a version")
+	}
+
+	for _, tt := range []struct {
+		feature string
+		enabled bool
+		reason  string
+	}{
+		{"maintenance", true, "override"},
+		{"temper_api_e2e_rollout:user:3", true, "rollout"},
+		{"temper_api_e2e:user:1", true, "filter"},
+		{"temper_api_e2e:user:42", true, "always_on"},
+		{"unknown_feature:user:1", false, "no_match"},
+	} {
+		res := c.CheckAudited(tt.feature)
+		if res.Enabled != tt.enabled || res.Reason != tt.reason {
+			t.Errorf("expected %s to be %v because of %q but got %v because of %q", tt.feature, tt.enabled, tt.reason, res.Enabled, res.Reason)
+		}
+		if res.Enabled != c.Check(tt.feature) {
+			t.Errorf("expected %s to be audited the same way as it's checked", tt.feature)
+		}
+		if res.FilterVersion != version {
+			t.Errorf("expected filter version %q but got %q", version, res.FilterVersion)
+		}
+		if res.EvaluatedAt.IsZero() {
+			t.Errorf("expected %s to have an evaluation time", tt.feature)
+		}
+	}
+	if len(audited) != 5 {
+		t.Errorf("expected every audited check to be passed to OnAudit but got %d", len(audited))
+	}
+
+	other := newTestClient(t, "FAKE_SECRET", nil)
+	if v := other.CurrentFilter().Version(); v != version {
+		t.Errorf("expected filters with the same data to have the same version but got %q and %q", version, v)
+	}
+	other.filter.Load().insert([]byte("new_feature"))
+	if v := other.CurrentFilter().Version(); v == version {
+		t.Error("expected the version to change with the filter's data")
+	}
+}
+
+func TestClientCheckFirst(t *testing.T) {
+	var checked []string
+	c := newTestClient(t, "", &Option{
+		StrictUnknownFeatures: true,
+		UnknownFeatureHandler: func(feature string) {
+			checked = append(checked, feature)
+		},
+	})
+
+	if v := c.CheckFirst("temper_api_e2e_rollout:user:3", "unknown_feature"); !v {
+		t.Errorf("expected the first key to match but got %v", v)
+	}
+	if len(checked) != 0 {
+		t.Errorf("expected keys after the first match not to be checked but got %v", checked)
+	}
+
+	if v := c.CheckFirst("unknown_feature:user:1", "unknown_feature"); v {
+		t.Errorf("expected no key to match but got %v", v)
+	}
+	if len(checked) != 2 {
+		t.Errorf("expected every key to be checked but got %v", checked)
+	}
+
+	if v := c.CheckFirst(); v {
+		t.Errorf("expected no keys to be false but got %v", v)
+	}
+
+	c = newTestClient(t, "", nil)
+	if v := c.CheckFirst("temper_api_e2e:user:2", "temper_api_e2e:user:1"); !v {
+		t.Errorf("expected to fall back to the second key but got %v", v)
+	}
+}
+
+func TestClientEnabledActors(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	c := newTestClient(t, "FAKE_SECRET", nil)
+	f, err := from(&FilterResponse{
+		Filter:  fr.Filter,
+		Rollout: encodeRollouts(map[string]uint8{"test_team_feature": 50}),
+		Killed:  binary.LittleEndian.AppendUint64(nil, hash([]byte("killed_feature"))),
+	})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	c.filter.Store(f)
+
+	if got := c.EnabledActors("test_team_feature", "user", []string{"1", "4"}); !slices.Equal(got, []string{"4"}) {
+		t.Errorf("expected only actor 4 to be enabled but got %v", got)
+	}
+
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	for _, feature := range []string{"temper_api_e2e", "test_team_feature", "killed_feature"} {
+		var want []string
+		for _, id := range ids {
+			if c.Check(feature + ":user:" + id) {
+				want = append(want, id)
+			}
+		}
+		if got := c.EnabledActors(feature, "user", ids); !slices.Equal(got, want) {
+			t.Errorf("expected %s to be enabled for %v but got %v", feature, want, got)
+		}
+	}
+}
+
+func TestNewClientFromBase64(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	filterB64 := base64.StdEncoding.EncodeToString(fr.Filter)
+	rolloutB64 := base64.StdEncoding.EncodeToString(fr.Rollout)
+
+	for _, tt := range []struct {
+		name                string
+		filterB64, rollouts string
+	}{
+		{"base64", filterB64, rolloutB64},
+		{"data uri", "data:application/octet-stream;base64," + filterB64, "data:;base64," + rolloutB64},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newClientFromBase64(tt.filterB64, tt.rollouts)
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			if err := c.Ready(context.Background()); err != nil {
+				t.Fatalf("expected the client to be ready but got %v", err)
+			}
+			if v := c.Check("temper_api_e2e:user:1"); !v {
+				t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+			}
+			if v := c.Check("temper_api_e2e_rollout:user:3"); !v {
+				t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+			}
+		})
+	}
+
+	if _, err := newClientFromBase64("not base64!", ""); err == nil {
+		t.Error("expected an error for invalid base64")
+	}
+	if _, err := newClientFromBase64("data:text/plain,abc", ""); err == nil {
+		t.Error("expected an error for a data uri that isn't base64")
+	}
+	if _, err := newClientFromBase64("AAAA", ""); err == nil {
+		t.Error("expected an error for a filter that doesn't decode")
+	}
+}
+
+func TestInitFromBase64_AlreadyInitialized(t *testing.T) {
+	// The client has already been initialized by Init in TestMain.
+	before := c
+	if err := InitFromBase64("", ""); !errors.Is(err, errAlreadyInitialized) {
+		t.Errorf("expected %v but got %v", errAlreadyInitialized, err)
+	}
+	if c != before {
+		t.Error("expected the client not to be replaced")
+	}
+}
+
+func TestClientFilterContains(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", nil)
+
+	if v := c.FilterContains("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be in the filter but got %v", v)
+	}
+	// Enabled by a rollout, rather than the filter.
+	if v := c.FilterContains("temper_api_e2e_rollout:user:3"); v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 not to be in the filter but got %v", v)
+	}
+}
+
+func TestClientCheck_PreReadyBehavior(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	t.Run("ReturnFalse", func(t *testing.T) {
+		c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL})
+		c.filter.Store(&filter{})
+		if v := c.Check("temper_api_e2e:user:1"); v {
+			t.Errorf("expected temper_api_e2e:user:1 to be false but got %v", v)
+		}
+	})
+
+	t.Run("ReturnDefault", func(t *testing.T) {
+		c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+			BaseURL:          srv.URL,
+			PreReadyBehavior: ReturnDefault,
+			PreReadyDefaults: map[string]bool{"temper_api_e2e_off": true},
+		})
+		c.filter.Store(&filter{})
+		if v := c.Check("temper_api_e2e_off:user:1"); !v {
+			t.Errorf("expected the default for temper_api_e2e_off:user:1 to be true but got %v", v)
+		}
+		if v := c.Check("temper_api_e2e:user:1"); v {
+			t.Errorf("expected temper_api_e2e:user:1 without a default to be false but got %v", v)
+		}
+
+		if err := c.fetchFilter(context.Background()); err != nil {
+			t.Fatalf("failed to fetch filter: %v", err)
+		}
+		if v := c.Check("temper_api_e2e_off:user:1"); v {
+			t.Errorf("expected temper_api_e2e_off:user:1 to be false once ready but got %v", v)
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, PreReadyBehavior: Block})
+		c.filter.Store(&filter{})
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			c.fetchFilter(context.Background())
+		}()
+		if v := c.Check("temper_api_e2e:user:1"); !v {
+			t.Errorf("expected Check to block until the filter was fetched but got %v", v)
+		}
+	})
+
+	t.Run("BlockTimeout", func(t *testing.T) {
+		c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, PreReadyBehavior: Block, PreReadyTimeout: 10 * time.Millisecond})
+		c.filter.Store(&filter{})
+		if v := c.Check("temper_api_e2e:user:1"); v {
+			t.Errorf("expected temper_api_e2e:user:1 to be false after timing out but got %v", v)
+		}
+	})
+}
+
+func TestClientRolloutBucket(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", nil)
+
+	// The same keys as in Test_filter_RolloutPercentage.
+	if v := c.RolloutBucket("test_team_feature:user:1"); v != 74 {
+		t.Errorf("expected bucket 74 but got %d", v)
+	}
+	if v := c.RolloutBucket("test_team_feature:user:4"); v != 41 {
+		t.Errorf("expected bucket 41 but got %d", v)
+	}
+
+	for i := range 1000 {
+		if v := c.RolloutBucket(fmt.Sprintf("test_team_feature:user:%d", i)); v > 99 {
+			t.Fatalf("expected a bucket from 0 to 99 but got %d", v)
+		}
+	}
+}
+
+func TestClientPausePolling(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", &Option{
+		PollInterval:    time.Millisecond,
+		MinPollInterval: time.Millisecond,
+		Logger:          log.New(io.Discard, "", 0),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var fetches atomic.Int64
+	go c.poll(ctx, "test", func(ctx context.Context) error {
+		fetches.Add(1)
+		return nil
+	})
+
+	waitForFetches := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for fetches.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected at least %d fetches but got %d", n, fetches.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForFetches(1)
+
+	c.PausePolling()
+	// Let a fetch that was already in progress finish.
+	time.Sleep(10 * time.Millisecond)
+	paused := fetches.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := fetches.Load(); n != paused {
+		t.Fatalf("expected no fetches while paused but got %d", n-paused)
+	}
+
+	c.ResumePolling()
+	waitForFetches(paused + 1)
+}
+
+func TestClientCheck_ConcurrentFetches(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, "FAKE_SECRET", &Option{
+		BaseURL:         srv.URL,
+		PollInterval:    time.Millisecond,
+		MinPollInterval: time.Millisecond,
+		Logger:          &recordingLogger{},
+	})
+	c.startPolling()
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				if v := c.Check("temper_api_e2e:user:1"); !v {
+					t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+					return
+				}
+				c.CheckGlobal("temper_api_e2e")
+				c.Stats()
+			}
+		}()
+	}
+	for range 20 {
+		if err := c.fetchFilter(context.Background()); err != nil {
+			t.Fatalf("failed to fetch filter: %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestNewClient(t *testing.T) {
+	serve := func(ok bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ok {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(testFilterResp)
+		}))
+	}
+	prod, staging := serve(true), serve(false)
+	defer prod.Close()
+	defer staging.Close()
+
+	prodClient, err := NewClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: prod.URL, Logger: &recordingLogger{}})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer prodClient.Close()
+	stagingClient, err := NewClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: staging.URL, Logger: &recordingLogger{}})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer stagingClient.Close()
+
+	if v := prodClient.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true in the first client but got %v", v)
+	}
+	if v := stagingClient.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false in the client without a filter but got %v", v)
+	}
+	if !prodClient.Config().Polling || !stagingClient.Config().Polling {
+		t.Error("expected both clients to be polling")
+	}
+
+	if _, err := NewClient(" ", "FAKE_SECRET"); err == nil {
+		t.Error("expected an error for an empty publishable key")
+	}
+
+	keyFuncClient, err := NewClient("", "FAKE_SECRET", &Option{
+		BaseURL:            prod.URL,
+		PublishableKeyFunc: func() (string, error) { return "FAKE_KEY", nil },
+		Logger:             &recordingLogger{},
+	})
+	if err != nil {
+		t.Fatalf("expected an empty publishable key with a PublishableKeyFunc to be allowed but got %v", err)
+	}
+	defer keyFuncClient.Close()
+	if v := keyFuncClient.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true in the client with a PublishableKeyFunc but got %v", v)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	var fetches atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL:         srv.URL,
+		PollInterval:    time.Millisecond,
+		MinPollInterval: time.Millisecond,
+		Logger:          &recordingLogger{},
+	})
+	c.startPolling()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fetches.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least 2 fetches but got %d", fetches.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close client: %v", err)
+	}
+	// Let the server finish handling a fetch that was cancelled in flight.
+	time.Sleep(10 * time.Millisecond)
+	closed := fetches.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := fetches.Load(); n != closed {
+		t.Errorf("expected no fetches after closing but got %d", n-closed)
+	}
+	if c.Config().Polling {
+		t.Error("expected a closed client not to be polling")
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the last filter to still be used after closing but got %v", v)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("expected closing twice not to fail but got %v", err)
+	}
+}
+
+func TestPollFailures(t *testing.T) {
+	errDown := errors.New("backend is down")
+	start := time.Now()
+
+	logger := &recordingLogger{}
+	p := &pollFailures{what: "filter", interval: time.Hour, logger: logger}
+	for i := range 120 {
+		p.failed(start.Add(time.Duration(i)*time.Minute), errDown)
+	}
+	if len(logger.messages) != 2 {
+		t.Fatalf("expected the first failure and one failure an hour later to be logged but got %v", logger.messages)
+	}
+	if !strings.Contains(logger.messages[1], "61 polls have failed") {
+		t.Errorf("expected the number of failures to be logged but got %q", logger.messages[1])
+	}
+
+	p.succeeded(start.Add(2 * time.Hour))
+	p.succeeded(start.Add(2*time.Hour + time.Minute))
+	if len(logger.messages) != 3 || !strings.Contains(logger.messages[2], "recovered") {
+		t.Fatalf("expected the recovery to be logged once but got %v", logger.messages)
+	}
+
+	// Without an interval, every failure is logged.
+	logger = &recordingLogger{}
+	p = &pollFailures{what: "filter", logger: logger}
+	for i := range 3 {
+		p.failed(start.Add(time.Duration(i)*time.Minute), errDown)
+	}
+	if len(logger.messages) != 3 {
+		t.Errorf("expected every failure to be logged but got %v", logger.messages)
+	}
+}
+
+func TestClientCheck_MaxFilterAge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, MaxFilterAge: time.Hour})
+	if !c.LastUpdated().IsZero() {
+		t.Errorf("expected no last update before the first fetch but got %s", c.LastUpdated())
+	}
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if d := time.Since(c.LastUpdated()); d < 0 || d > time.Minute {
+		t.Errorf("expected the filter to have just been updated but got %s", c.LastUpdated())
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+
+	c.updated.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if v := c.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to fail closed but got %v", v)
+	}
+	if v := c.CheckGlobal("temper_api_e2e_rollout"); v {
+		t.Errorf("expected temper_api_e2e_rollout to fail closed but got %v", v)
+	}
+
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true after a fresh fetch but got %v", v)
+	}
+
+	// A filter that was never fetched isn't trusted.
+	c = newTestClient(t, "FAKE_SECRET", &Option{MaxFilterAge: time.Hour})
+	if v := c.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to fail closed but got %v", v)
+	}
+}
+
+func TestClientFetchFilter_CallbackPanics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	logger := &recordingLogger{}
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL: srv.URL,
+		Logger:  logger,
+		OnFetch: func(duration time.Duration, bytes int, status int) {
+			panic("buggy OnFetch")
+		},
+	})
+
+	c.filter.Store(&filter{})
+
+	var called bool
+	c.Watch("temper_api_e2e:user:1", func(enabled bool) {
+		panic("buggy watcher")
+	})
+	c.Watch("temper_api_e2e_rollout:user:3", func(enabled bool) {
+		called = true
+	})
+
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the filter to be installed despite the panics but got %v", v)
+	}
+	if !called {
+		t.Error("expected the other watchers to be called after a panic")
+	}
+	if len(logger.messages) != 2 {
+		t.Fatalf("expected both panics to be logged but got %v", logger.messages)
+	}
+	for i, name := range []string{"OnFetch", "Watch"} {
+		if !strings.Contains(logger.messages[i], "panic in "+name) {
+			t.Errorf("expected the panic in %s to be logged but got %q", name, logger.messages[i])
+		}
+	}
+}
+
+func TestClientCheck_AlwaysOnActors(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", &Option{AlwaysOnActors: []string{"user:42"}})
+	f, err := from(&FilterResponse{
+		Rollout: encodeRollouts(map[string]uint8{"test_team_feature": 0}),
+		Killed:  binary.LittleEndian.AppendUint64(nil, hash([]byte("killed_feature"))),
+	})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	c.filter.Store(f)
+
+	for _, key := range []string{"test_team_feature:user:42", "unknown_feature:user:42"} {
+		if v := c.Check(key); !v {
+			t.Errorf("expected %s to be true for an always on actor but got %v", key, v)
+		}
+	}
+	for _, key := range []string{"test_team_feature:user:4", "test_team_feature:org:42", "killed_feature:user:42"} {
+		if v := c.Check(key); v {
+			t.Errorf("expected %s to be false but got %v", key, v)
+		}
+	}
+
+	got := c.EnabledActors("test_team_feature", "user", []string{"4", "42"})
+	if !slices.Equal(got, []string{"42"}) {
+		t.Errorf("expected only actor 42 to be enabled but got %v", got)
+	}
+	if got := c.EnabledActors("killed_feature", "user", []string{"42"}); len(got) != 0 {
+		t.Errorf("expected no actors to be enabled for a killed feature but got %v", got)
+	}
+}
+
+func TestClientCheck_RolloutSalt(t *testing.T) {
+	f, err := from(&FilterResponse{Rollout: encodeRollouts(map[string]uint8{"holdout": 10})})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	day := "2026-10-15"
+	c := newTestClient(t, "FAKE_SECRET", &Option{RolloutSalt: func() string { return day }})
+	c.filter.Store(f)
+	unsalted := newTestClient(t, "FAKE_SECRET", nil)
+	unsalted.filter.Store(f)
+
+	ids := make([]string, 1000)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i)
+	}
+	enabled := func() []string {
+		var enabled []string
+		for _, id := range ids {
+			key := "holdout:user:" + id
+			v := c.Check(key)
+			if want := unsalted.CheckSeeded(key, day); v != want {
+				t.Fatalf("expected %s to be the same as with the salt as a seed, %v, but got %v", key, want, v)
+			}
+			if v {
+				enabled = append(enabled, id)
+			}
+		}
+		if got := c.EnabledActors("holdout", "user", ids); !slices.Equal(got, enabled) {
+			t.Fatalf("expected the same actors to be enabled as by Check but got %v", got)
+		}
+		return enabled
+	}
+
+	first := enabled()
+	day = "2026-10-16"
+	second := enabled()
+	if len(first) < 50 || len(second) < 50 || slices.Equal(first, second) {
+		t.Errorf("expected a fresh 10%% of actors each day but got %d then %d", len(first), len(second))
+	}
+}
+
+// signingTransport signs every request with the Authorization header it was
+// sent with, like an API gateway's signer.
+type signingTransport struct {
+	base http.RoundTripper
+}
+
+func (st *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Signature", "signed "+req.Header.Get("Authorization"))
+	return st.base.RoundTrip(req)
+}
+
+func TestClientFetchFilter_TransportWrapper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "signed Bearer FAKE_KEY" {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	var wrapped http.RoundTripper
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+		BaseURL: srv.URL,
+		TransportWrapper: func(base http.RoundTripper) http.RoundTripper {
+			wrapped = base
+			return &signingTransport{base: base}
+		},
+	})
+	if wrapped != http.DefaultTransport {
+		t.Errorf("expected the default transport to be wrapped but got %v", wrapped)
+	}
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter through the signing transport: %v", err)
+	}
+}
+
+func TestClient_SecretKeyFunc(t *testing.T) {
+	var auth atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("FIRST_SECRET\n"), 0o600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	c := newClient("FAKE_KEY", "", &Option{
+		SecretKeyFunc: SecretKeyFromFile(path),
+		KeyCacheTTL:   time.Hour,
+	})
+	if c.devMode {
+		t.Error("expected a client with a secret key func not to be in dev mode")
+	}
+
+	get := func(p string) string {
+		t.Helper()
+		resp, err := c.http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", p, err)
+		}
+		resp.Body.Close()
+		return auth.Load().(string)
+	}
+
+	if got := get("/api/private"); got != "Bearer FIRST_SECRET" {
+		t.Errorf("expected the secret key from the file but got %q", got)
+	}
+	if got := get("/api/public/filter"); got != "Bearer FAKE_KEY" {
+		t.Errorf("expected the public API to use the publishable key but got %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte("SECOND_SECRET"), 0o600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+	if got := get("/api/private"); got != "Bearer FIRST_SECRET" {
+		t.Errorf("expected the cached secret key but got %q", got)
+	}
+	c.tokens.secretKeyFunc.expires = time.Time{}
+	if got := get("/api/private"); got != "Bearer SECOND_SECRET" {
+		t.Errorf("expected the rotated secret key once the cache expired but got %q", got)
+	}
+
+	os.Remove(path)
+	c.tokens.secretKeyFunc.expires = time.Time{}
+	if _, err := c.http.Get(srv.URL + "/api/private"); err == nil || !strings.Contains(err.Error(), "failed to get secret key") {
+		t.Errorf("expected an error when the secret key can't be read but got %v", err)
+	}
+}
+
+func TestClientFetchFilter_HTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "signed Bearer FAKE_KEY" {
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/api/public/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	hc := &http.Client{
+		Transport: &signingTransport{base: http.DefaultTransport},
+		Timeout:   50 * time.Millisecond,
+	}
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, HTTPClient: hc})
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter through the custom transport: %v", err)
+	}
+	if _, ok := hc.Transport.(*signingTransport); !ok {
+		t.Errorf("expected the custom client not to be modified but got transport %T", hc.Transport)
+	}
+
+	c = newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, FilterPath: "/api/public/slow", HTTPClient: hc})
+	if err := c.fetchFilter(context.Background()); err == nil {
+		t.Error("expected the custom client's timeout to apply")
+	}
+}
+
+func TestClientFetchFilter_FilterPath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/external/temper/api/public/filter", "/external/temper/flags":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer FAKE_KEY" {
+			http.Error(w, "expected the publishable key but got "+got, http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	for _, filterPath := range []string{"", "/flags"} {
+		c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{
+			BaseURL:    srv.URL + "/external/temper",
+			FilterPath: filterPath,
+		})
+		if err := c.fetchFilter(context.Background()); err != nil {
+			t.Errorf("failed to fetch filter from path %q: %v", filterPath, err)
+		}
+	}
+}
+
+func TestClientFetchFilter_ContentType(t *testing.T) {
+	var contentType atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType.Load().(string))
+		if strings.HasPrefix(contentType.Load().(string), "text/html") {
+			w.Write([]byte("<html><body>" + strings.Repeat("Bad Gateway ", 50) + "</body></html>"))
+			return
+		}
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL})
+
+	contentType.Store("application/json; charset=utf-8")
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("expected a json content type with a charset to be accepted but got %v", err)
+	}
+
+	contentType.Store("text/html; charset=utf-8")
+	err := c.fetchFilter(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for an html response")
+	}
+	if msg := err.Error(); !strings.Contains(msg, `"text/html; charset=utf-8"`) || !strings.Contains(msg, "<html><body>Bad Gateway") {
+		t.Errorf("expected the content type and a snippet of the body in the error but got %q", msg)
+	}
+	if len(err.Error()) > 400 {
+		t.Errorf("expected the snippet of the body to be truncated but got %d bytes", len(err.Error()))
+	}
+}
+
+func TestNewClientFromMap(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		c, err := newClientFromMap(
+			map[string]bool{"beta:user:1": true, "beta:user:2": false},
+			map[string]uint8{"launched": 100, "test_team_feature": 50},
+			&Option{CompactFilter: compact},
+		)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		if err := c.Ready(context.Background()); err != nil {
+			t.Fatalf("expected the client to be ready but got %v", err)
+		}
+
+		for key, want := range map[string]bool{
+			"beta:user:1":              true,
+			"beta:user:2":              false,
+			"launched:user:2":          true,
+			"test_team_feature:user:1": false,
+			"test_team_feature:user:4": true,
+		} {
+			if v := c.Check(key); v != want {
+				t.Errorf("expected %s to be %v with compact=%t but got %v", key, want, compact, v)
+			}
+		}
+	}
+
+	if _, err := newClientFromMap(nil, map[string]uint8{"over": 101}); err == nil {
+		t.Error("expected an error for a rollout over 100")
+	}
+}
+
+func Test_initialize(t *testing.T) {
+	// The client has already been initialized by Init in TestMain.
+	if initialize(func() { t.Error("expected an initialized client not to be initialized again") }) {
+		t.Error("expected initialize to report that it didn't run")
+	}
+
+	// Pretend the client has been closed, and initialize it concurrently.
+	initMu.Lock()
+	initialized = false
+	initMu.Unlock()
+
+	var calls atomic.Int64
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			initialize(func() { calls.Add(1) })
+		}()
+	}
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected the client to be initialized once but it was initialized %d times", n)
+	}
+}
+
+func TestInitFromMap_AlreadyInitialized(t *testing.T) {
+	// The client has already been initialized by Init in TestMain.
+	before := c
+	if err := InitFromMap(map[string]bool{"beta:user:1": true}, nil); !errors.Is(err, errAlreadyInitialized) {
+		t.Errorf("expected %v but got %v", errAlreadyInitialized, err)
+	}
+	if c != before {
+		t.Error("expected the client not to be replaced")
+	}
+}
+
+func TestClientCheck_TestModeOverrides(t *testing.T) {
+	overrides := map[string]struct{}{
+		"local_feature:user:1":      {},
+		"temper_api_e2e_off:user:1": {},
+	}
+
+	c := newTestClient(t, "", &Option{TestModeOverrides: overrides})
+	for _, key := range []string{"local_feature:user:1", "temper_api_e2e_off:user:1", "temper_api_e2e:user:1"} {
+		if v := c.Check(key); !v {
+			t.Errorf("expected %s to be true but got %v", key, v)
+		}
+	}
+	if v := c.Check("local_feature:user:2"); v {
+		t.Errorf("expected local_feature:user:2 to be false but got %v", v)
+	}
+
+	// The overrides are ignored when a secret key is provided.
+	c = newTestClient(t, "FAKE_SECRET", &Option{TestModeOverrides: overrides})
+	for _, key := range []string{"local_feature:user:1", "temper_api_e2e_off:user:1"} {
+		if v := c.Check(key); v {
+			t.Errorf("expected %s to be false but got %v", key, v)
+		}
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+}
+
+func TestClientCheck_Parent(t *testing.T) {
+	parent := newTestClient(t, "", nil)
+
+	f, err := NewFilterFromMap(
+		map[string]bool{"tenant_feature:user:1": true},
+		map[string]uint8{"temper_api_e2e_rollout": 0},
+	)
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+	tenant := NewClientWithFilter(f, &Option{Parent: parent})
+
+	tests := []struct {
+		key    string
+		want   bool
+		reason string
+	}{
+		{"tenant_feature:user:1", true, "filter"},
+		{"temper_api_e2e:user:1", true, "filter"},
+		{"temper_api_e2e_rollout:user:1", false, "no_match"},
+		{"temper_api_e2e_off:user:1", false, "no_match"},
+		{"unknown_feature:user:1", false, "no_match"},
+	}
+	for _, tt := range tests {
+		if v := tenant.Check(tt.key); v != tt.want {
+			t.Errorf("expected %s to be %v but got %v", tt.key, tt.want, v)
+		}
+		if v := tenant.CheckToken(tenant.Prepare(tt.key)); v != tt.want {
+			t.Errorf("expected the token for %s to be %v but got %v", tt.key, tt.want, v)
+		}
+		if r := tenant.CheckAudited(tt.key); r.Enabled != tt.want || r.Reason != tt.reason {
+			t.Errorf("expected %s to be %v with reason %q but got %+v", tt.key, tt.want, tt.reason, r)
+		}
+	}
+
+	if r, want := tenant.CheckAudited("tenant_feature:user:1"), f.Version(); r.FilterVersion != want {
+		t.Errorf("expected the tenant's filter version %s but got %s", want, r.FilterVersion)
+	}
+	if r, want := tenant.CheckAudited("temper_api_e2e:user:1"), parent.CurrentFilter().Version(); r.FilterVersion != want {
+		t.Errorf("expected the parent's filter version %s but got %s", want, r.FilterVersion)
+	}
+}
+
+func TestClient_ParentEvaluationPaths(t *testing.T) {
+	pf, err := NewFilterFromMap(
+		map[string]bool{"parent_feature:user:1": true},
+		map[string]uint8{"maintenance": 100},
+	)
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+	pf.f.variants = map[uint64][]WeightedVariant{
+		rolloutKey(hash([]byte("checkout"))): {{Name: "a", Weight: 100}},
+	}
+	parent := NewClientWithFilter(pf)
+
+	f, err := NewFilterFromMap(map[string]bool{"tenant_feature:user:2": true}, nil)
+	if err != nil {
+		t.Fatalf("failed to build filter: %v", err)
+	}
+	tenant := NewClientWithFilter(f, &Option{Parent: parent})
+
+	if got := tenant.EnabledActors("parent_feature", "user", []string{"1", "2"}); !slices.Equal(got, []string{"1"}) {
+		t.Errorf("expected the parent's actors [1] but got %v", got)
+	}
+	if got := tenant.EnabledActors("tenant_feature", "user", []string{"1", "2"}); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("expected the tenant's actors [2] but got %v", got)
+	}
+	if v := tenant.Variant("checkout:user:1"); v != "a" {
+		t.Errorf("expected the parent's variant a but got %q", v)
+	}
+	if v := tenant.Variant("tenant_feature:user:2"); v != "" {
+		t.Errorf("expected no variant for a feature the tenant knows but got %q", v)
+	}
+	if v := tenant.CheckGlobal("maintenance"); !v {
+		t.Errorf("expected the parent's global feature to be true but got %v", v)
+	}
+
+	ctx := ContextWithFilter(context.Background(), f)
+	if v := tenant.CheckCtx(ctx, "parent_feature:user:1"); v {
+		t.Errorf("expected a context filter to ignore the parent but got %v", v)
+	}
+}
+
+func TestClientCheckOr(t *testing.T) {
+	c := NewClientWithFilter(nil)
+	if v := c.CheckOr("temper_api_e2e:user:1", true); !v {
+		t.Errorf("expected the default of true for an empty filter but got %v", v)
+	}
+	if v := c.CheckOr("temper_api_e2e:user:1", false); v {
+		t.Errorf("expected the default of false for an empty filter but got %v", v)
+	}
+
+	c = NewClientWithFilter(nil, &Option{TestModeOverrides: map[string]struct{}{"temper_api_e2e_off:user:1": {}}})
+	if v := c.CheckOr("temper_api_e2e_off:user:1", false); !v {
+		t.Errorf("expected the override to take precedence over the default but got %v", v)
+	}
+
+	c = newTestClient(t, "", nil)
+	if v := c.CheckOr("unknown_feature:user:1", true); v {
+		t.Errorf("expected unknown_feature:user:1 to be false with a filter but got %v", v)
+	}
+	if v := c.CheckOr("temper_api_e2e:user:1", false); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true with a filter but got %v", v)
+	}
+}
+
+func TestClientCohort_RolloutHash(t *testing.T) {
+	f, err := from(&FilterResponse{
+		Rollout:     encodeRollouts(map[string]uint8{"cohort_feature": 50}),
+		RolloutHash: RolloutHashSHA256,
+	}, &Option{RolloutHash: RolloutHashSHA256})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	for _, opt := range []*Option{nil, {RolloutSalt: func() string { return "2026-10-15" }}} {
+		c := NewClientWithFilter(&Filter{f: f}, opt)
+		for i := range 50 {
+			key := fmt.Sprintf("user:%d", i)
+			cohort := c.Cohort("cohort_feature", key, 100)
+			if bucket := int(c.RolloutBucket("cohort_feature:" + key)); cohort != bucket {
+				t.Fatalf("expected the cohort of %s to be its rollout bucket %d but got %d", key, bucket, cohort)
+			}
+			if enabled := c.Check("cohort_feature:" + key); enabled != (cohort <= 50) {
+				t.Errorf("expected %s to be %v for cohort %d but got %v", key, cohort <= 50, cohort, enabled)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package temper
+
+import (
+	"slices"
+	"time"
+)
+
+// EffectiveConfig is the configuration of a client after the defaults have
+// been applied to its options, with its keys redacted.
+type EffectiveConfig struct {
+	BaseURL     string `json:"base_url"`
+	FilterPath  string `json:"filter_path"`
+	Environment string `json:"environment"`
+
+	// PublishableKey and SecretKey are only long enough to tell keys apart.
+	PublishableKey string `json:"publishable_key"`
+	SecretKey      string `json:"secret_key"`
+
+	// DevMode is true when no secret key was provided.
+	DevMode bool `json:"dev_mode"`
+
+	// Polling is true when the client is polling the backend, which is
+	// false for a client that was never meant to poll, and while polling is
+	// paused by PausePolling.
+	Polling         bool          `json:"polling"`
+	PollInterval    time.Duration `json:"poll_interval"`
+	MinPollInterval time.Duration `json:"min_poll_interval"`
+	LogInterval     time.Duration `json:"log_interval"`
+
+	// Overrides is true when overrides are fetched from the OverridesURL
+	// option.
+	Overrides bool `json:"overrides"`
+
+	// Scopes are the names of the scopes, in order.
+	Scopes []string `json:"scopes"`
+
+	PreReadyBehavior      PreReadyBehavior `json:"pre_ready_behavior"`
+	PreReadyTimeout       time.Duration    `json:"pre_ready_timeout"`
+	MaxFilterAge          time.Duration    `json:"max_filter_age"`
+	DefaultsFile          string           `json:"defaults_file"`
+	StrictUnknownFeatures bool             `json:"strict_unknown_features"`
+	CompactFilter         bool             `json:"compact_filter"`
+	RolloutOnly           bool             `json:"rollout_only"`
+	MaxFilterBytes        int              `json:"max_filter_bytes"`
+	MaxRolloutEntries     int              `json:"max_rollout_entries"`
+	MaxDecodeFailures     int              `json:"max_decode_failures"`
+}
+
+// Config returns the effective configuration of the client, for example, to
+// confirm that options set for an environment took effect.
+func Config() EffectiveConfig {
+	return c.Config()
+}
+
+func (c *Client) Config() EffectiveConfig {
+	scopes := make([]string, 0, len(c.scopes))
+	for name := range c.scopes {
+		scopes = append(scopes, name)
+	}
+	slices.Sort(scopes)
+
+	opt := c.opt
+	return EffectiveConfig{
+		BaseURL:               c.baseURL,
+		FilterPath:            opt.FilterPath,
+		Environment:           opt.Environment,
+		PublishableKey:        redact(c.tokens.publishableKey),
+		SecretKey:             redact(c.tokens.secretKey),
+		DevMode:               c.devMode,
+		Polling:               c.polling.Load() && !c.paused.Load(),
+		PollInterval:          opt.PollInterval,
+		MinPollInterval:       opt.MinPollInterval,
+		LogInterval:           opt.LogInterval,
+		Overrides:             opt.OverridesURL != "",
+		Scopes:                scopes,
+		PreReadyBehavior:      opt.PreReadyBehavior,
+		PreReadyTimeout:       opt.PreReadyTimeout,
+		MaxFilterAge:          opt.MaxFilterAge,
+		DefaultsFile:          opt.DefaultsFile,
+		StrictUnknownFeatures: opt.StrictUnknownFeatures,
+		CompactFilter:         opt.CompactFilter,
+		RolloutOnly:           opt.RolloutOnly,
+		MaxFilterBytes:        opt.MaxFilterBytes,
+		MaxRolloutEntries:     opt.MaxRolloutEntries,
+		MaxDecodeFailures:     opt.MaxDecodeFailures,
+	}
+}
@@ -0,0 +1,45 @@
+package temper
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClientConfig(t *testing.T) {
+	c := newClient("pk_live_1234567890", "sk_live_1234567890", &Option{
+		Environment: "staging",
+		Scopes:      map[string]string{"b": "/api/public/filter?tenant=b", "a": "/api/public/filter?tenant=a"},
+	})
+
+	config := c.Config()
+	if config.BaseURL != defaultBaseURL || config.FilterPath != defaultFilterPath || config.Environment != "staging" {
+		t.Errorf("expected the defaults and options to be applied but got %+v", config)
+	}
+	if config.PollInterval != defaultPollInterval || config.MaxDecodeFailures != defaultMaxDecodeFailures {
+		t.Errorf("expected the default poll interval and decode failures but got %+v", config)
+	}
+	if config.PublishableKey != "pk_l..." || config.SecretKey != "sk_l..." || config.DevMode {
+		t.Errorf("expected redacted keys but got %q and %q", config.PublishableKey, config.SecretKey)
+	}
+	if !slices.Equal(config.Scopes, []string{"a", "b"}) {
+		t.Errorf("expected the sorted scopes but got %v", config.Scopes)
+	}
+	if config.Polling || config.Overrides {
+		t.Errorf("expected no polling or overrides but got %+v", config)
+	}
+
+	c.polling.Store(true)
+	if !c.Config().Polling {
+		t.Error("expected polling once it's started")
+	}
+	c.paused.Store(true)
+	if c.Config().Polling {
+		t.Error("expected no polling while it's paused")
+	}
+
+	c = newClient("FAKE_KEY", "", &Option{PollInterval: 5 * time.Minute, OverridesURL: "https://qa.example.com/overrides"})
+	if config := c.Config(); config.PollInterval != 5*time.Minute || !config.Overrides || !config.DevMode || config.SecretKey != "<none>" {
+		t.Errorf("expected the options to be applied but got %+v", config)
+	}
+}
@@ -0,0 +1,81 @@
+package temper
+
+import "context"
+
+// actorContextKey is the context key for the actor set by ContextWithActor.
+type actorContextKey struct{}
+
+// filterContextKey is the context key for the filter set by
+// ContextWithFilter.
+type filterContextKey struct{}
+
+// contextActor is the actor identity carried in a context.
+type contextActor struct {
+	resource string
+	id       string
+}
+
+// ContextWithActor returns a copy of ctx that carries the identity of the
+// actor that features are checked for by CheckContextActor, for example, the
+// user of the current request, with a resource of "user", and their ID.
+func ContextWithActor(ctx context.Context, resource, id string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, contextActor{resource: resource, id: id})
+}
+
+// ActorFromContext returns the resource and ID of the actor carried in ctx by
+// ContextWithActor, and whether there is one.
+func ActorFromContext(ctx context.Context) (resource, id string, ok bool) {
+	actor, ok := ctx.Value(actorContextKey{}).(contextActor)
+	return actor.resource, actor.id, ok
+}
+
+// CheckContextActor checks a feature for the actor carried in ctx by
+// ContextWithActor, the same way as CheckCtx does for the key
+// `feature:resource:id`. It returns false if ctx doesn't carry an actor.
+func CheckContextActor(ctx context.Context, feature string) bool {
+	return c.CheckContextActor(ctx, feature)
+}
+
+func (c *Client) CheckContextActor(ctx context.Context, feature string) bool {
+	resource, id, ok := ActorFromContext(ctx)
+	if !ok {
+		return false
+	}
+	return c.CheckCtx(ctx, feature+":"+resource+":"+id)
+}
+
+// ContextWithFilter returns a copy of ctx that carries a filter, which
+// CheckCtx evaluates features against instead of the client's filter. It lets
+// each test control the state of features through its own context, even when
+// tests run in parallel against the same client.
+func ContextWithFilter(ctx context.Context, f *Filter) context.Context {
+	return context.WithValue(ctx, filterContextKey{}, f)
+}
+
+// FilterFromContext returns the filter carried in ctx by ContextWithFilter,
+// and whether there is one.
+func FilterFromContext(ctx context.Context) (*Filter, bool) {
+	f, ok := ctx.Value(filterContextKey{}).(*Filter)
+	return f, ok
+}
+
+// CheckCtx checks a feature the same way as Check, unless ctx carries a
+// filter from ContextWithFilter, in which case the feature is looked up in
+// that filter alone, ignoring overrides, defaults, the Parent option, and
+// whether the client is ready. A nil filter in ctx disables every feature.
+// Lookups are local, so ctx isn't used for cancellation yet, and spans are
+// recorded by wrapping the check with the temperotel package.
+func CheckCtx(ctx context.Context, feature string) bool {
+	return c.CheckCtx(ctx, feature)
+}
+
+func (c *Client) CheckCtx(ctx context.Context, feature string) bool {
+	f, ok := FilterFromContext(ctx)
+	if !ok {
+		return c.CheckSeeded(feature, "")
+	}
+	if f == nil || f.f == nil {
+		return false
+	}
+	return f.f.lookupSeeded([]byte(feature), c.seed(""))
+}
@@ -0,0 +1,67 @@
+package temper
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClientCheckContextActor(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", nil)
+
+	ctx := ContextWithActor(context.Background(), "user", "1")
+	if resource, id, ok := ActorFromContext(ctx); !ok || resource != "user" || id != "1" {
+		t.Errorf("expected actor user 1 but got %q %q %v", resource, id, ok)
+	}
+	if v := c.CheckContextActor(ctx, "temper_api_e2e"); !v {
+		t.Errorf("expected temper_api_e2e to be true for user 1 but got %v", v)
+	}
+
+	ctx = ContextWithActor(ctx, "user", "2")
+	if v := c.CheckContextActor(ctx, "temper_api_e2e"); v {
+		t.Errorf("expected temper_api_e2e to be false for user 2 but got %v", v)
+	}
+
+	if v := c.CheckContextActor(context.Background(), "temper_api_e2e_rollout"); v {
+		t.Errorf("expected false without an actor but got %v", v)
+	}
+}
+
+func TestClientCheckCtx(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", nil)
+
+	for _, tt := range []struct {
+		name    string
+		enabled map[string]bool
+		want    bool
+	}{
+		{"enabled", map[string]bool{"new_feature:user:1": true}, true},
+		{"disabled", map[string]bool{"temper_api_e2e:user:1": false}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			f, err := NewFilterFromMap(tt.enabled, nil)
+			if err != nil {
+				t.Fatalf("failed to build filter: %v", err)
+			}
+			ctx := ContextWithFilter(context.Background(), f)
+
+			if v := c.CheckCtx(ctx, "new_feature:user:1"); v != tt.want {
+				t.Errorf("expected new_feature:user:1 to be %v but got %v", tt.want, v)
+			}
+			if v := c.CheckCtx(ctx, "temper_api_e2e:user:1"); v {
+				t.Errorf("expected the client's filter to be ignored but got %v", v)
+			}
+			if v := c.CheckContextActor(ContextWithActor(ctx, "user", "1"), "new_feature"); v != tt.want {
+				t.Errorf("expected the actor to be checked against the context's filter but got %v", v)
+			}
+		})
+	}
+
+	if v := c.CheckCtx(context.Background(), "temper_api_e2e:user:1"); !v {
+		t.Errorf("expected the client's filter without a filter in the context but got %v", v)
+	}
+	if v := c.CheckCtx(ContextWithFilter(context.Background(), nil), "temper_api_e2e:user:1"); v {
+		t.Errorf("expected a nil filter to disable every feature but got %v", v)
+	}
+}
@@ -0,0 +1,227 @@
+package temper
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxExprBytes is the longest expression CheckExpr parses, and
+	// maxExprDepth is how deeply its parentheses and negations can nest,
+	// which protect against expressions that are expensive to parse.
+	maxExprBytes = 4096
+	maxExprDepth = 32
+
+	// maxCachedExprs is the most parsed expressions that are cached, so that
+	// expressions built from untrusted input can't grow the cache forever.
+	maxCachedExprs = 1024
+)
+
+// exprCache maps expressions to their parsed exprNode, and cachedExprs is the
+// number of expressions in it.
+var (
+	exprCache   sync.Map
+	cachedExprs atomic.Int64
+)
+
+// An exprNode is a node of a parsed expression.
+type exprNode interface {
+	eval(c *Client) bool
+}
+
+type (
+	exprFeature string
+	exprNot     struct{ x exprNode }
+	exprAnd     struct{ x, y exprNode }
+	exprOr      struct{ x, y exprNode }
+)
+
+func (e exprFeature) eval(c *Client) bool { return c.Check(string(e)) }
+func (e exprNot) eval(c *Client) bool     { return !e.x.eval(c) }
+func (e exprAnd) eval(c *Client) bool     { return e.x.eval(c) && e.y.eval(c) }
+func (e exprOr) eval(c *Client) bool      { return e.x.eval(c) || e.y.eval(c) }
+
+// CheckExpr evaluates an expression of features, each of which is checked
+// with Check, combined with `&&`, `||`, `!`, and parentheses, for example,
+// `new_checkout && !(legacy_cart || maintenance)`. `!` binds tighter than
+// `&&`, which binds tighter than `||`, and both are short circuiting. An
+// error is returned if the expression can't be parsed. Parsed expressions
+// are cached, so the same expression is only parsed once.
+func CheckExpr(expr string) (bool, error) {
+	return c.CheckExpr(expr)
+}
+
+func (c *Client) CheckExpr(expr string) (bool, error) {
+	node, err := parseExprCached(expr)
+	if err != nil {
+		return false, err
+	}
+	return node.eval(c), nil
+}
+
+// parseExprCached returns the parsed expression from the cache, parsing and
+// caching it if it isn't there yet.
+func parseExprCached(expr string) (exprNode, error) {
+	if node, ok := exprCache.Load(expr); ok {
+		return node.(exprNode), nil
+	}
+
+	node, err := parseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if cachedExprs.Add(1) > maxCachedExprs {
+		cachedExprs.Add(-1)
+		return node, nil
+	}
+
+	// Another goroutine may have cached the same expression since the Load,
+	// in which case its slot is given back, so it's only ever counted once.
+	if actual, loaded := exprCache.LoadOrStore(expr, node); loaded {
+		cachedExprs.Add(-1)
+		return actual.(exprNode), nil
+	}
+	return node, nil
+}
+
+// errExprDepth is returned for an expression that's nested too deeply.
+var errExprDepth = fmt.Errorf("nested more than %d deep", maxExprDepth)
+
+// exprParser is a recursive descent parser of expressions.
+type exprParser struct {
+	expr  string
+	pos   int
+	depth int
+}
+
+// parseExpr parses an expression.
+func parseExpr(expr string) (exprNode, error) {
+	if len(expr) > maxExprBytes {
+		return nil, fmt.Errorf("go-temper: expression is longer than %d bytes", maxExprBytes)
+	}
+
+	p := &exprParser{expr: expr}
+	node, err := p.or()
+	if err == nil && p.peek() != "" {
+		err = fmt.Errorf("unexpected %q", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: invalid expression %q at offset %d: %w", expr, p.pos, err)
+	}
+	return node, nil
+}
+
+// or parses operands separated by `||`.
+func (p *exprParser) or() (exprNode, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = exprOr{x, y}
+	}
+	return x, nil
+}
+
+// and parses operands separated by `&&`.
+func (p *exprParser) and() (exprNode, error) {
+	x, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		y, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		x = exprAnd{x, y}
+	}
+	return x, nil
+}
+
+// unary parses a feature, a negation, or a parenthesized expression.
+func (p *exprParser) unary() (exprNode, error) {
+	tok := p.peek()
+	switch tok {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "!", "(":
+		if p.depth++; p.depth > maxExprDepth {
+			return nil, errExprDepth
+		}
+		defer func() { p.depth-- }()
+		p.next()
+
+		if tok == "!" {
+			x, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return exprNot{x}, nil
+		}
+
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.next()
+		return x, nil
+	case ")", "&&", "||", "&", "|":
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+
+	p.next()
+	return exprFeature(tok), nil
+}
+
+// peek returns the next token without consuming it, which is empty at the end
+// of the expression. A token is an operator, a parenthesis, or a feature,
+// which runs until the next space, operator, or parenthesis.
+func (p *exprParser) peek() string {
+	for p.pos < len(p.expr) && isExprSpace(p.expr[p.pos]) {
+		p.pos++
+	}
+	rest := p.expr[p.pos:]
+	switch {
+	case rest == "":
+		return ""
+	case strings.HasPrefix(rest, "&&"), strings.HasPrefix(rest, "||"):
+		return rest[:2]
+	case rest[0] == '!', rest[0] == '(', rest[0] == ')':
+		return rest[:1]
+	}
+
+	end := strings.IndexFunc(rest, func(r rune) bool {
+		return r < 0x80 && (isExprSpace(byte(r)) || strings.ContainsRune("&|!()", r))
+	})
+	if end < 0 {
+		end = len(rest)
+	}
+	if end == 0 {
+		// A lone `&` or `|`, which is part of no token.
+		return rest[:1]
+	}
+	return rest[:end]
+}
+
+// next consumes the token returned by peek.
+func (p *exprParser) next() {
+	p.pos += len(p.peek())
+}
+
+// isExprSpace returns true if b separates tokens of an expression.
+func isExprSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
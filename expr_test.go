@@ -0,0 +1,85 @@
+package temper
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClientCheckExpr(t *testing.T) {
+	c := newTestClient(t, "", nil)
+
+	for expr, want := range map[string]bool{
+		"temper_api_e2e:user:1":                                true,
+		"!temper_api_e2e:user:1":                               false,
+		"temper_api_e2e:user:1 && !unknown_feature":            true,
+		"temper_api_e2e:user:1 && unknown_feature":             false,
+		"unknown_feature || temper_api_e2e_rollout:user:3":     true,
+		"unknown_feature || unknown_feature && temper_api_e2e": false,
+		"!(unknown_feature || !temper_api_e2e:user:1)":         true,
+		"!!temper_api_e2e:user:1":                              true,
+		"(temper_api_e2e:user:1)&&(temper_api_e2e_rollout)":    true,
+	} {
+		got, err := c.CheckExpr(expr)
+		if err != nil {
+			t.Errorf("failed to check %q: %v", expr, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("expected %q to be %v but got %v", expr, want, got)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"a &&",
+		"&& a",
+		"a & b",
+		"a b",
+		"(a || b",
+		"a)",
+		"!",
+		strings.Repeat("(", maxExprDepth+1) + "a" + strings.Repeat(")", maxExprDepth+1),
+		strings.Repeat("!", maxExprDepth+1) + "a",
+		strings.Repeat("a||", maxExprBytes),
+	} {
+		if _, err := c.CheckExpr(expr); err == nil {
+			t.Errorf("expected an error checking %q", expr)
+		}
+	}
+
+	nested := strings.Repeat("(", maxExprDepth) + "temper_api_e2e:user:1" + strings.Repeat(")", maxExprDepth)
+	if v, err := c.CheckExpr(nested); err != nil || !v {
+		t.Errorf("expected an expression nested %d deep to be true but got %v, %v", maxExprDepth, v, err)
+	}
+	if _, ok := exprCache.Load(nested); !ok {
+		t.Error("expected the parsed expression to be cached")
+	}
+}
+
+func Test_parseExprCached_concurrent(t *testing.T) {
+	const expr = "concurrent_feature:user:1 && !concurrent_feature:user:2"
+	if _, ok := exprCache.LoadAndDelete(expr); ok {
+		cachedExprs.Add(-1)
+	}
+	before := cachedExprs.Load()
+
+	var wg sync.WaitGroup
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := parseExprCached(expr); err != nil {
+				t.Errorf("failed to parse %q: %v", expr, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := exprCache.Load(expr); !ok {
+		t.Error("expected the parsed expression to be cached")
+	}
+	if n := cachedExprs.Load() - before; n != 1 {
+		t.Errorf("expected the expression to be counted once but it was counted %d times", n)
+	}
+}
@@ -0,0 +1,55 @@
+package temper
+
+import (
+	"expvar"
+	"sync"
+)
+
+// expvarName is the name the client's metrics are published under by the
+// Expvar option.
+const expvarName = "temper"
+
+// publishOnce ensures the metrics are only published once, since the expvar
+// package panics when a name is reused.
+var publishOnce sync.Once
+
+// publishExpvar publishes the metrics of the client initialized by Init with
+// the expvar package, as a map of the number of fetches of the filter that
+// succeeded and failed, the number of entries in the filter, when it was last
+// updated in unix seconds, and the stats of every refactor that has run. The
+// client is looked up each time the metrics are read, so they follow it when
+// it's closed and initialized again.
+func publishExpvar() {
+	publishOnce.Do(func() {
+		expvar.Publish(expvarName, expvar.Func(expvarMetrics))
+	})
+}
+
+// expvarMetrics returns the metrics published by publishExpvar for the
+// current client initialized by Init.
+func expvarMetrics() any {
+	// The client is only read once, so that the metrics are never mixed
+	// from two clients when it's initialized again while they're read.
+	c := current.Load()
+
+	m := map[string]any{
+		"poll_successes": int64(0),
+		"poll_failures":  int64(0),
+		"filter_entries": 0,
+		"last_updated":   int64(0),
+		"refactors":      refactorStats(),
+	}
+	if c == nil {
+		return m
+	}
+
+	m["poll_successes"] = c.fetchSuccesses.Load()
+	m["poll_failures"] = c.fetchFailures.Load()
+	if f := c.filter.Load(); f != nil {
+		m["filter_entries"] = f.stats().Entries
+	}
+	if updated := c.LastUpdated(); !updated.IsZero() {
+		m["last_updated"] = updated.Unix()
+	}
+	return m
+}
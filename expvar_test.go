@@ -0,0 +1,85 @@
+package temper
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient_Expvar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	client := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, Expvar: true})
+	if err := client.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+
+	// The metrics are those of the global client, so it's replaced for the
+	// duration of the test, the same way as Close and Init would.
+	before := c
+	setClient(client)
+	t.Cleanup(func() { setClient(before) })
+
+	refactor := &RefactorArgs[int, int]{
+		Name: "expvar_refactor",
+		Old:  func(n int) int { return n },
+		New:  func(n int) int { return -n },
+	}
+	refactor.run(1)
+
+	v := expvar.Get(expvarName)
+	if v == nil {
+		t.Fatal("expected the metrics to be published")
+	}
+
+	var metrics struct {
+		PollSuccesses int64                    `json:"poll_successes"`
+		PollFailures  int64                    `json:"poll_failures"`
+		FilterEntries int                      `json:"filter_entries"`
+		LastUpdated   int64                    `json:"last_updated"`
+		Refactors     map[string]RefactorStats `json:"refactors"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &metrics); err != nil {
+		t.Fatalf("failed to decode metrics %s: %v", v.String(), err)
+	}
+	if metrics.PollSuccesses != 1 || metrics.PollFailures != 0 {
+		t.Errorf("expected 1 successful poll but got %+v", metrics)
+	}
+	if want := client.Stats().Entries; metrics.FilterEntries != want {
+		t.Errorf("expected %d filter entries but got %d", want, metrics.FilterEntries)
+	}
+	if want := client.LastUpdated().Unix(); metrics.LastUpdated != want {
+		t.Errorf("expected last updated %d but got %d", want, metrics.LastUpdated)
+	}
+	if stats := metrics.Refactors["expvar_refactor"]; stats.Runs != 1 || stats.Mismatches != 1 {
+		t.Errorf("expected 1 mismatched run of the refactor but got %+v", stats)
+	}
+
+	setClient(NewClientWithFilter(nil))
+	if err := json.Unmarshal([]byte(v.String()), &metrics); err != nil {
+		t.Fatalf("failed to decode metrics %s: %v", v.String(), err)
+	}
+	if metrics.PollSuccesses != 0 || metrics.FilterEntries != 0 {
+		t.Errorf("expected the metrics of the new global client but got %+v", metrics)
+	}
+
+	// Reading the metrics while the client is initialized again is safe.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			_ = v.String()
+		}
+	}()
+	for range 100 {
+		setClient(client)
+	}
+	<-done
+}
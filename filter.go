@@ -2,10 +2,15 @@ package temper
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
 )
 
 const (
@@ -24,13 +29,70 @@ const (
 	// 16 is the fingerprint size (uint16), and 8 is the size of a byte
 	// (uint8).
 	bytesPerBucket = bucketSize * 16 / 8
+
+	// bytesPerSparseIndex is the number of bytes in the index of a bucket of
+	// a compact filter.
+	bytesPerSparseIndex = 4
 )
 
-// filterResponse represents the JSON response from the Temper API's public
-// filter endpoint.
-type filterResponse struct {
-	Filter  []byte `json:"filter"`
+// A FilterResponse is the filter and rollout data served by the Temper API's
+// public filter endpoint, which is decoded from JSON.
+type FilterResponse struct {
+	// Filter contains the little endian uint16 fingerprints of the cuckoo
+	// filter's buckets.
+	Filter []byte `json:"filter"`
+
+	// Entries is the number of occupied entries the backend encoded in
+	// Filter, if it declares one. When it's set, a filter that decodes to a
+	// different number of entries is rejected, which catches a truncated
+	// filter that still has a valid number of buckets.
+	Entries *uint `json:"entries,omitempty"`
+
+	// Rollout contains little endian uint64 entries, each of which is the
+	// hash of a feature with its lowest byte replaced by its rollout
+	// percentage.
 	Rollout []byte `json:"rollout"`
+
+	// EnvRollouts contains rollout data keyed by environment name, encoded
+	// the same way as Rollout. Entries for the configured environment take
+	// precedence over the entries in Rollout.
+	EnvRollouts map[string][]byte `json:"env_rollouts,omitempty"`
+
+	// Killed contains the little endian uint64 hashes of features that have
+	// been killed, which are disabled regardless of the filter and rollout
+	// data.
+	Killed []byte `json:"killed,omitempty"`
+
+	// RolloutHash is the hash the backend computed the rollout percentages
+	// of full keys with, which is fnv-1a when it's empty.
+	RolloutHash string `json:"rollout_hash,omitempty"`
+
+	// Environment identifies the backend environment the filter was served
+	// from, when it's not sent in the environmentHeader header.
+	Environment string `json:"environment,omitempty"`
+
+	// Variants contains the weighted variants of multivariate features.
+	Variants []FeatureVariants `json:"variants,omitempty"`
+
+	// Combined, if it isn't empty, contains both the filter and the rollout
+	// data, and is used instead of Filter and Rollout. It starts with the
+	// little endian uint32 length of the filter data, followed by the filter
+	// data, and then the rollout data.
+	Combined []byte `json:"combined,omitempty"`
+}
+
+// FeatureVariants are the weighted variants of a single feature, identified by
+// the hash of its name.
+type FeatureVariants struct {
+	Feature  uint64            `json:"feature"`
+	Variants []WeightedVariant `json:"variants"`
+}
+
+// A WeightedVariant is a variant of a multivariate feature, which is assigned
+// to the given percentage of keys.
+type WeightedVariant struct {
+	Name   string `json:"name"`
+	Weight uint8  `json:"weight"`
 }
 
 // has computes a 64 bit fnv-1a hash of the given data.
@@ -40,8 +102,33 @@ func hash(data []byte) uint64 {
 	return hash.Sum64()
 }
 
-// nextPowerOf2 returns the next power of two.
-func nextPowerOf2(n uint64) uint {
+// rolloutKey returns the key of a feature's entry in the rollout data, which
+// is the feature hash with its low 8 bits, where the percentage is stored in
+// the encoded entry, cleared.
+func rolloutKey(hfeat uint64) uint64 {
+	return (hfeat >> 8) << 8
+}
+
+// hashSHA256 computes a 64 bit hash of the given data from the first 8 bytes
+// of its sha256 digest.
+func hashSHA256(data []byte) uint64 {
+	sum := sha256.Sum256(data)
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+// maxPowerOf2 is the largest power of two that fits in a uint.
+const maxPowerOf2 = 1 << (bits.UintSize - 1)
+
+// nextPowerOf2 returns the next power of two, or false if it's too large to
+// fit in a uint.
+func nextPowerOf2(n uint64) (uint, bool) {
+	if n > maxPowerOf2 {
+		return 0, false
+	}
+	if n == 0 {
+		return 1, true
+	}
+
 	n--
 	n |= n >> 1
 	n |= n >> 2
@@ -50,7 +137,7 @@ func nextPowerOf2(n uint64) uint {
 	n |= n >> 16
 	n |= n >> 32
 	n++
-	return uint(n)
+	return uint(n), true
 }
 
 // A Bucket contains fingerprints.
@@ -69,73 +156,514 @@ func (b *bucket) contains(fingerprint uint16) bool {
 type filter struct {
 	cap             uint // cap of `Buckets`, used to resize.
 	count           uint
+	full            uint     // number of buckets with every entry occupied.
 	buckets         []bucket // "Height" of the cuckoo filter table.
 	bucketIndexMask uint
 
-	rollouts map[uint64]uint8 // feature rollout data outside of filter
+	// When the filter is compact, buckets is nil, and only the non-empty
+	// buckets are kept in sparseBuckets, with their indexes, in ascending
+	// order, in sparseIndexes.
+	sparseIndexes []uint32
+	sparseBuckets []bucket
+
+	rollouts    map[uint64]uint8 // feature rollout data outside of filter
+	envRollouts map[uint64]uint8 // rollout data for the configured environment
+
+	killed map[uint64]struct{} // hashes of features that are killed
+
+	variants map[uint64][]WeightedVariant // variants keyed by rollout key
+
+	// rolloutHash is the hash used to compare full keys against rollout
+	// percentages, which is fnv-1a when it's empty.
+	rolloutHash string
+
+	// versionID caches the filter's version once it's computed.
+	versionID atomic.Pointer[string]
+
+	// rand chooses the entries that insert evicts, which is the global
+	// source when it's nil.
+	rand *rand.Rand
 }
 
-// from initializes a filter from an encoded byte slice.
-func from(fr *filterResponse) (*filter, error) {
-	filter := &filter{}
+// Segments of the filter response, which are decoded independently of each
+// other.
+const (
+	segmentFilter  = "filter"
+	segmentRollout = "rollout"
+)
+
+// A DecodeError is returned when a single segment of the filter response
+// fails to decode, and describes where in the segment's data it failed.
+type DecodeError struct {
+	// Segment is the segment that failed to decode, either "filter" or
+	// "rollout".
+	Segment string
+
+	// Offset is the offset of the byte in the segment's data where decoding
+	// failed, and Index is the index of the bucket or entry at that offset.
+	// Both are -1 when the failure isn't at a specific position, such as
+	// when the data is too large.
+	Offset int
+	Index  int
+
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Offset < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (%s segment, offset %d, index %d)", e.Err.Error(), e.Segment, e.Offset, e.Index)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
 
-	if fr.Filter != nil {
-		if len(fr.Filter)%bucketSize != 0 {
-			return nil, errors.New("go-temper: bytes must be a multiple of 4")
+// decodeErrorAt returns a DecodeError for a failure at the given offset and
+// index, leaving the segment to be filled in by from.
+func decodeErrorAt(offset, index int, err error) *DecodeError {
+	return &DecodeError{Offset: offset, Index: index, Err: err}
+}
+
+// segmentError returns err as a DecodeError for the given segment.
+func segmentError(segment string, err error) *DecodeError {
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		de = decodeErrorAt(-1, -1, err)
+	}
+	de.Segment = segment
+	return de
+}
+
+// from initializes a filter from an encoded byte slice. The size limits in
+// the given options are only enforced when they're set.
+//
+// The filter and rollout segments are decoded independently. If only one of
+// them fails to decode, from returns both the filter, with the failed segment
+// left empty, and an error describing the failure, so that the caller can
+// decide whether to install it.
+func from(fr *FilterResponse, opts ...*Option) (*filter, error) {
+	opt := &Option{}
+	for _, o := range opts {
+		if o != nil {
+			opt = o
 		}
+	}
+
+	if len(fr.Combined) > 0 {
+		filterData, rolloutData, err := splitCombined(fr.Combined)
+		if err != nil {
+			return nil, err
+		}
+		combined := *fr
+		combined.Filter, combined.Rollout = filterData, rolloutData
+		fr = &combined
+	}
+
+	filter := &filter{}
+	var errs []error
+	decoded := 0
+
+	// Only use a different rollout hash when the backend agrees, since the
+	// percentages have to be computed the same way on both ends.
+	if opt.RolloutHash == RolloutHashSHA256 && fr.RolloutHash == RolloutHashSHA256 {
+		filter.rolloutHash = RolloutHashSHA256
+	}
 
-		size := len(fr.Filter) / bytesPerBucket
-		if size < 1 {
-			return nil, errors.New("go-temper: data can not be smaller than 16 (size of a bucket)")
+	// Rollout only filters never hold any buckets, so every lookup in the
+	// filter itself is false.
+	if fr.Filter != nil && !opt.RolloutOnly {
+		buckets, count, err := decodeBuckets(fr.Filter, opt.MaxFilterBytes)
+		if err == nil && fr.Entries != nil && *fr.Entries != count {
+			err = fmt.Errorf("go-temper: filter has %d entries but the backend declared %d", count, *fr.Entries)
 		}
+		if err != nil {
+			errs = append(errs, segmentError(segmentFilter, err))
+		} else {
+			decoded++
+			filter.cap = uint(len(buckets))
+			filter.buckets = buckets
+			filter.count = count
+			filter.bucketIndexMask = uint(len(buckets) - 1)
+			filter.full = fullBuckets(buckets)
 
-		if nextPowerOf2(uint64(size)) != uint(size) {
-			return nil, errors.New("go-temper: size must be a power of 2")
+			if opt.CompactFilter {
+				filter.compact()
+			}
 		}
+	}
 
-		count := uint(0)
-		buckets := make([]bucket, size)
-		r := bytes.NewReader(fr.Filter)
+	// Unpack the encoded hashed rollout data, the rollout data for the
+	// configured environment, the killed features, and the variants, if there
+	// are any.
+	if fr.Rollout != nil || fr.EnvRollouts[opt.Environment] != nil || fr.Killed != nil || fr.Variants != nil {
+		rollouts, envRollouts, killed, err := decodeRolloutSegment(fr, opt.Environment, opt.MaxRolloutEntries)
+		var variants map[uint64][]WeightedVariant
+		if err == nil {
+			variants, err = decodeVariants(fr.Variants, opt.MaxRolloutEntries)
+		}
+		if err != nil {
+			errs = append(errs, segmentError(segmentRollout, err))
+		} else {
+			decoded++
+			filter.rollouts = rollouts
+			filter.envRollouts = envRollouts
+			filter.killed = killed
+			filter.variants = variants
 
-		for i, b := range buckets {
-			for j := range b {
-				if err := binary.Read(r, binary.LittleEndian, &buckets[i][j]); err != nil {
-					return nil, fmt.Errorf("go-temper: failed to decode filter from http api response: %w", err)
-				}
-				if buckets[i][j] != 0 {
-					count++
+			if opt.Debug && opt.Logger != nil {
+				warnRolloutCollisions(opt.Logger, "rollout data", fr.Rollout)
+				if opt.Environment != "" {
+					warnRolloutCollisions(opt.Logger, "rollout data for environment "+opt.Environment, fr.EnvRollouts[opt.Environment])
 				}
 			}
 		}
+	}
+
+	// Only give up entirely when no segment could be decoded.
+	if len(errs) > 0 && decoded == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return filter, errors.Join(errs...)
+}
+
+// splitCombined splits the combined data of a FilterResponse into its filter
+// and rollout data, either of which is nil when it's empty.
+func splitCombined(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("go-temper: combined data of %d bytes is too short for its length prefix", len(data))
+	}
+	n := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	if uint64(n) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("go-temper: combined data declares %d bytes of filter data but only has %d bytes", n, len(data))
+	}
+
+	filterData, rolloutData := data[:n], data[n:]
+	if len(filterData) == 0 {
+		filterData = nil
+	}
+	if len(rolloutData) == 0 {
+		rolloutData = nil
+	}
+	return filterData, rolloutData, nil
+}
+
+// decodeBuckets unpacks the encoded cuckoo filter buckets, returning the
+// buckets and the number of occupied entries. If maxBytes is greater than 0,
+// data larger than it is rejected.
+func decodeBuckets(data []byte, maxBytes int) ([]bucket, uint, error) {
+	if maxBytes > 0 && len(data) > maxBytes {
+		return nil, 0, fmt.Errorf("go-temper: filter of %d bytes exceeds the maximum of %d bytes", len(data), maxBytes)
+	}
+	if len(data)%bucketSize != 0 {
+		offset := len(data) - len(data)%bucketSize
+		return nil, 0, decodeErrorAt(offset, offset/bytesPerBucket, errors.New("go-temper: bytes must be a multiple of 4"))
+	}
+
+	size := len(data) / bytesPerBucket
+	if size < 1 {
+		return nil, 0, errors.New("go-temper: data can not be smaller than 16 (size of a bucket)")
+	}
+
+	if p, ok := nextPowerOf2(uint64(size)); !ok {
+		return nil, 0, fmt.Errorf("go-temper: filter of %d buckets is too large", size)
+	} else if p != uint(size) {
+		return nil, 0, errors.New("go-temper: size must be a power of 2")
+	}
+
+	count := uint(0)
+	buckets := make([]bucket, size)
+	r := bytes.NewReader(data)
+
+	for i, b := range buckets {
+		for j := range b {
+			if err := binary.Read(r, binary.LittleEndian, &buckets[i][j]); err != nil {
+				return nil, 0, decodeErrorAt(i*bytesPerBucket+j*2, i, fmt.Errorf("go-temper: failed to decode filter from http api response: %w", err))
+			}
+			if buckets[i][j] != 0 {
+				count++
+			}
+		}
+	}
+
+	return buckets, count, nil
+}
 
-		filter.cap = uint(size)
-		filter.buckets = buckets
-		filter.count = count
-		filter.bucketIndexMask = uint(len(buckets) - 1)
+// fullBuckets returns the number of buckets with every entry occupied. As the
+// number of full buckets grows, so does the false positive rate.
+func fullBuckets(buckets []bucket) uint {
+	full := uint(0)
+	for _, b := range buckets {
+		if !b.contains(0) {
+			full++
+		}
 	}
+	return full
+}
 
-	// Unpack the encoded hashed rollout data.
-	rollouts := make(map[uint64]uint8)
+// decodeRolloutSegment unpacks the default rollout data, the rollout data for
+// the given environment, and the killed features.
+func decodeRolloutSegment(fr *FilterResponse, environment string, maxEntries int) (rollouts, envRollouts map[uint64]uint8, killed map[uint64]struct{}, err error) {
 	if fr.Rollout != nil {
-		r := bytes.NewReader(fr.Rollout)
+		if rollouts, err = decodeRollouts(fr.Rollout, maxEntries); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if data, ok := fr.EnvRollouts[environment]; ok && environment != "" {
+		if envRollouts, err = decodeRollouts(data, maxEntries); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if fr.Killed != nil {
+		if killed, err = decodeKilled(fr.Killed, maxEntries); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return rollouts, envRollouts, killed, nil
+}
+
+// decodeVariants validates the variants of multivariate features, and keys
+// them by rollout key. The weights of each feature's variants can't add up to
+// more than 100.
+func decodeVariants(entries []FeatureVariants, maxEntries int) (map[uint64][]WeightedVariant, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if maxEntries > 0 && len(entries) > maxEntries {
+		return nil, fmt.Errorf("go-temper: %d variant entries exceeds the maximum of %d entries", len(entries), maxEntries)
+	}
+
+	variants := make(map[uint64][]WeightedVariant, len(entries))
+	for _, e := range entries {
+		total := 0
+		for _, v := range e.Variants {
+			if v.Name == "" {
+				return nil, fmt.Errorf("go-temper: variant of feature %#x has no name", e.Feature)
+			}
+			total += int(v.Weight)
+		}
+		if total > 100 {
+			return nil, fmt.Errorf("go-temper: variant weights of feature %#x add up to %d, which is more than 100", e.Feature, total)
+		}
+		variants[rolloutKey(e.Feature)] = e.Variants
+	}
+
+	return variants, nil
+}
+
+// decodeKilled unpacks the encoded hashes of killed features.
+func decodeKilled(data []byte, maxEntries int) (map[uint64]struct{}, error) {
+	if len(data)%8 != 0 {
+		offset := len(data) - len(data)%8
+		return nil, decodeErrorAt(offset, offset/8, errors.New("go-temper: killed feature data must be a multiple of 8 bytes"))
+	}
+	if maxEntries > 0 && len(data)/8 > maxEntries {
+		return nil, fmt.Errorf("go-temper: %d killed features exceeds the maximum of %d entries", len(data)/8, maxEntries)
+	}
+
+	killed := make(map[uint64]struct{}, len(data)/8)
+	for i := 0; i < len(data); i += 8 {
+		killed[binary.LittleEndian.Uint64(data[i:])] = struct{}{}
+	}
+
+	return killed, nil
+}
+
+// inherit copies the segments that failed to decode, according to err, from
+// the previous filter, so that a failure in one segment doesn't discard a
+// good update to the other.
+func (f *filter) inherit(prev *filter, err error) {
+	if prev == nil {
+		return
+	}
+
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+
+	for _, err := range errs {
+		var de *DecodeError
+		if !errors.As(err, &de) {
+			continue
+		}
+
+		switch de.Segment {
+		case segmentFilter:
+			f.cap = prev.cap
+			f.buckets = prev.buckets
+			f.count = prev.count
+			f.full = prev.full
+			f.bucketIndexMask = prev.bucketIndexMask
+			f.sparseIndexes = prev.sparseIndexes
+			f.sparseBuckets = prev.sparseBuckets
+		case segmentRollout:
+			f.rollouts = prev.rollouts
+			f.envRollouts = prev.envRollouts
+			f.killed = prev.killed
+			f.variants = prev.variants
+		}
+	}
+}
+
+// decodeRollouts unpacks encoded hashed rollout data. Each entry is a little
+// endian uint64, where the low 8 bits are the rollout percentage, and the
+// remaining high bits are the hash of the feature. If maxEntries is greater
+// than 0, data with more entries than it is rejected.
+func decodeRollouts(data []byte, maxEntries int) (map[uint64]uint8, error) {
+	if len(data)%8 != 0 {
+		offset := len(data) - len(data)%8
+		return nil, decodeErrorAt(offset, offset/8, errors.New("go-temper: rollout data must be a multiple of 8 bytes"))
+	}
+	if maxEntries > 0 && len(data)/8 > maxEntries {
+		return nil, fmt.Errorf("go-temper: %d rollout entries exceeds the maximum of %d entries", len(data)/8, maxEntries)
+	}
+
+	r := bytes.NewReader(data)
+
+	entries := make([]uint64, r.Len()/8)
+	for i := range entries {
+		if err := binary.Read(r, binary.LittleEndian, &entries[i]); err != nil {
+			return nil, decodeErrorAt(i*8, i, fmt.Errorf("go-temper: failed to decode rollout data from http api response: %w", err))
+		}
+	}
+
+	rollouts := make(map[uint64]uint8, len(entries))
+	for _, e := range entries {
+		high := rolloutKey(e)
+		low := uint8(e & ((1 << 8) - 1))
+		rollouts[high] = low
+	}
+
+	return rollouts, nil
+}
+
+// rolloutCollisions returns the pairs of distinct entries in the encoded
+// rollout data that have the same rollout key, of which only the last is kept
+// by decodeRollouts. Since only the high 56 bits of a feature's hash are kept
+// in its entry, two features can collide even though their hashes differ.
+func rolloutCollisions(data []byte) [][2]uint64 {
+	seen := make(map[uint64]uint64, len(data)/8)
+	var collisions [][2]uint64
+	for i := 0; i+8 <= len(data); i += 8 {
+		e := binary.LittleEndian.Uint64(data[i:])
+		high := rolloutKey(e)
+		if prev, ok := seen[high]; ok && prev != e {
+			collisions = append(collisions, [2]uint64{prev, e})
+		}
+		seen[high] = e
+	}
+	return collisions
+}
+
+// warnRolloutCollisions logs every collision in the encoded rollout data, so
+// that the entries can be cross-referenced with the backend.
+func warnRolloutCollisions(logger Logger, what string, data []byte) {
+	for _, c := range rolloutCollisions(data) {
+		logger.Printf("go-temper: entries %#016x and %#016x in the %s collide on rollout key %#016x, only the second is used", c[0], c[1], what, rolloutKey(c[0]))
+	}
+}
+
+// FilterStats describes the size and occupancy of a filter.
+type FilterStats struct {
+	// Buckets is the number of buckets in the filter.
+	Buckets int
+
+	// Entries is the number of occupied entries across all buckets.
+	Entries int
+
+	// FullBuckets is the number of buckets with every entry occupied. When
+	// a large share of buckets are full, the filter is getting crowded, and
+	// false positives are more likely.
+	FullBuckets int
+}
+
+// stats returns the size and occupancy of the filter.
+func (f *filter) stats() FilterStats {
+	return FilterStats{
+		Buckets:     int(f.cap),
+		Entries:     int(f.count),
+		FullBuckets: int(f.full),
+	}
+}
+
+// validate checks the invariants of the filter, that its number of buckets is
+// a power of 2, that its counts of entries and full buckets match its buckets,
+// that every rollout percentage is at most 100, and that the weights of every
+// feature's variants add up to at most 100, returning an error describing
+// every invariant that doesn't hold.
+func (f *filter) validate() error {
+	var errs []error
+
+	if f.cap > 0 {
+		if p, ok := nextPowerOf2(uint64(f.cap)); !ok || p != f.cap {
+			errs = append(errs, fmt.Errorf("go-temper: filter of %d buckets isn't a power of 2", f.cap))
+		}
+		if f.bucketIndexMask != f.cap-1 {
+			errs = append(errs, fmt.Errorf("go-temper: bucket index mask %#x doesn't match %d buckets", f.bucketIndexMask, f.cap))
+		}
+	}
+
+	buckets := f.buckets
+	if buckets == nil {
+		buckets = f.sparseBuckets
+		if len(f.sparseIndexes) != len(f.sparseBuckets) {
+			errs = append(errs, fmt.Errorf("go-temper: compact filter has %d indexes for %d buckets", len(f.sparseIndexes), len(f.sparseBuckets)))
+		}
+		if !slices.IsSorted(f.sparseIndexes) || (len(f.sparseIndexes) > 0 && uint(f.sparseIndexes[len(f.sparseIndexes)-1]) >= f.cap) {
+			errs = append(errs, errors.New("go-temper: compact filter has bucket indexes out of order or out of range"))
+		}
+	} else if uint(len(buckets)) != f.cap {
+		errs = append(errs, fmt.Errorf("go-temper: filter has %d buckets but a capacity of %d", len(buckets), f.cap))
+	}
 
-		entries := make([]uint64, r.Len()/8)
-		for i := range entries {
-			if err := binary.Read(r, binary.LittleEndian, &entries[i]); err != nil {
-				return nil, fmt.Errorf("go-temper: failed to decode rollout data from http api response: %w", err)
+	count := uint(0)
+	for _, b := range buckets {
+		for _, entry := range b {
+			if entry != 0 {
+				count++
 			}
 		}
+	}
+	if count != f.count {
+		errs = append(errs, fmt.Errorf("go-temper: filter has %d entries but a count of %d", count, f.count))
+	}
+	if count > f.cap*bucketSize {
+		errs = append(errs, fmt.Errorf("go-temper: filter has %d entries, more than its capacity of %d", count, f.cap*bucketSize))
+	}
+	if full := fullBuckets(buckets); full != f.full {
+		errs = append(errs, fmt.Errorf("go-temper: filter has %d full buckets but a count of %d", full, f.full))
+	}
+
+	for _, rollouts := range []map[uint64]uint8{f.rollouts, f.envRollouts} {
+		for high, rollout := range rollouts {
+			if rollout > 100 {
+				errs = append(errs, fmt.Errorf("go-temper: rollout of feature %#x is %d%%, which is more than 100%%", high, rollout))
+			}
+		}
+	}
 
-		for _, e := range entries {
-			high := (e >> 8) << 8
-			low := uint8(e & ((1 << 8) - 1))
-			rollouts[high] = low
+	for high, variants := range f.variants {
+		total := 0
+		for _, v := range variants {
+			total += int(v.Weight)
 		}
+		if total > 100 {
+			errs = append(errs, fmt.Errorf("go-temper: variant weights of feature %#x add up to %d, which is more than 100", high, total))
+		}
+	}
 
-		filter.rollouts = rollouts
+	if f.rolloutHash != "" && f.rolloutHash != RolloutHashSHA256 {
+		errs = append(errs, fmt.Errorf("go-temper: unknown rollout hash %q", f.rolloutHash))
 	}
 
-	return filter, nil
+	return errors.Join(errs...)
 }
 
 // fingerprintAndIndex returns the fingerprint of the given data, and the
@@ -144,14 +672,23 @@ func (f *filter) fingerprintAndIndex(data []byte) (uint16, uint) {
 	// Start by computing the hash of the given data.
 	hash := hash(data)
 
-	// Compute the fingerprint.
-	shifted := hash >> (64 - 16)
-	fingerprint := uint16(shifted%(maxFingerprint-1) + 1)
-
 	// Derive the index using the least significant bits.
 	index := uint(hash) & f.bucketIndexMask
 
-	return fingerprint, index
+	return fingerprintOf(hash), index
+}
+
+// fingerprintOf returns the fingerprint of data with the given hash.
+func fingerprintOf(hash uint64) uint16 {
+	shifted := hash >> (64 - 16)
+	return uint16(shifted%(maxFingerprint-1) + 1)
+}
+
+// candidates returns the indexes of both buckets that data with the given
+// fingerprint and hash can be in.
+func (f *filter) candidates(fingerprint uint16, hash uint64) (uint, uint) {
+	index := uint(hash) & f.bucketIndexMask
+	return index, f.altIndex(fingerprint, index)
 }
 
 // altIndex returns the secondary index to store or retrieve a value in the
@@ -168,13 +705,150 @@ func (f *filter) altIndex(fingerprint uint16, index uint) uint {
 	return (index ^ hash) & f.bucketIndexMask
 }
 
-// lookupRollout looks up the rollout entry in the filter's rollout table. If
-// the value is not found, the returned value is 0, indicating the client (or
-// filter or whatever) must consult the filter.
-func (f *filter) lookupRollout(data []byte) bool {
-	// Compute the hash of the full byte slice in case we need it later.
-	hfull := hash(data)
+// maxKicks is how many entries insert relocates before it gives up on
+// finding room for a fingerprint, and minBuildBuckets is the fewest buckets
+// buildFilter uses. Keys that only differ in their last byte, like sequential
+// actor IDs, often share a fingerprint, since the high bits of fnv-1a barely
+// change, so they're only told apart by their bucket indexes, which need
+// enough buckets to differ.
+const (
+	maxKicks        = 500
+	minBuildBuckets = 64
+)
+
+// newFilter returns an empty filter with the given number of buckets, which
+// must be a power of 2.
+func newFilter(size uint) *filter {
+	return &filter{
+		cap:             size,
+		buckets:         make([]bucket, size),
+		bucketIndexMask: size - 1,
+	}
+}
+
+// buildSeed seeds the source that chooses evicted entries when a filter is
+// built without one.
+const buildSeed = 0x74656d706572
+
+// buildFilter returns a filter containing every key, the same way as the
+// backend builds them, growing it until there's room for all of the keys. The
+// entries that are evicted to make room are chosen by rng, or by a source
+// with a fixed seed when it's nil, so the same keys always build the same
+// filter unless a different rng is given.
+func buildFilter(keys [][]byte, rng *rand.Rand) *filter {
+	if rng == nil {
+		rng = rand.New(rand.NewPCG(buildSeed, buildSeed))
+	}
+
+	// Start at a load of at most 50%, which almost always has room.
+	size, _ := nextPowerOf2(uint64(max(2*len(keys)/bucketSize, minBuildBuckets)))
+	for ; ; size *= 2 {
+		f := newFilter(size)
+		f.rand = rng
+		inserted := true
+		for _, key := range keys {
+			if !f.insert(key) {
+				inserted = false
+				break
+			}
+		}
+		if inserted {
+			return f
+		}
+	}
+}
+
+// insert adds data to the filter, relocating the entries in its candidate
+// buckets when they're both full, and returns false if there's no room for
+// it. A failed insert can leave the filter without an entry that was
+// relocated, so the filter must be rebuilt with more buckets when it fails.
+//
+// Like the backend, insert stores a fingerprint again even when it's already
+// in one of the candidate buckets, since two distinct keys can collide on the
+// same fingerprint and bucket. Each of them then has its own entry, so
+// deleting one of the keys leaves the other in the filter.
+func (f *filter) insert(data []byte) bool {
+	f.versionID.Store(nil)
+
+	fingerprint, index := f.fingerprintAndIndex(data)
+	alt := f.altIndex(fingerprint, index)
+	if f.insertInto(index, fingerprint) || f.insertInto(alt, fingerprint) {
+		return true
+	}
+
+	for range maxKicks {
+		// Swap the fingerprint with a random one in the full bucket, and
+		// try to move the evicted one to its other bucket.
+		slot := f.evictSlot()
+		fingerprint, f.buckets[alt][slot] = f.buckets[alt][slot], fingerprint
+		alt = f.altIndex(fingerprint, alt)
+		if f.insertInto(alt, fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// evictSlot returns the slot of the entry to evict from a full bucket.
+func (f *filter) evictSlot() int {
+	if f.rand != nil {
+		return f.rand.IntN(bucketSize)
+	}
+	return rand.IntN(bucketSize)
+}
+
+// delete removes a single entry for data from the filter, returning false if
+// it isn't in the filter. When the fingerprint of data is stored more than
+// once, because distinct keys collided on it, only one of the entries is
+// removed, so the filter still contains data until every one of the keys is
+// deleted. Compact filters can't be modified.
+func (f *filter) delete(data []byte) bool {
+	if f.buckets == nil {
+		return false
+	}
 
+	f.versionID.Store(nil)
+
+	fingerprint, index := f.fingerprintAndIndex(data)
+	return f.deleteFrom(index, fingerprint) || f.deleteFrom(f.altIndex(fingerprint, index), fingerprint)
+}
+
+// deleteFrom removes a single entry for the fingerprint from the bucket at
+// index, and returns false if the bucket doesn't contain it.
+func (f *filter) deleteFrom(index uint, fingerprint uint16) bool {
+	b := &f.buckets[index]
+	for i, entry := range b {
+		if entry == fingerprint {
+			if !b.contains(0) {
+				f.full--
+			}
+			b[i] = 0
+			f.count--
+			return true
+		}
+	}
+	return false
+}
+
+// insertInto adds the fingerprint to an empty entry in the bucket at index,
+// and returns false if the bucket is full.
+func (f *filter) insertInto(index uint, fingerprint uint16) bool {
+	b := &f.buckets[index]
+	for i, entry := range b {
+		if entry == 0 {
+			b[i] = fingerprint
+			f.count++
+			if !b.contains(0) {
+				f.full++
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// featureSegment returns the top-level feature segment of the given key.
+func featureSegment(data []byte) []byte {
 	index := bytes.Index(data, []byte(":"))
 	if index > 0 {
 		// Fully qualified keys are typically in the format
@@ -183,14 +857,41 @@ func (f *filter) lookupRollout(data []byte) bool {
 		// everything after the first `:`. If no `:` is present, we use the entire
 		// byte slice of data, making the assumption that it is the top-level
 		// feature key.
-		data = data[:index]
+		return data[:index]
 	}
+	return data
+}
+
+// rollout returns the rollout percentage for the given high bits of a feature
+// hash, preferring the entry for the configured environment over the default.
+func (f *filter) rollout(high uint64) (uint8, bool) {
+	if rollout, ok := f.envRollouts[high]; ok {
+		return rollout, true
+	}
+
+	rollout, ok := f.rollouts[high]
+	return rollout, ok
+}
+
+// lookupRollout looks up the rollout entry in the filter's rollout table. If
+// the value is not found, the returned value is 0, indicating the client (or
+// filter or whatever) must consult the filter.
+func (f *filter) lookupRollout(data, seed []byte) bool {
+	// Compute the hash of the full byte slice in case we need it later.
+	hfull := f.seededHash(data, seed)
 
 	// Compute the hash of only the feature segment of the byte slice to
 	// pull the rollout percentage from the rollouts map.
-	hfeat := hash(data)
-	high := (hfeat >> 8) << 8
-	rollout := f.rollouts[high]
+	hfeat := hash(featureSegment(data))
+
+	return f.lookupRolloutHash(hfeat, hfull)
+}
+
+// lookupRolloutHash looks up the rollout entry for the feature hash hfeat,
+// and checks whether the full key hash hfull falls within it.
+func (f *filter) lookupRolloutHash(hfeat, hfull uint64) bool {
+	high := rolloutKey(hfeat)
+	rollout, _ := f.rollout(high)
 
 	// Fast path: if the rollout is 100, return true now so we don't have to
 	// check the mod of the hash of the entire data byte slice.
@@ -199,30 +900,208 @@ func (f *filter) lookupRollout(data []byte) bool {
 	}
 	// Otherwise get the last two digits of the full hash and compare it with
 	// the rollout percentage.
-	return uint8(hfull%100) <= rollout
+	return rolloutBucket(hfull) <= rollout
+}
+
+// rolloutBucket returns the bucket, from 0 to 99, that the given full key hash
+// falls into, which is compared against rollout percentages.
+func rolloutBucket(hfull uint64) uint8 {
+	return uint8(hfull % 100)
 }
 
-// lookupFilter checks if the data is in the filter.
+// lookupFilter checks if the data is in the filter. Both candidate buckets
+// are read from the same filter, so the result is consistent as long as the
+// caller only reads the client's filter once.
 func (f *filter) lookupFilter(data []byte) bool {
-	if f.buckets == nil {
+	if f.cap == 0 {
 		return false
 	}
 
 	fingerprint, index := f.fingerprintAndIndex(data)
-	if f.buckets[index].contains(fingerprint) {
+	if f.bucketContains(index, fingerprint) {
 		return true
 	}
 
 	index = f.altIndex(fingerprint, index)
-	return f.buckets[index].contains(fingerprint)
+	return f.bucketContains(index, fingerprint)
+}
+
+// bucketContains returns true if the fingerprint is in the bucket at index.
+func (f *filter) bucketContains(index uint, fingerprint uint16) bool {
+	if f.buckets != nil {
+		return f.buckets[index].contains(fingerprint)
+	}
+
+	i, ok := slices.BinarySearch(f.sparseIndexes, uint32(index))
+	return ok && f.sparseBuckets[i].contains(fingerprint)
+}
+
+// compact replaces the filter's buckets with a sparse representation that
+// only keeps the non-empty buckets, which uses less memory for filters that
+// are mostly empty at the cost of a binary search per lookup. Since each
+// non-empty bucket also needs its index, the buckets are left as they are
+// when the sparse representation wouldn't be smaller.
+func (f *filter) compact() {
+	if f.buckets == nil {
+		return
+	}
+
+	occupied := 0
+	for _, b := range f.buckets {
+		if b != (bucket{}) {
+			occupied++
+		}
+	}
+	if occupied*(bytesPerBucket+bytesPerSparseIndex) >= len(f.buckets)*bytesPerBucket {
+		return
+	}
+
+	f.sparseIndexes = make([]uint32, 0, occupied)
+	f.sparseBuckets = make([]bucket, 0, occupied)
+	for i, b := range f.buckets {
+		if b != (bucket{}) {
+			f.sparseIndexes = append(f.sparseIndexes, uint32(i))
+			f.sparseBuckets = append(f.sparseBuckets, b)
+		}
+	}
+	f.buckets = nil
+}
+
+// bucketBytes returns the number of bytes used to store the filter's
+// buckets, either dense or sparse.
+func (f *filter) bucketBytes() int {
+	if f.buckets != nil {
+		return len(f.buckets) * bytesPerBucket
+	}
+	return len(f.sparseBuckets) * (bytesPerBucket + bytesPerSparseIndex)
+}
+
+// isKilled returns true if the feature with the given hash has been killed.
+func (f *filter) isKilled(hfeat uint64) bool {
+	_, ok := f.killed[hfeat]
+	return ok
 }
 
 // lookup returns true if data is in the filter or is enabled by the rollout
-// data.
+// data, and its feature hasn't been killed.
 func (f *filter) lookup(data []byte) bool {
-	if f.lookupRollout(data) {
+	return f.lookupSeeded(data, nil)
+}
+
+// lookupSeeded is like lookup, but mixes seed into the hash of the full key
+// that's compared against the rollout percentage. The filter itself is
+// unaffected by the seed.
+func (f *filter) lookupSeeded(data, seed []byte) bool {
+	if len(f.killed) > 0 && f.isKilled(hash(featureSegment(data))) {
+		return false
+	}
+
+	if f.lookupRollout(data, seed) {
+		return true
+	}
+
+	return f.lookupFilter(data)
+}
+
+// fullHash returns the hash of a full key that's compared against rollout
+// percentages.
+func (f *filter) fullHash(data []byte) uint64 {
+	if f.rolloutHash == RolloutHashSHA256 {
+		return hashSHA256(data)
+	}
+	return hash(data)
+}
+
+// seededHash returns the full key hash of data mixed with seed, which is the
+// same as the full key hash of data when the seed is empty.
+func (f *filter) seededHash(data, seed []byte) uint64 {
+	if len(seed) == 0 {
+		return f.fullHash(data)
+	}
+
+	b := make([]byte, 0, len(data)+1+len(seed))
+	b = append(b, data...)
+	b = append(b, 0)
+	b = append(b, seed...)
+	return f.fullHash(b)
+}
+
+// lookupGlobal returns true if data is in the filter or is enabled by the
+// rollout data, treating all of data as the feature segment.
+func (f *filter) lookupGlobal(data []byte) bool {
+	h := hash(data)
+	if f.isKilled(h) {
+		return false
+	}
+
+	hfull := h
+	if f.rolloutHash != "" {
+		hfull = f.fullHash(data)
+	}
+	if f.lookupRolloutHash(h, hfull) {
 		return true
 	}
 
 	return f.lookupFilter(data)
 }
+
+// variant returns the name of the variant that data is assigned to, by
+// mapping its rollout bucket onto the cumulative weights of its feature's
+// variants. It returns an empty string if the feature has no variants, has
+// been killed, or if the bucket is past the total weight of the variants.
+func (f *filter) variant(data []byte) string {
+	hfeat := hash(featureSegment(data))
+	variants, ok := f.variants[rolloutKey(hfeat)]
+	if !ok || f.isKilled(hfeat) {
+		return ""
+	}
+
+	bucket := rolloutBucket(f.fullHash(data))
+	cumulative := uint8(0)
+	for _, v := range variants {
+		cumulative += v.Weight
+		if bucket < cumulative {
+			return v.Name
+		}
+	}
+	return ""
+}
+
+// empty returns true if the filter has no buckets and no rollout data, which
+// is the state of the filter installed when the initial fetch fails.
+func (f *filter) empty() bool {
+	return f == nil || (f.cap == 0 && len(f.rollouts) == 0 && len(f.envRollouts) == 0 && len(f.killed) == 0 && len(f.variants) == 0)
+}
+
+// known returns true if the filter has a rollout entry or variants for the
+// feature segment of data, or it's killed, or if data is in the filter.
+// Whether a feature is known for every actor can only be decided by the
+// former, since the filter itself only holds hashes of fully qualified keys.
+func (f *filter) known(data []byte) bool {
+	hfeat := hash(featureSegment(data))
+	if f.isKilled(hfeat) {
+		return true
+	}
+	high := rolloutKey(hfeat)
+	if _, ok := f.rollout(high); ok {
+		return true
+	}
+	if _, ok := f.variants[high]; ok {
+		return true
+	}
+
+	return f.lookupFilter(data)
+}
+
+// knownGlobal is like known, but for a global feature checked with
+// CheckGlobal, whose name is the whole of data, even if it contains a `:`.
+func (f *filter) knownGlobal(data []byte) bool {
+	h := hash(data)
+	if f.isKilled(h) {
+		return true
+	}
+	if _, ok := f.rollout(rolloutKey(h)); ok {
+		return true
+	}
+	return f.lookupFilter(data)
+}
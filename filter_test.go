@@ -1,13 +1,21 @@
 package temper
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
 	"testing"
 )
 
 func Test_filter(t *testing.T) {
 	rawFilterResp := []byte(`{"filter":"AAAAAAAAAAChyQAAAAAAAKHJAAAAAAAAONKlyQAAAAAIhwAAAAAAAAAAAAAAAAAAAAAAAAAAAABAnQAAAAAAAAAAAAAAAAAAAAAAAAAAAADLPwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAcdx5tgAAAACNEQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAPaPvckAAAAAAAAAAAAAAACSYQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA==","rollout":"ZPPzHfbwt2xk7lAWLwPCQgE+Qryr1ydL"}`)
-	fr := &filterResponse{}
+	fr := &FilterResponse{}
 	if err := json.Unmarshal(rawFilterResp, fr); err != nil {
 		t.Fatalf("failed to decode json: %v", err)
 	}
@@ -30,7 +38,7 @@ func Test_filter(t *testing.T) {
 
 func Test_filter_RolloutPercentage(t *testing.T) {
 	rawFilterResp := []byte(`{"filter":null,"rollout":"MkVpBxSg9TI="}`)
-	fr := &filterResponse{}
+	fr := &FilterResponse{}
 	if err := json.Unmarshal(rawFilterResp, fr); err != nil {
 		t.Fatalf("failed to decode json: %v", err)
 	}
@@ -53,7 +61,7 @@ func Test_filter_RolloutPercentage(t *testing.T) {
 
 func Test_filter_RolloutOnly(t *testing.T) {
 	rawFilterResp := []byte(`{"filter":null,"rollout":"ZPPzHfbwt2xk7lAWLwPCQgE+Qryr1ydL"}`)
-	fr := &filterResponse{}
+	fr := &FilterResponse{}
 	if err := json.Unmarshal(rawFilterResp, fr); err != nil {
 		t.Fatalf("failed to decode json: %v", err)
 	}
@@ -71,9 +79,374 @@ func Test_filter_RolloutOnly(t *testing.T) {
 	}
 }
 
+func Test_filter_lookupSeeded(t *testing.T) {
+	f, err := from(&FilterResponse{Rollout: encodeRollouts(map[string]uint8{"experiment": 50})})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	enabled, moved := 0, 0
+	for i := range 1000 {
+		key := []byte(fmt.Sprintf("experiment:user:%d", i))
+		if f.lookupSeeded(key, nil) != f.lookup(key) {
+			t.Fatalf("expected an empty seed to match lookup for %s", key)
+		}
+
+		v := f.lookupSeeded(key, []byte("phase2"))
+		if v {
+			enabled++
+		}
+		if v != f.lookup(key) {
+			moved++
+		}
+	}
+	if enabled < 400 || enabled > 600 {
+		t.Errorf("expected about half of the keys to be enabled with a seed but got %d", enabled)
+	}
+	if moved == 0 {
+		t.Error("expected the seed to reshuffle which keys are enabled")
+	}
+
+	// Explicitly enabled keys are unaffected by the seed.
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	if f, err = from(fr); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	for _, seed := range []string{"phase2", "phase3", "phase4"} {
+		if v := f.lookupSeeded([]byte("temper_api_e2e:user:1"), []byte(seed)); !v {
+			t.Errorf("expected temper_api_e2e:user:1 to be true with seed %s but got %v", seed, v)
+		}
+	}
+}
+
+func Test_filter_RolloutHash(t *testing.T) {
+	fr := &FilterResponse{Rollout: encodeRollouts(map[string]uint8{"experiment": 9})}
+
+	// The backend hasn't agreed to use sha256, so fnv-1a is still used.
+	f, err := from(fr, &Option{RolloutHash: RolloutHashSHA256})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if f.rolloutHash != "" {
+		t.Fatalf("expected the default rollout hash without the backend's agreement but got %q", f.rolloutHash)
+	}
+
+	fr.RolloutHash = RolloutHashSHA256
+	if f, err = from(fr); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if f.rolloutHash != "" {
+		t.Fatalf("expected the default rollout hash without the option but got %q", f.rolloutHash)
+	}
+
+	if f, err = from(fr, &Option{RolloutHash: RolloutHashSHA256}); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if f.rolloutHash != RolloutHashSHA256 {
+		t.Fatalf("expected the sha256 rollout hash but got %q", f.rolloutHash)
+	}
+
+	enabled := 0
+	for i := range 10000 {
+		key := []byte(fmt.Sprintf("experiment:user:%d", i))
+		if v := f.lookup(key); v != (hashSHA256(key)%100 <= 9) {
+			t.Fatalf("expected %s to be compared using the sha256 hash", key)
+		} else if v {
+			enabled++
+		}
+	}
+	if enabled < 900 || enabled > 1100 {
+		t.Errorf("expected about 10%% of the keys to be enabled but got %d", enabled)
+	}
+}
+
+func Test_hashSHA256_distribution(t *testing.T) {
+	const keys = 100000
+	var buckets [100]int
+	for i := range keys {
+		buckets[hashSHA256([]byte(fmt.Sprintf("feature:user:%d", i)))%100]++
+	}
+
+	// A chi-squared test with 99 degrees of freedom, which exceeds 148.23
+	// with a probability of 0.001 for a uniform distribution.
+	expected := float64(keys) / 100
+	chi2 := 0.0
+	for _, n := range buckets {
+		d := float64(n) - expected
+		chi2 += d * d / expected
+	}
+	if chi2 > 148.23 {
+		t.Errorf("expected buckets to be uniformly distributed but got chi-squared %.2f: %v", chi2, buckets)
+	}
+}
+
+func Test_nextPowerOf2(t *testing.T) {
+	for _, tt := range []struct {
+		n    uint64
+		want uint
+		ok   bool
+	}{
+		{0, 1, true},
+		{1, 1, true},
+		{3, 4, true},
+		{1024, 1024, true},
+		{1025, 2048, true},
+		{maxPowerOf2 - 1, maxPowerOf2, true},
+		{maxPowerOf2, maxPowerOf2, true},
+		{maxPowerOf2 + 1, 0, false},
+		{math.MaxUint64, 0, false},
+	} {
+		got, ok := nextPowerOf2(tt.n)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("expected nextPowerOf2(%d) to be %d, %v but got %d, %v", tt.n, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func Test_filter_variant(t *testing.T) {
+	fr := &FilterResponse{
+		Variants: []FeatureVariants{{
+			Feature: hash([]byte("checkout")),
+			Variants: []WeightedVariant{
+				{Name: "control", Weight: 50},
+				{Name: "a", Weight: 30},
+				{Name: "b", Weight: 20},
+			},
+		}},
+	}
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for i := range 10000 {
+		key := []byte(fmt.Sprintf("checkout:user:%d", i))
+		v := f.variant(key)
+
+		bucket := rolloutBucket(hash(key))
+		expected := "b"
+		if bucket < 50 {
+			expected = "control"
+		} else if bucket < 80 {
+			expected = "a"
+		}
+		if v != expected {
+			t.Fatalf("expected %s in bucket %d to be %s but got %s", key, bucket, expected, v)
+		}
+		counts[v]++
+	}
+	if counts["control"] < 4800 || counts["a"] < 2800 || counts["b"] < 1800 {
+		t.Errorf("expected the variants to be distributed by weight but got %v", counts)
+	}
+
+	if v := f.variant([]byte("other:user:1")); v != "" {
+		t.Errorf("expected no variant for a feature without variants but got %q", v)
+	}
+
+	// Weights that add up to less than 100 leave some keys without a variant.
+	fr.Variants[0].Variants = []WeightedVariant{{Name: "a", Weight: 10}}
+	if f, err = from(fr); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	for i := range 100 {
+		key := []byte(fmt.Sprintf("checkout:user:%d", i))
+		if v, in := f.variant(key), rolloutBucket(hash(key)) < 10; (v == "a") != in {
+			t.Errorf("expected %s to be in variant a %v but got %q", key, in, v)
+		}
+	}
+
+	fr.Variants[0].Variants = []WeightedVariant{{Name: "a", Weight: 60}, {Name: "b", Weight: 41}}
+	if _, err := from(fr); err == nil {
+		t.Error("expected an error for variant weights that add up to more than 100")
+	}
+}
+
+func Test_from_RolloutOnly(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	f, err := from(fr, &Option{RolloutOnly: true})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if f.buckets != nil || f.sparseBuckets != nil || f.cap != 0 {
+		t.Errorf("expected no buckets to be allocated but got %d", f.cap)
+	}
+
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+	// Enabled by the filter, which isn't loaded.
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false but got %v", v)
+	}
+}
+
+func Test_buildFilter(t *testing.T) {
+	var keys [][]byte
+	for i := range 10000 {
+		keys = append(keys, []byte(fmt.Sprintf("feature:user:%d", i)))
+	}
+
+	f := buildFilter(keys, nil)
+	if err := f.validate(); err != nil {
+		t.Fatalf("expected a valid filter but got %v", err)
+	}
+	if f.count != 10000 {
+		t.Errorf("expected 10000 entries but got %d", f.count)
+	}
+	for _, key := range keys {
+		if !f.lookupFilter(key) {
+			t.Fatalf("expected %s to be in the filter", key)
+		}
+	}
+
+	falsePositives := 0
+	for i := range 10000 {
+		if f.lookupFilter([]byte(fmt.Sprintf("other:user:%d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 10 {
+		t.Errorf("expected a false positive rate under 0.1%% but got %d in 10000", falsePositives)
+	}
+
+	if f := buildFilter(nil, nil); f.cap != minBuildBuckets || f.lookupFilter([]byte("feature:user:1")) {
+		t.Errorf("expected an empty filter but got %+v", f.stats())
+	}
+}
+
+func Test_buildFilter_InsertRand(t *testing.T) {
+	// Nearly filling a small filter forces many evictions.
+	build := func(seed uint64) *filter {
+		f := newFilter(minBuildBuckets)
+		f.rand = rand.New(rand.NewPCG(seed, seed))
+		for i := range minBuildBuckets * bucketSize * 9 / 10 {
+			f.insert([]byte(fmt.Sprintf("feature:user:%d", i)))
+		}
+		return f
+	}
+	if a, b := build(1), build(1); !slices.Equal(a.buckets, b.buckets) {
+		t.Error("expected the same seed to build identical filters")
+	}
+
+	enabled := make(map[string]bool)
+	for i := range 10000 {
+		enabled[fmt.Sprintf("feature:user:%d", i)] = true
+	}
+	for _, tt := range []struct {
+		name string
+		opt  func() *Option
+	}{
+		{"seeded", func() *Option { return &Option{InsertRand: rand.New(rand.NewPCG(1, 2))} }},
+		{"default", func() *Option { return nil }},
+	} {
+		var snapshots [][]byte
+		for range 2 {
+			f, err := NewFilterFromMap(enabled, nil, tt.opt())
+			if err != nil {
+				t.Fatalf("failed to build filter: %v", err)
+			}
+			data, err := f.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal filter: %v", err)
+			}
+			snapshots = append(snapshots, data)
+		}
+		if !bytes.Equal(snapshots[0], snapshots[1]) {
+			t.Errorf("expected the %s source to build byte for byte identical filters from a map", tt.name)
+		}
+	}
+}
+
+func Test_bucket_duplicateFingerprints(t *testing.T) {
+	b := bucket{7, 7, 0, 0}
+	if !b.contains(7) {
+		t.Error("expected the bucket to contain the duplicated fingerprint")
+	}
+
+	// The backend stores a fingerprint once per key, so each duplicate is
+	// counted as an occupied entry.
+	data := binary.LittleEndian.AppendUint16(nil, 7)
+	data = binary.LittleEndian.AppendUint16(data, 7)
+	data = append(data, 0, 0, 0, 0)
+	buckets, count, err := decodeBuckets(data, 0)
+	if err != nil {
+		t.Fatalf("failed to decode buckets: %v", err)
+	}
+	if count != 2 || buckets[0] != b {
+		t.Errorf("expected both duplicates to be counted but got %d in %v", count, buckets)
+	}
+}
+
+func Test_filter_delete(t *testing.T) {
+	// These keys only differ in their last byte, so they share a
+	// fingerprint, and with a single bucket, they share a bucket too.
+	key1, key2 := []byte("beta:user:1"), []byte("beta:user:2")
+
+	f := newFilter(1)
+	for _, key := range [][]byte{key1, key2} {
+		if !f.insert(key) {
+			t.Fatalf("failed to insert %s", key)
+		}
+	}
+	fingerprint, _ := f.fingerprintAndIndex(key1)
+	if want := (bucket{fingerprint, fingerprint, 0, 0}); f.buckets[0] != want || f.count != 2 {
+		t.Fatalf("expected the colliding keys to have an entry each but got %v", f.buckets[0])
+	}
+
+	// Deleting one of the keys only removes one of the entries, so the other
+	// key is still in the filter.
+	if !f.delete(key1) {
+		t.Fatalf("failed to delete %s", key1)
+	}
+	if !f.lookupFilter(key2) || f.count != 1 {
+		t.Errorf("expected %s to still be in the filter with 1 entry but got %d", key2, f.count)
+	}
+
+	if !f.delete(key2) {
+		t.Fatalf("failed to delete %s", key2)
+	}
+	if f.lookupFilter(key1) || f.lookupFilter(key2) || f.count != 0 {
+		t.Errorf("expected an empty filter but got %v", f.buckets[0])
+	}
+	if f.delete(key1) {
+		t.Error("expected deleting a key that isn't in the filter to fail")
+	}
+
+	// Filling and emptying a bucket keeps the count of full buckets.
+	for range bucketSize {
+		f.insert(key1)
+	}
+	if f.full != 1 {
+		t.Errorf("expected 1 full bucket but got %d", f.full)
+	}
+	f.delete(key1)
+	if err := f.validate(); err != nil {
+		t.Errorf("expected a valid filter after deleting but got %v", err)
+	}
+
+	compact := newFilter(64)
+	compact.insert(key1)
+	compact.compact()
+	if compact.buckets != nil {
+		t.Fatal("expected the filter to be compacted")
+	}
+	if compact.delete(key1) {
+		t.Error("expected deleting from a compact filter to fail")
+	}
+}
+
 func Test_filter_zero(t *testing.T) {
 	rawFilterResp := []byte(`{}`)
-	fr := &filterResponse{}
+	fr := &FilterResponse{}
 	if err := json.Unmarshal(rawFilterResp, fr); err != nil {
 		t.Fatalf("failed to decode json: %v", err)
 	}
@@ -91,3 +464,402 @@ func Test_filter_zero(t *testing.T) {
 		t.Errorf("expected value to be false but got %v", v)
 	}
 }
+
+// encodeRollouts encodes the given feature rollout percentages the same way
+// as the Temper backend.
+func encodeRollouts(rollouts map[string]uint8) []byte {
+	data := make([]byte, 0, len(rollouts)*8)
+	for feature, rollout := range rollouts {
+		high := rolloutKey(hash([]byte(feature)))
+		data = binary.LittleEndian.AppendUint64(data, high|uint64(rollout))
+	}
+	return data
+}
+
+func Test_filter_EnvRollouts(t *testing.T) {
+	fr := &FilterResponse{
+		Rollout: encodeRollouts(map[string]uint8{"env_feature": 100}),
+		EnvRollouts: map[string][]byte{
+			"staging": encodeRollouts(map[string]uint8{"env_feature": 0}),
+		},
+	}
+	key := []byte("env_feature:user:2") // hash mod 100 becomes 70.
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if v := f.lookup(key); !v {
+		t.Errorf("expected %s to be true with no environment but got %v", key, v)
+	}
+
+	f, err = from(fr, &Option{Environment: "staging"})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if v := f.lookup(key); v {
+		t.Errorf("expected %s to be false in staging but got %v", key, v)
+	}
+
+	f, err = from(fr, &Option{Environment: "production"})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if v := f.lookup(key); !v {
+		t.Errorf("expected %s to fall back to the default rollout in production but got %v", key, v)
+	}
+}
+
+func Test_from_PartialFailure(t *testing.T) {
+	good := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, good); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	prev, err := from(good)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	// A malformed rollout segment still lets the filter segment install.
+	f, err := from(&FilterResponse{Filter: good.Filter, Rollout: []byte{1, 2, 3}})
+	if f == nil || err == nil {
+		t.Fatalf("expected a partial filter and an error but got %v and %v", f, err)
+	}
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	f.inherit(prev, err)
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be inherited but got %v", v)
+	}
+
+	// A malformed filter segment still lets the rollout segment install.
+	f, err = from(&FilterResponse{Filter: []byte{1, 2, 3}, Rollout: good.Rollout})
+	if f == nil || err == nil {
+		t.Fatalf("expected a partial filter and an error but got %v and %v", f, err)
+	}
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+	f.inherit(prev, err)
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be inherited but got %v", v)
+	}
+
+	// When every segment is malformed there's nothing to install.
+	f, err = from(&FilterResponse{Filter: []byte{1, 2, 3}, Rollout: []byte{1, 2, 3}})
+	if f != nil || err == nil {
+		t.Fatalf("expected no filter and an error but got %v and %v", f, err)
+	}
+}
+
+func Test_from_DecodeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		fr      *FilterResponse
+		segment string
+		offset  int
+		index   int
+	}{
+		{"truncated filter", &FilterResponse{Filter: make([]byte, 19)}, segmentFilter, 16, 2},
+		{"truncated rollout", &FilterResponse{Rollout: make([]byte, 12)}, segmentRollout, 8, 1},
+		{"too large", &FilterResponse{Rollout: make([]byte, 16)}, segmentRollout, -1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := from(tt.fr, &Option{MaxRolloutEntries: 1})
+
+			var de *DecodeError
+			if !errors.As(err, &de) {
+				t.Fatalf("expected a DecodeError but got %v", err)
+			}
+			if de.Segment != tt.segment {
+				t.Errorf("expected segment %q but got %q", tt.segment, de.Segment)
+			}
+			if de.Offset != tt.offset || de.Index != tt.index {
+				t.Errorf("expected offset %d and index %d but got %d and %d", tt.offset, tt.index, de.Offset, de.Index)
+			}
+		})
+	}
+}
+
+func Test_filter_lookupGlobal(t *testing.T) {
+	fr := &FilterResponse{
+		Rollout: encodeRollouts(map[string]uint8{
+			"global_feature":      100,
+			"global:with:colons":  100,
+			"global_feature_zero": 0,
+		}),
+	}
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	if v := f.lookupGlobal([]byte("global_feature")); !v {
+		t.Errorf("expected global_feature to be true but got %v", v)
+	}
+	if v := f.lookupGlobal([]byte("global:with:colons")); !v {
+		t.Errorf("expected global:with:colons to be true but got %v", v)
+	}
+	if v := f.lookup([]byte("global:with:colons")); v {
+		t.Errorf("expected lookup of global:with:colons to only use its first segment but got %v", v)
+	}
+	if v := f.lookupGlobal([]byte("global_feature_zero")); v {
+		t.Errorf("expected global_feature_zero to be false but got %v", v)
+	}
+}
+
+func Test_from_Limits(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	if _, err := from(fr, &Option{MaxFilterBytes: len(fr.Filter), MaxRolloutEntries: len(fr.Rollout) / 8}); err != nil {
+		t.Fatalf("expected filter at the limits to decode but got %v", err)
+	}
+
+	f, err := from(fr, &Option{MaxFilterBytes: len(fr.Filter) - 1})
+	if err == nil {
+		t.Fatal("expected an error for a filter over the maximum size")
+	}
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); v {
+		t.Errorf("expected the oversized filter to be discarded but got %v", v)
+	}
+
+	f, err = from(fr, &Option{MaxRolloutEntries: len(fr.Rollout)/8 - 1})
+	if err == nil {
+		t.Fatal("expected an error for rollout data over the maximum number of entries")
+	}
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); v {
+		t.Errorf("expected the oversized rollout data to be discarded but got %v", v)
+	}
+}
+
+func Test_from_RolloutCollisions(t *testing.T) {
+	key := rolloutKey(hash([]byte("some_feature")))
+	fr := &FilterResponse{
+		Rollout: binary.LittleEndian.AppendUint64(nil, key|10),
+	}
+	fr.Rollout = binary.LittleEndian.AppendUint64(fr.Rollout, key|10)
+	fr.Rollout = binary.LittleEndian.AppendUint64(fr.Rollout, hash([]byte("other_feature")))
+
+	logger := &recordingLogger{}
+	if _, err := from(fr, &Option{Debug: true, Logger: logger}); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("expected duplicate entries not to be collisions but got %v", logger.messages)
+	}
+
+	fr.Rollout = binary.LittleEndian.AppendUint64(fr.Rollout, key|90)
+	if _, err := from(fr, &Option{Logger: logger}); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if len(logger.messages) != 0 {
+		t.Errorf("expected nothing to be logged without debug enabled but got %v", logger.messages)
+	}
+
+	if _, err := from(fr, &Option{Debug: true, Logger: logger}); err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	if len(logger.messages) != 1 || !strings.Contains(logger.messages[0], fmt.Sprintf("%#016x", key)) {
+		t.Errorf("expected a warning about the collision on %#016x but got %v", key, logger.messages)
+	}
+}
+
+func Test_filter_Killed(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	fr.Killed = binary.LittleEndian.AppendUint64(nil, hash([]byte("temper_api_e2e")))
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	// temper_api_e2e:user:1 is in the filter, but the feature is killed.
+	if v := f.lookupFilter([]byte("temper_api_e2e:user:1")); !v {
+		t.Fatalf("expected temper_api_e2e:user:1 to be in the filter but got %v", v)
+	}
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); v {
+		t.Errorf("expected killed temper_api_e2e:user:1 to be false but got %v", v)
+	}
+	if v := f.lookupGlobal([]byte("temper_api_e2e")); v {
+		t.Errorf("expected killed temper_api_e2e to be false but got %v", v)
+	}
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+}
+
+func Test_filter_Compact(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	f, err := from(fr)
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	compact, err := from(fr, &Option{CompactFilter: true})
+	if err != nil {
+		t.Fatalf("failed to create compact filter from response: %v", err)
+	}
+
+	if compact.buckets != nil {
+		t.Fatal("expected compact filter to not keep the full bucket array")
+	}
+	if len(compact.sparseBuckets) >= len(f.buckets) {
+		t.Errorf("expected compact filter to keep fewer than %d buckets but got %d", len(f.buckets), len(compact.sparseBuckets))
+	}
+
+	for i := range 100 {
+		for _, feature := range []string{"temper_api_e2e", "temper_api_e2e_rollout", "test"} {
+			key := []byte(fmt.Sprintf("%s:user:%d", feature, i))
+			if expected, actual := f.lookup(key), compact.lookup(key); expected != actual {
+				t.Errorf("expected compact lookup of %s to be %v but got %v", key, expected, actual)
+			}
+		}
+	}
+}
+
+func Test_filter_compactSize(t *testing.T) {
+	// A filter at a typical load has few empty buckets, so it's kept dense.
+	keys := make([][]byte, 0, 1000)
+	for i := range cap(keys) {
+		keys = append(keys, []byte(fmt.Sprintf("feature:user:%d", i)))
+	}
+	loaded := buildFilter(keys, nil)
+	dense := loaded.bucketBytes()
+	loaded.compact()
+	if loaded.buckets == nil {
+		t.Error("expected a loaded filter to stay dense")
+	}
+	if size := loaded.bucketBytes(); size > dense {
+		t.Errorf("expected compacting not to grow the filter from %d bytes but got %d", dense, size)
+	}
+
+	// A mostly empty filter is smaller when it's sparse.
+	sparse := buildFilter(keys[:10], nil)
+	dense = sparse.bucketBytes()
+	sparse.compact()
+	if sparse.buckets != nil {
+		t.Error("expected a mostly empty filter to be compacted")
+	}
+	if size := sparse.bucketBytes(); size >= dense {
+		t.Errorf("expected compacting to shrink the filter from %d bytes but got %d", dense, size)
+	}
+	for _, key := range keys[:10] {
+		if !sparse.lookupFilter(key) {
+			t.Errorf("expected %s to be in the compact filter", key)
+		}
+	}
+}
+
+func Test_filter_stats(t *testing.T) {
+	data := make([]byte, 4*bytesPerBucket)
+	// Fill the first bucket, and half of the second.
+	for i := range 6 {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(i+1))
+	}
+
+	f, err := from(&FilterResponse{Filter: data})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+
+	expected := FilterStats{Buckets: 4, Entries: 6, FullBuckets: 1}
+	if actual := f.stats(); actual != expected {
+		t.Errorf("expected stats %+v but got %+v", expected, actual)
+	}
+
+	compact, err := from(&FilterResponse{Filter: data}, &Option{CompactFilter: true})
+	if err != nil {
+		t.Fatalf("failed to create compact filter from response: %v", err)
+	}
+	if actual := compact.stats(); actual != expected {
+		t.Errorf("expected compact stats %+v but got %+v", expected, actual)
+	}
+
+	if actual := (&filter{}).stats(); actual != (FilterStats{}) {
+		t.Errorf("expected empty stats for an empty filter but got %+v", actual)
+	}
+}
+
+func Test_from_Entries(t *testing.T) {
+	f := buildFilter([][]byte{[]byte("a:user:1"), []byte("b:user:1"), []byte("c:user:1")}, nil)
+	data := make([]byte, 0, f.cap*bucketSize*2)
+	for _, b := range f.buckets {
+		for _, fp := range b {
+			data = binary.LittleEndian.AppendUint16(data, fp)
+		}
+	}
+
+	matching, mismatched := uint(3), uint(4)
+	for _, tt := range []struct {
+		name    string
+		entries *uint
+		wantErr bool
+	}{
+		{"absent", nil, false},
+		{"matching", &matching, false},
+		{"mismatched", &mismatched, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := from(&FilterResponse{Filter: data, Entries: tt.entries})
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("expected no error but got %v", err)
+				}
+				if v := got.lookup([]byte("b:user:1")); !v {
+					t.Errorf("expected b:user:1 to be true but got %v", v)
+				}
+				return
+			}
+
+			var de *DecodeError
+			if !errors.As(err, &de) || de.Segment != segmentFilter {
+				t.Fatalf("expected a DecodeError for the filter segment but got %v", err)
+			}
+		})
+	}
+}
+
+func Test_from_Combined(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	combined := binary.LittleEndian.AppendUint32(nil, uint32(len(fr.Filter)))
+	combined = append(combined, fr.Filter...)
+	combined = append(combined, fr.Rollout...)
+
+	// The separate fields are ignored when there's combined data.
+	f, err := from(&FilterResponse{Combined: combined, Filter: []byte{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("failed to create filter from combined data: %v", err)
+	}
+	if v := f.lookup([]byte("temper_api_e2e:user:1")); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	if v := f.lookup([]byte("temper_api_e2e_rollout:user:3")); !v {
+		t.Errorf("expected temper_api_e2e_rollout:user:3 to be true but got %v", v)
+	}
+
+	for _, data := range [][]byte{
+		{1, 0},
+		binary.LittleEndian.AppendUint32(nil, 16),
+	} {
+		if _, err := from(&FilterResponse{Combined: data}); err == nil {
+			t.Errorf("expected an error for combined data %v", data)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package temper
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// States of the backend reported by HealthHandler.
+const (
+	// backendUnknown is the state before the filter has been fetched from
+	// the backend.
+	backendUnknown = "unknown"
+
+	// backendOK is the state when the last fetch of the filter succeeded,
+	// and backendFailing is the state when it failed.
+	backendOK      = "ok"
+	backendFailing = "failing"
+)
+
+// HealthStatus is the health of a client, as served by HealthHandler.
+type HealthStatus struct {
+	// Healthy is true when the client is Healthy, and its filter is no
+	// older than the MaxFilterAge option.
+	Healthy bool `json:"healthy"`
+
+	// LastUpdated is when the filter was last fetched successfully, which
+	// is the zero time if it's never been fetched.
+	LastUpdated time.Time `json:"last_updated"`
+
+	// FilterEntries is the number of occupied entries in the filter.
+	FilterEntries int `json:"filter_entries"`
+
+	// BackendState is "ok" when the last fetch of the filter succeeded,
+	// "failing" when it failed, and "unknown" before the first fetch.
+	BackendState string `json:"backend_state"`
+
+	// ConsecutiveFailures is the number of fetches of the filter in a row
+	// that failed.
+	ConsecutiveFailures int64 `json:"consecutive_failures"`
+}
+
+// HealthHandler returns a handler for readiness probes, which responds with
+// 200 OK when the client is Healthy and its filter is no older than the
+// MaxFilterAge option, and 503 Service Unavailable otherwise. Either way, the
+// body is the client's HealthStatus as JSON.
+func HealthHandler() http.Handler {
+	return c.HealthHandler()
+}
+
+func (c *Client) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := c.health()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(&status)
+	})
+}
+
+// health returns the client's current HealthStatus.
+func (c *Client) health() HealthStatus {
+	status := HealthStatus{
+		Healthy:             c.Healthy() && !c.stale(),
+		LastUpdated:         c.LastUpdated(),
+		ConsecutiveFailures: c.fetchFailuresInRow.Load(),
+	}
+	if f := c.filter.Load(); f != nil {
+		status.FilterEntries = f.stats().Entries
+	}
+
+	switch {
+	case status.ConsecutiveFailures > 0:
+		status.BackendState = backendFailing
+	case c.fetchSuccesses.Load() > 0:
+		status.BackendState = backendOK
+	default:
+		status.BackendState = backendUnknown
+	}
+	return status
+}
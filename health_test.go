@@ -0,0 +1,66 @@
+package temper
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientHealthHandler(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(testFilterResp)
+	}))
+	defer srv.Close()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, MaxFilterAge: time.Hour, Logger: &recordingLogger{}})
+
+	probe := func(wantCode int) HealthStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		c.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != wantCode {
+			t.Errorf("expected status %d but got %d", wantCode, rec.Code)
+		}
+		var status HealthStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("failed to decode health status %s: %v", rec.Body.String(), err)
+		}
+		return status
+	}
+
+	if status := probe(http.StatusServiceUnavailable); status.BackendState != "unknown" || !status.LastUpdated.IsZero() {
+		t.Errorf("expected an unknown backend before the first fetch but got %+v", status)
+	}
+
+	if err := c.fetchFilter(context.Background()); err != nil {
+		t.Fatalf("failed to fetch filter: %v", err)
+	}
+	status := probe(http.StatusOK)
+	if !status.Healthy || status.BackendState != "ok" || status.FilterEntries != c.Stats().Entries || status.LastUpdated.IsZero() {
+		t.Errorf("expected a healthy status after a fetch but got %+v", status)
+	}
+
+	down.Store(true)
+	for range 2 {
+		c.fetchFilter(context.Background())
+	}
+	status = probe(http.StatusOK)
+	if status.BackendState != "failing" || status.ConsecutiveFailures != 2 {
+		t.Errorf("expected 2 consecutive failures with a fresh filter but got %+v", status)
+	}
+
+	c.updated.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if status := probe(http.StatusServiceUnavailable); status.Healthy {
+		t.Errorf("expected a stale filter to be unhealthy but got %+v", status)
+	}
+}
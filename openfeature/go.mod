@@ -0,0 +1,15 @@
+module github.com/bentranter/temper-go/openfeature
+
+go 1.22
+
+require (
+	github.com/bentranter/temper-go v0.0.6
+	github.com/open-feature/go-sdk v1.14.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+)
+
+replace github.com/bentranter/temper-go => ../
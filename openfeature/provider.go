@@ -0,0 +1,146 @@
+// Package openfeature provides an OpenFeature provider backed by the Temper
+// API client, so that teams using the OpenFeature Go SDK can evaluate Temper
+// features without rewriting their call sites.
+//
+// It's a separate module so that the core temper-go package stays free of
+// dependencies.
+package openfeature
+
+import (
+	"context"
+
+	of "github.com/open-feature/go-sdk/openfeature"
+
+	"github.com/bentranter/temper-go"
+)
+
+// ResourceKey is the evaluation context attribute that names the resource of
+// the targeting key, for example, "user". When it's set, features are checked
+// with the key `<feature>:<resource>:<targeting key>`, and otherwise with the
+// key `<feature>:<targeting key>`, so the targeting key may contain both the
+// resource and actor ID, for example, "user:1".
+const ResourceKey = "resource"
+
+// Provider is an OpenFeature provider backed by the Temper API client. Only
+// boolean flags are supported.
+type Provider struct {
+	check func(feature string) bool
+	known func(feature string) bool
+}
+
+// NewProvider returns an OpenFeature provider that checks features with
+// temper.Check. The Temper API client must be initialized with temper.Init
+// before flags are evaluated.
+func NewProvider() *Provider {
+	return &Provider{check: temper.Check, known: temper.FeatureKnown}
+}
+
+// Metadata returns the name of the provider.
+func (p *Provider) Metadata() of.Metadata {
+	return of.Metadata{Name: "temper"}
+}
+
+// Hooks returns the provider's hooks, of which there are none.
+func (p *Provider) Hooks() []of.Hook {
+	return nil
+}
+
+// BooleanEvaluation checks the flag for the targeting key in the evaluation
+// context. Without a targeting key, the flag is checked on its own. When the
+// filter has no data for the key, as reported by temper.FeatureKnown, the
+// default value is returned with the default reason instead.
+func (p *Provider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx of.FlattenedContext) of.BoolResolutionDetail {
+	key, targeted, err := featureKey(flag, evalCtx)
+	if err != nil {
+		return of.BoolResolutionDetail{
+			Value: defaultValue,
+			ProviderResolutionDetail: of.ProviderResolutionDetail{
+				ResolutionError: *err,
+				Reason:          of.ErrorReason,
+			},
+		}
+	}
+
+	if !p.known(key) {
+		return of.BoolResolutionDetail{
+			Value: defaultValue,
+			ProviderResolutionDetail: of.ProviderResolutionDetail{
+				Reason: of.DefaultReason,
+			},
+		}
+	}
+
+	reason := of.StaticReason
+	if targeted {
+		reason = of.TargetingMatchReason
+	}
+
+	return of.BoolResolutionDetail{
+		Value: p.check(key),
+		ProviderResolutionDetail: of.ProviderResolutionDetail{
+			Reason: reason,
+		},
+	}
+}
+
+// StringEvaluation isn't supported, and always returns the default value.
+func (p *Provider) StringEvaluation(ctx context.Context, flag string, defaultValue string, evalCtx of.FlattenedContext) of.StringResolutionDetail {
+	return of.StringResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: typeMismatch("string"),
+	}
+}
+
+// FloatEvaluation isn't supported, and always returns the default value.
+func (p *Provider) FloatEvaluation(ctx context.Context, flag string, defaultValue float64, evalCtx of.FlattenedContext) of.FloatResolutionDetail {
+	return of.FloatResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: typeMismatch("float"),
+	}
+}
+
+// IntEvaluation isn't supported, and always returns the default value.
+func (p *Provider) IntEvaluation(ctx context.Context, flag string, defaultValue int64, evalCtx of.FlattenedContext) of.IntResolutionDetail {
+	return of.IntResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: typeMismatch("int"),
+	}
+}
+
+// ObjectEvaluation isn't supported, and always returns the default value.
+func (p *Provider) ObjectEvaluation(ctx context.Context, flag string, defaultValue any, evalCtx of.FlattenedContext) of.InterfaceResolutionDetail {
+	return of.InterfaceResolutionDetail{
+		Value:                    defaultValue,
+		ProviderResolutionDetail: typeMismatch("object"),
+	}
+}
+
+// featureKey maps a flag and an evaluation context into the Temper key
+// convention, `<feature>:<resource>:<actor id>`, and reports whether the key
+// targets an actor.
+func featureKey(flag string, evalCtx of.FlattenedContext) (string, bool, *of.ResolutionError) {
+	targetingKey, _ := evalCtx[of.TargetingKey].(string)
+	if targetingKey == "" {
+		return flag, false, nil
+	}
+
+	resource, ok := evalCtx[ResourceKey]
+	if !ok {
+		return flag + ":" + targetingKey, true, nil
+	}
+
+	name, ok := resource.(string)
+	if !ok || name == "" {
+		err := of.NewInvalidContextResolutionError("temper: the resource attribute must be a non-empty string")
+		return "", false, &err
+	}
+	return flag + ":" + name + ":" + targetingKey, true, nil
+}
+
+// typeMismatch returns the resolution detail for unsupported flag types.
+func typeMismatch(kind string) of.ProviderResolutionDetail {
+	return of.ProviderResolutionDetail{
+		ResolutionError: of.NewTypeMismatchResolutionError("temper: " + kind + " flags aren't supported, only boolean flags are"),
+		Reason:          of.ErrorReason,
+	}
+}
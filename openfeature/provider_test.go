@@ -0,0 +1,96 @@
+package openfeature
+
+import (
+	"context"
+	"testing"
+
+	of "github.com/open-feature/go-sdk/openfeature"
+)
+
+// Provider must implement the OpenFeature provider interface.
+var _ of.FeatureProvider = (*Provider)(nil)
+
+func TestProviderBooleanEvaluation(t *testing.T) {
+	var checked []string
+	p := &Provider{
+		check: func(feature string) bool {
+			checked = append(checked, feature)
+			return feature == "beta:user:1"
+		},
+		known: func(feature string) bool { return true },
+	}
+
+	tests := []struct {
+		name    string
+		evalCtx of.FlattenedContext
+		key     string
+		value   bool
+		reason  of.Reason
+	}{
+		{"no targeting key", of.FlattenedContext{}, "beta", false, of.StaticReason},
+		{"targeting key", of.FlattenedContext{of.TargetingKey: "user:1"}, "beta:user:1", true, of.TargetingMatchReason},
+		{"targeting key and resource", of.FlattenedContext{of.TargetingKey: "1", ResourceKey: "user"}, "beta:user:1", true, of.TargetingMatchReason},
+		{"other actor", of.FlattenedContext{of.TargetingKey: "2", ResourceKey: "user"}, "beta:user:2", false, of.TargetingMatchReason},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked = nil
+			detail := p.BooleanEvaluation(context.Background(), "beta", !tt.value, tt.evalCtx)
+			if len(checked) != 1 || checked[0] != tt.key {
+				t.Errorf("expected %s to be checked but got %v", tt.key, checked)
+			}
+			if detail.Value != tt.value {
+				t.Errorf("expected %v but got %v", tt.value, detail.Value)
+			}
+			if detail.Reason != tt.reason {
+				t.Errorf("expected reason %s but got %s", tt.reason, detail.Reason)
+			}
+		})
+	}
+}
+
+func TestProviderBooleanEvaluation_unknown(t *testing.T) {
+	p := &Provider{
+		check: func(feature string) bool {
+			t.Fatalf("expected no feature to be checked but got %s", feature)
+			return false
+		},
+		known: func(feature string) bool { return false },
+	}
+
+	for _, def := range []bool{true, false} {
+		detail := p.BooleanEvaluation(context.Background(), "beta", def, of.FlattenedContext{of.TargetingKey: "user:1"})
+		if detail.Value != def {
+			t.Errorf("expected the default value %v but got %v", def, detail.Value)
+		}
+		if detail.Reason != of.DefaultReason {
+			t.Errorf("expected reason %s but got %s", of.DefaultReason, detail.Reason)
+		}
+	}
+}
+
+func TestProviderBooleanEvaluation_invalidResource(t *testing.T) {
+	p := &Provider{check: func(feature string) bool {
+		t.Fatalf("expected no feature to be checked but got %s", feature)
+		return false
+	}}
+
+	detail := p.BooleanEvaluation(context.Background(), "beta", true, of.FlattenedContext{of.TargetingKey: "1", ResourceKey: 1})
+	if !detail.Value {
+		t.Errorf("expected the default value but got %v", detail.Value)
+	}
+	if detail.Reason != of.ErrorReason {
+		t.Errorf("expected reason %s but got %s", of.ErrorReason, detail.Reason)
+	}
+}
+
+func TestProviderStringEvaluation(t *testing.T) {
+	detail := NewProvider().StringEvaluation(context.Background(), "beta", "default", of.FlattenedContext{})
+	if detail.Value != "default" {
+		t.Errorf("expected the default value but got %s", detail.Value)
+	}
+	if detail.Reason != of.ErrorReason {
+		t.Errorf("expected reason %s but got %s", of.ErrorReason, detail.Reason)
+	}
+}
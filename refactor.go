@@ -1,9 +1,23 @@
 package temper
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/cmplx"
+	"math/rand/v2"
+	"os"
 	"reflect"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +34,10 @@ type refactorResultParameters struct {
 	Args     []*refactorParameter `json:"args"`
 	OldType  string               `json:"old_type"`
 	Old      []*refactorParameter `json:"old"`
+	OldErr   string               `json:"old_err,omitempty"`
 	NewType  string               `json:"new_type"`
 	New      []*refactorParameter `json:"new"`
+	NewErr   string               `json:"new_err,omitempty"`
 }
 
 // addRefactorResultRequest is the data type for submitting Refactor results
@@ -31,15 +47,41 @@ type addRefactorResultRequest struct {
 	OldAverageDuration time.Duration               `json:"old_average_duration"`
 	NewAverageDuration time.Duration               `json:"new_average_duration"`
 	ResultParameters   []*refactorResultParameters `json:"results"`
+
+	// IdempotencyKey identifies this result, so that the backend can dedupe
+	// retried submissions of it. It's sent in the idempotencyKeyHeader
+	// header rather than in the body.
+	IdempotencyKey string `json:"-"`
+}
+
+// idempotencyKeyHeader is the header used to send the idempotency key of a
+// refactor result to the Temper API.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// A newResult is the result of the `New` function, sent from the goroutine it
+// runs in.
+type newResult[Ret any] struct {
+	ret Ret
+	err error
+	dur time.Duration
 }
 
 // A result is the result of a Refactor call.
 type result[Args, Ret any] struct {
+	at     time.Time // when the run started.
 	args   Args
 	old    Ret
 	new    Ret
 	olddur time.Duration
 	newdur time.Duration
+
+	// oldErr and newErr are the errors returned by OldErr and NewErr, when
+	// the refactor was run with RefactorErr.
+	oldErr error
+	newErr error
+
+	// matched is true if the results were compared and matched.
+	matched bool
 }
 
 type RefactorArgs[Args, Ret any] struct {
@@ -48,18 +90,365 @@ type RefactorArgs[Args, Ret any] struct {
 	Old func(args Args) Ret
 	New func(args Args) Ret
 
+	// OldErr and NewErr are the old and new functions run by RefactorErr,
+	// for functions that return an error. Their errors are compared along
+	// with their results.
 	OldErr func(args Args) (Ret, error)
 	NewErr func(args Args) (Ret, error)
 
-	result *result[Args, Ret]
+	// FloatTolerance, if greater than 0, is how far apart floats in the
+	// results can be while still matching, which allows for the rounding
+	// differences from reordering floating point operations. Every other
+	// type is still compared exactly.
+	FloatTolerance float64
+
+	// NewTimeout, if greater than 0, is how long a run waits for the new
+	// function, counted from when the run started. A run that times out
+	// returns the result of the old function, and is recorded as a mismatch
+	// with a "timeout" error from the new function, which is left to finish
+	// in the background, and still counts against MaxConcurrency until it
+	// does.
+	NewTimeout time.Duration
+
+	// SampleRate, if between 0 and 1, is the fraction of runs that run the
+	// new function and compare it with the old one, while the rest only run
+	// the old function. Like the other limits, it's unlimited when it's 0,
+	// so every run is compared, and every run is compared when it's 1 or
+	// more too. A negative or NaN rate is invalid, and is logged the first
+	// time it's used, and treated as 0.
+	SampleRate float64
+
+	// CompareFeature, if set, is a feature that's checked before each run,
+	// and only when it's enabled is the new function run and compared with
+	// the old one. It's a remote kill switch for the cost of the comparison.
+	CompareFeature string
+
+	// Output, if set, receives every completed comparison as a single line
+	// of JSON, independent of what's sent to the Temper backend. Writes to
+	// Output are serialized across all refactors.
+	Output io.Writer
+
+	// ShadowOnly, if true, runs both functions and records how long they
+	// took, but never compares, outputs, or reports their results. It's the
+	// cheapest way to exercise the new function, for example, to warm its
+	// caches, when its correctness doesn't matter yet.
+	ShadowOnly bool
+
+	// MismatchHistory is how many of the most recent mismatches are kept
+	// for RecentMismatches. None are kept when it's 0.
+	MismatchHistory int
+
+	// AlwaysSubmit, if true, submits the result of every run to the
+	// backend, rather than only the runs whose results didn't match.
+	AlwaysSubmit bool
+
+	// MaxConcurrency, if greater than 0, is how many runs of this refactor
+	// can run the new function at once. Runs over the limit only run the old
+	// function, so an expensive comparison can be bounded without affecting
+	// other refactors.
+	MaxConcurrency int
+
+	// running is the number of runs currently running the new function.
+	running atomic.Int64
+
+	// result is the result of the most recent run.
+	result atomic.Pointer[result[Args, Ret]]
+
+	// stats are the accumulated stats of every run, guarded by statsMu.
+	statsMu sync.Mutex
+	stats   RefactorStats
+
+	// registered is true once the refactor has been added to refactors.
+	registered atomic.Bool
+
+	// invalidSampleRate logs an invalid SampleRate the first time it's used.
+	invalidSampleRate sync.Once
+
+	// mismatches is a ring buffer of the most recent mismatches, where
+	// mismatchNext is the index the next one is written to, both guarded by
+	// mismatchMu.
+	mismatchMu   sync.Mutex
+	mismatches   []Mismatch
+	mismatchNext int
+}
+
+// A Mismatch is a run of a refactor where the results of the old and new
+// functions didn't match.
+type Mismatch struct {
+	At          time.Time     `json:"at"`
+	Args        any           `json:"args"`
+	Old         any           `json:"old"`
+	New         any           `json:"new"`
+	OldErr      string        `json:"old_err,omitempty"`
+	NewErr      string        `json:"new_err,omitempty"`
+	OldDuration time.Duration `json:"old_duration"`
+	NewDuration time.Duration `json:"new_duration"`
+}
+
+// RefactorStats are the accumulated stats of the runs of a refactor.
+type RefactorStats struct {
+	// Runs is the number of times both functions were run and compared,
+	// and Matches and Mismatches are how many of those runs had results
+	// that matched and didn't match.
+	Runs       int64 `json:"runs"`
+	Matches    int64 `json:"matches"`
+	Mismatches int64 `json:"mismatches"`
+
+	// Shadowed is the number of times both functions were run without
+	// being compared, because the refactor is ShadowOnly.
+	Shadowed int64 `json:"shadowed"`
+
+	// OldAverageDuration and NewAverageDuration are exponential moving
+	// averages of how long each function took, weighted by statsAlpha.
+	OldAverageDuration time.Duration `json:"old_average_duration"`
+	NewAverageDuration time.Duration `json:"new_average_duration"`
+}
+
+// refactors maps the name of every refactor that has run to a func that
+// returns its stats, which are published by the Expvar option.
+var refactors sync.Map
+
+// refactorStats returns the stats of every refactor that has run, keyed by
+// name.
+func refactorStats() map[string]RefactorStats {
+	stats := make(map[string]RefactorStats)
+	refactors.Range(func(name, fn any) bool {
+		stats[name.(string)] = fn.(func() RefactorStats)()
+		return true
+	})
+	return stats
+}
+
+// statsAlpha is the weight of the latest run in the moving averages of the
+// refactor stats.
+const statsAlpha = 0.1
+
+// record adds the given result to the stats.
+func (s *RefactorStats) record(matched bool, olddur, newdur time.Duration) {
+	s.recordDurations(olddur, newdur)
+
+	s.Runs++
+	if matched {
+		s.Matches++
+	} else {
+		s.Mismatches++
+	}
+}
+
+// recordShadow adds the durations of a run that wasn't compared to the
+// stats.
+func (s *RefactorStats) recordShadow(olddur, newdur time.Duration) {
+	s.recordDurations(olddur, newdur)
+	s.Shadowed++
+}
+
+// recordDurations adds the given durations to the moving averages.
+func (s *RefactorStats) recordDurations(olddur, newdur time.Duration) {
+	if s.Runs == 0 && s.Shadowed == 0 {
+		s.OldAverageDuration = olddur
+		s.NewAverageDuration = newdur
+		return
+	}
+	s.OldAverageDuration += time.Duration(statsAlpha * float64(olddur-s.OldAverageDuration))
+	s.NewAverageDuration += time.Duration(statsAlpha * float64(newdur-s.NewAverageDuration))
+}
+
+// Stats returns the accumulated stats of every run of the refactor.
+func (r *RefactorArgs[Args, Ret]) Stats() RefactorStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+// RecentMismatches returns copies of the most recent mismatches, up to the
+// MismatchHistory of the refactor, from the oldest to the newest.
+func (r *RefactorArgs[Args, Ret]) RecentMismatches() []Mismatch {
+	r.mismatchMu.Lock()
+	defer r.mismatchMu.Unlock()
+
+	mismatches := make([]Mismatch, 0, len(r.mismatches))
+	if len(r.mismatches) == r.MismatchHistory {
+		mismatches = append(mismatches, r.mismatches[r.mismatchNext:]...)
+		return append(mismatches, r.mismatches[:r.mismatchNext]...)
+	}
+	return append(mismatches, r.mismatches...)
+}
+
+// recordMismatch adds the given result to the recent mismatches, replacing
+// the oldest one once there are MismatchHistory of them.
+func (r *RefactorArgs[Args, Ret]) recordMismatch(res *result[Args, Ret]) {
+	if r.MismatchHistory <= 0 {
+		return
+	}
+
+	m := res.mismatch()
+
+	r.mismatchMu.Lock()
+	defer r.mismatchMu.Unlock()
+
+	if len(r.mismatches) < r.MismatchHistory {
+		r.mismatches = append(r.mismatches, m)
+		return
+	}
+	r.mismatches[r.mismatchNext] = m
+	r.mismatchNext = (r.mismatchNext + 1) % r.MismatchHistory
+}
+
+// ExportStats returns the accumulated stats of the refactor encoded as JSON,
+// so that they can be persisted and restored with ImportStats after a
+// restart, rather than starting from nothing on every deploy.
+func (r *RefactorArgs[Args, Ret]) ExportStats() []byte {
+	stats := r.Stats()
+
+	// Encoding a struct of numbers can't fail.
+	data, _ := json.Marshal(&stats)
+	return data
+}
+
+// ImportStats restores stats exported by ExportStats, replacing the stats
+// accumulated so far.
+func (r *RefactorArgs[Args, Ret]) ImportStats(data []byte) error {
+	var stats RefactorStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return fmt.Errorf("failed to import stats for refactor %s: %w", r.Name, err)
+	}
+	if stats.Runs < 0 || stats.Matches < 0 || stats.Mismatches < 0 || stats.Shadowed < 0 || stats.Matches+stats.Mismatches != stats.Runs {
+		return fmt.Errorf("failed to import stats for refactor %s: inconsistent counts", r.Name)
+	}
+
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats = stats
+	return nil
 }
 
-// TODO I need to copy below with the error returning variation, so something
-// like `RunErr`.
+// outputMu serializes writes to each RefactorArgs's Output, so that the
+// results of concurrent refactors don't interleave.
+var outputMu sync.Mutex
+
+// refactorLabel is the profiler label set to the name of the refactor while
+// its `New` function runs from RefactorCtx.
+const refactorLabel = "temper_refactor"
 
 // Run executes both the old and new functions defined in the refactor, and
 // returns the results of the `Old` function.
+//
+// The `New` function runs in a goroutine started from the calling goroutine,
+// so it inherits any profiler labels set on it by `pprof.Do`.
 func (r *RefactorArgs[Args, Ret]) run(args Args) Ret {
+	return r.runOn(c, args)
+}
+
+// runOn is like run, but checks CompareFeature with the given client.
+func (r *RefactorArgs[Args, Ret]) runOn(client *Client, args Args) Ret {
+	if !r.compare(client) || !r.acquire() {
+		return r.Old(args)
+	}
+	// The slot is released by the goroutine running New, rather than when
+	// the run returns, so that runs that time out waiting for New still
+	// count against MaxConcurrency until it returns.
+	res := r.execute(args, false, func(fn func()) {
+		go fn()
+	}, r.release)
+	r.report(client, res)
+	return res.old
+}
+
+// runCtx is like run, but runs the `New` function with the profiler labels
+// from ctx, along with a label for the name of the refactor.
+func (r *RefactorArgs[Args, Ret]) runCtx(ctx context.Context, args Args) Ret {
+	if !r.compare(c) || !r.acquire() {
+		return r.Old(args)
+	}
+	res := r.execute(args, false, func(fn func()) {
+		go pprof.Do(ctx, pprof.Labels(refactorLabel, r.Name), func(context.Context) {
+			fn()
+		})
+	}, r.release)
+	r.report(c, res)
+	return res.old
+}
+
+// report calls the given client's OnRefactor option with a compared result,
+// and queues it for submission to the backend when it's a mismatch, or when
+// AlwaysSubmit or the SubmitRefactorMatches option is set. Results are only
+// submitted while the client is polling, and failed submissions are logged
+// rather than affecting the run.
+func (r *RefactorArgs[Args, Ret]) report(client *Client, res *result[Args, Ret]) {
+	if r.ShadowOnly || client == nil {
+		return
+	}
+	if client.opt.OnRefactor != nil {
+		client.callback("OnRefactor", func() {
+			client.opt.OnRefactor(r.Name, res.matched, res.olddur, res.newdur)
+		})
+	}
+
+	if client.devMode || (res.matched && !r.AlwaysSubmit && !client.opt.SubmitRefactorMatches) {
+		return
+	}
+	client.queueRefactorResult(r.request(res))
+}
+
+// runErr is like run, but runs the `OldErr` and `NewErr` functions, and
+// returns the result and error of `OldErr`.
+func (r *RefactorArgs[Args, Ret]) runErr(args Args) (Ret, error) {
+	if !r.compare(c) || !r.acquire() {
+		return r.OldErr(args)
+	}
+	res := r.execute(args, true, func(fn func()) {
+		go fn()
+	}, r.release)
+	r.report(c, res)
+	return res.old, res.oldErr
+}
+
+// compare returns true if the new function should be run and compared with
+// the old one, which is always, unless the run isn't sampled by SampleRate,
+// or CompareFeature is set and disabled in the given client.
+func (r *RefactorArgs[Args, Ret]) compare(client *Client) bool {
+	if rate := r.SampleRate; rate < 0 || math.IsNaN(rate) {
+		r.invalidSampleRate.Do(func() {
+			log.Printf("[temper] sample rate %v of refactor %s isn't between 0 and 1, so every run is compared\n", rate, r.Name)
+		})
+	} else if rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return false
+	}
+	return r.CompareFeature == "" || client.Check(r.CompareFeature)
+}
+
+// acquire reserves one of the MaxConcurrency slots for a run of the new
+// function, returning false if they're all in use.
+func (r *RefactorArgs[Args, Ret]) acquire() bool {
+	if r.MaxConcurrency <= 0 {
+		return true
+	}
+	if r.running.Add(1) > int64(r.MaxConcurrency) {
+		r.running.Add(-1)
+		return false
+	}
+	return true
+}
+
+// release frees the slot reserved by acquire.
+func (r *RefactorArgs[Args, Ret]) release() {
+	if r.MaxConcurrency > 0 {
+		r.running.Add(-1)
+	}
+}
+
+// runWith executes both the old and new functions defined in the refactor,
+// using spawn to start the goroutine for the `New` function, and returns the
+// result.
+func (r *RefactorArgs[Args, Ret]) runWith(args Args, spawn func(fn func())) *result[Args, Ret] {
+	return r.execute(args, false, spawn, nil)
+}
+
+// execute is like runWith, but runs `OldErr` and `NewErr` instead when
+// withErr is true. If release isn't nil, it's called from the goroutine of
+// the `New` function as soon as it returns, even if the run has already
+// stopped waiting for it.
+func (r *RefactorArgs[Args, Ret]) execute(args Args, withErr bool, spawn func(fn func()), release func()) *result[Args, Ret] {
 	start := time.Now()
 
 	// TODO
@@ -77,74 +466,612 @@ func (r *RefactorArgs[Args, Ret]) run(args Args) Ret {
 	// one is the function argument and the other is the result type.
 
 	// Initialize the result struct.
-	r.result = &result[Args, Ret]{
+	res := &result[Args, Ret]{
+		at:   start,
 		args: args,
 	}
+	r.result.Store(res)
 
-	// Run the `New` func in its own goroutine.
-	ch := make(chan Ret)
-	go func() {
-		ret := r.New(args)
-		r.result.newdur = time.Since(start)
-		ch <- ret
-	}()
+	// Run the `New` func in its own goroutine. The channel is buffered so
+	// that the goroutine can still finish after a timeout.
+	ch := make(chan newResult[Ret], 1)
+	spawn(func() {
+		var nr newResult[Ret]
+		if withErr {
+			nr.ret, nr.err = r.NewErr(args)
+		} else {
+			nr.ret = r.New(args)
+		}
+		nr.dur = time.Since(start)
+		if release != nil {
+			release()
+		}
+		ch <- nr
+	})
 
-	r.result.old = r.Old(args)
-	r.result.olddur = time.Since(start)
+	if withErr {
+		res.old, res.oldErr = r.OldErr(args)
+	} else {
+		res.old = r.Old(args)
+	}
+	res.olddur = time.Since(start)
+
+	// Block until we receive a result from the `New` goroutine, or until
+	// NewTimeout passes.
+	if nr, ok := r.wait(ch, start); ok {
+		res.new, res.newErr, res.newdur = nr.ret, nr.err, nr.dur
+	} else {
+		res.newErr = fmt.Errorf("timeout after %s", r.NewTimeout)
+		res.newdur = r.NewTimeout
+	}
+
+	if !r.registered.Swap(true) {
+		refactors.Store(r.Name, r.Stats)
+	}
+
+	if r.ShadowOnly {
+		r.statsMu.Lock()
+		r.stats.recordShadow(res.olddur, res.newdur)
+		r.statsMu.Unlock()
+		return res
+	}
 
-	// Block until we receive a result from the `New` goroutine.
-	r.result.new = <-ch
+	res.matched = res.matches(r.FloatTolerance)
+	r.statsMu.Lock()
+	r.stats.record(res.matched, res.olddur, res.newdur)
+	r.statsMu.Unlock()
 
-	// Return the old result to preserve the previous behaviour that the
-	// caller is expecting/using this for in the first place.
-	return r.result.old
+	if !res.matched {
+		r.recordMismatch(res)
+	}
+
+	if r.Output != nil {
+		r.writeOutput(res)
+	}
+
+	return res
+}
+
+// wait returns the result of the `New` function from ch, or false if it isn't
+// received within NewTimeout of start. A result that's already been received
+// is returned even if the timeout has passed.
+func (r *RefactorArgs[Args, Ret]) wait(ch <-chan newResult[Ret], start time.Time) (newResult[Ret], bool) {
+	if r.NewTimeout <= 0 {
+		return <-ch, true
+	}
+
+	select {
+	case nr := <-ch:
+		return nr, true
+	default:
+	}
+
+	t := time.NewTimer(r.NewTimeout - time.Since(start))
+	defer t.Stop()
+	select {
+	case nr := <-ch:
+		return nr, true
+	case <-t.C:
+		return newResult[Ret]{}, false
+	}
+}
+
+// TestingT is the subset of testing.TB used by AssertMatch and AssertGolden,
+// so that the package doesn't have to import testing, which would register
+// its flags in every program that uses it.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// AssertMatch runs both the old and new functions with the given arguments,
+// and fails the test with a description of the differences if their results
+// don't match. It turns a refactor into a differential test that can be run
+// over many inputs before the refactor is ever deployed.
+func (r *RefactorArgs[Args, Ret]) AssertMatch(t TestingT, args Args) {
+	t.Helper()
+
+	res := r.runWith(args, func(fn func()) {
+		go fn()
+	})
+	if !res.matches(r.FloatTolerance) {
+		t.Errorf("refactor %s results don't match for args %+v:\n%s", r.Name, args, res.diff())
+	}
+}
+
+// An AggregateResult is the result of running a refactor over many inputs
+// with RunAll.
+type AggregateResult struct {
+	// Runs is the number of inputs that were run, and Matches is how many
+	// of them had results that matched.
+	Runs    int
+	Matches int
+
+	// Mismatches are the runs whose results didn't match, in the order of
+	// their inputs.
+	Mismatches []Mismatch
+}
+
+// Passed returns true if the results of every run matched.
+func (ar *AggregateResult) Passed() bool {
+	return len(ar.Mismatches) == 0
+}
+
+// RunAll runs both the old and new functions with each of the given inputs,
+// one input at a time, and returns how many of their results matched, along
+// with every mismatch. It's meant for validating a refactor against a corpus
+// of recorded inputs before it's deployed, so CompareFeature is ignored, and
+// the results are compared even when the refactor is ShadowOnly.
+func (r *RefactorArgs[Args, Ret]) RunAll(inputs []Args) AggregateResult {
+	ar := AggregateResult{Runs: len(inputs)}
+	for _, args := range inputs {
+		res := r.runWith(args, func(fn func()) {
+			go fn()
+		})
+		if res.matches(r.FloatTolerance) {
+			ar.Matches++
+			continue
+		}
+		ar.Mismatches = append(ar.Mismatches, res.mismatch())
+	}
+	return ar
+}
+
+// A goldenRecord is a single known-good call recorded in a golden file.
+type goldenRecord[Args, Ret any] struct {
+	Args     Args `json:"args"`
+	Expected Ret  `json:"expected"`
+}
+
+// RecordGolden runs the old function with each of the given arguments, and
+// writes the results to w as golden records, one line of JSON per call, for
+// use with AssertGolden.
+func (r *RefactorArgs[Args, Ret]) RecordGolden(w io.Writer, args ...Args) error {
+	enc := json.NewEncoder(w)
+	for _, a := range args {
+		if err := enc.Encode(&goldenRecord[Args, Ret]{Args: a, Expected: r.Old(a)}); err != nil {
+			return fmt.Errorf("failed to write golden record for refactor %s: %w", r.Name, err)
+		}
+	}
+	return nil
+}
+
+// AssertGolden runs only the new function against every record in the golden
+// file at path, as written by RecordGolden, and fails the test with a
+// description of the differences for every result that doesn't match the
+// recorded one. In the description, the recorded result is reported as old.
+// It guards the new function against regressions once the old function has
+// been deleted.
+func (r *RefactorArgs[Args, Ret]) AssertGolden(t TestingT, path string) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open golden file for refactor %s: %v", r.Name, err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for n := 1; ; n++ {
+		var rec goldenRecord[Args, Ret]
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to decode golden record %d for refactor %s: %v", n, r.Name, err)
+		}
+
+		res := &result[Args, Ret]{
+			args: rec.Args,
+			old:  rec.Expected,
+			new:  r.New(rec.Args),
+		}
+		if !res.matches(r.FloatTolerance) {
+			t.Errorf("refactor %s result doesn't match golden record %d for args %+v:\n%s", r.Name, n, rec.Args, res.diff())
+		}
+	}
+}
+
+// mismatch returns the result as a Mismatch.
+func (res *result[Args, Ret]) mismatch() Mismatch {
+	return Mismatch{
+		At:          res.at,
+		Args:        res.args,
+		Old:         res.old,
+		New:         res.new,
+		OldErr:      errString(res.oldErr),
+		NewErr:      errString(res.newErr),
+		OldDuration: res.olddur,
+		NewDuration: res.newdur,
+	}
+}
+
+// matches returns true if the results of the old and new functions are equal,
+// with floats compared within the given tolerance. Errors match when their
+// messages are equal, and when both functions returned an error, their
+// results aren't compared.
+func (res *result[Args, Ret]) matches(tolerance float64) bool {
+	if errString(res.oldErr) != errString(res.newErr) {
+		return false
+	}
+	if res.oldErr != nil {
+		return true
+	}
+	if tolerance <= 0 {
+		return reflect.DeepEqual(res.old, res.new) || paramsMatch(res.old, res.new)
+	}
+	return equalWithin(reflect.ValueOf(res.old), reflect.ValueOf(res.new), tolerance, make(map[[2]uintptr]bool))
+}
+
+// paramsMatch returns true if results that reflect.DeepEqual considers
+// unequal because they contain funcs, which are never equal unless they're
+// nil, have the same values extracted by extractParam.
+func paramsMatch(a, b any) bool {
+	rt := reflect.TypeOf(a)
+	if rt == nil || rt != reflect.TypeOf(b) || !containsFunc(rt, make(map[reflect.Type]bool)) {
+		return false
+	}
+	if rt.Kind() == reflect.Pointer {
+		rt = rt.Elem()
+	}
+	switch rt.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+	default:
+		return false
+	}
+
+	_, aParams := extractParam(a)
+	_, bParams := extractParam(b)
+	if aParams == nil || bParams == nil {
+		return false
+	}
+	return slices.EqualFunc(aParams, bParams, func(a, b *refactorParameter) bool {
+		return *a == *b
+	})
+}
+
+// containsFunc returns true if values of the type can contain a func.
+func containsFunc(rt reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[rt] {
+		return false
+	}
+	visited[rt] = true
+
+	switch rt.Kind() {
+	case reflect.Func:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return containsFunc(rt.Elem(), visited)
+	case reflect.Map:
+		return containsFunc(rt.Key(), visited) || containsFunc(rt.Elem(), visited)
+	case reflect.Struct:
+		for i := range rt.NumField() {
+			if containsFunc(rt.Field(i).Type, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// errString returns the message of err, or an empty string if it's nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// equalWithin is like reflect.DeepEqual, except that floats are equal when
+// they're equal or within the given tolerance of each other. The pairs of pointers
+// already being compared are tracked in visited, so that cyclic values are
+// compared without looping forever.
+func equalWithin(a, b reflect.Value, tolerance float64, visited map[[2]uintptr]bool) bool {
+	if !a.IsValid() || !b.IsValid() {
+		return a.IsValid() == b.IsValid()
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a.Kind() {
+	case reflect.Float32, reflect.Float64:
+		// Equal infinities are compared directly, since their difference
+		// is NaN.
+		return a.Float() == b.Float() || math.Abs(a.Float()-b.Float()) <= tolerance
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex() || cmplx.Abs(a.Complex()-b.Complex()) <= tolerance
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Pointer() == b.Pointer() {
+			return true
+		}
+		key := [2]uintptr{a.Pointer(), b.Pointer()}
+		if visited[key] {
+			return true
+		}
+		visited[key] = true
+		return equalWithin(a.Elem(), b.Elem(), tolerance, visited)
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return equalWithin(a.Elem(), b.Elem(), tolerance, visited)
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !equalWithin(a.Field(i), b.Field(i), tolerance, visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice:
+		if a.IsNil() != b.IsNil() {
+			return false
+		}
+		fallthrough
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !equalWithin(a.Index(i), b.Index(i), tolerance, visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			bv := b.MapIndex(iter.Key())
+			if !bv.IsValid() || !equalWithin(iter.Value(), bv, tolerance, visited) {
+				return false
+			}
+		}
+		return true
+	case reflect.Func:
+		// Like reflect.DeepEqual, funcs are only equal when they're both
+		// nil.
+		return a.IsNil() && b.IsNil()
+	default:
+		// Channels and unsafe pointers are equal when they're the same.
+		return a.Pointer() == b.Pointer()
+	}
+}
+
+// diff returns a description of how the results of the old and new functions
+// differ, field by field when the results are structs.
+func (res *result[Args, Ret]) diff() string {
+	if oldErr, newErr := errString(res.oldErr), errString(res.newErr); oldErr != newErr {
+		return fmt.Sprintf("  error: old %q, new %q", oldErr, newErr)
+	}
+
+	_, oldParams := extractParam(res.old)
+	_, newParams := extractParam(res.new)
+	if oldParams == nil || newParams == nil {
+		return fmt.Sprintf("  old: %#v\n  new: %#v", res.old, res.new)
+	}
+
+	newByName := make(map[string]*refactorParameter, len(newParams))
+	for _, p := range newParams {
+		newByName[p.Name] = p
+	}
+
+	var b strings.Builder
+	for _, op := range oldParams {
+		np, ok := newByName[op.Name]
+		if !ok {
+			fmt.Fprintf(&b, "  %s: old %q, new missing\n", op.Name, op.Value)
+			continue
+		}
+		if op.Type != np.Type || op.Value != np.Value {
+			fmt.Fprintf(&b, "  %s: old %s %q, new %s %q\n", op.Name, op.Type, op.Value, np.Type, np.Value)
+		}
+	}
+	if b.Len() == 0 {
+		// The values are formatted identically, so the difference is
+		// somewhere that extractParam can't see, like behind a pointer.
+		return fmt.Sprintf("  old: %#v\n  new: %#v", res.old, res.new)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// writeOutput writes the given result to Output as a line of JSON.
+func (r *RefactorArgs[Args, Ret]) writeOutput(res *result[Args, Ret]) {
+	data, err := json.Marshal(r.request(res))
+	if err != nil {
+		log.Printf("[temper] failed to encode results for refactor %s: %v\n", r.Name, err)
+		return
+	}
+	data = append(data, '\n')
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	if _, err := r.Output.Write(data); err != nil {
+		log.Printf("[temper] failed to write results for refactor %s: %v\n", r.Name, err)
+	}
 }
 
 // results returns an API client friendly representation of the type T
 func (r *RefactorArgs[Args, Ret]) results() *addRefactorResultRequest {
-	argsType, args := extractParam(r.result.args)
-	oldType, oldRet := extractParam(r.result.old)
-	newType, newRet := extractParam(r.result.new)
+	return r.request(r.result.Load())
+}
+
+// request returns an API client friendly representation of the given result.
+func (r *RefactorArgs[Args, Ret]) request(res *result[Args, Ret]) *addRefactorResultRequest {
+	argsType, args := extractParam(res.args)
+	oldType, oldRet := extractParam(res.old)
+	newType, newRet := extractParam(res.new)
 
 	return &addRefactorResultRequest{
 		Key:                r.Name,
-		OldAverageDuration: r.result.olddur,
-		NewAverageDuration: r.result.newdur,
+		IdempotencyKey:     idempotencyKey(r.Name, argsType, args, res.at),
+		OldAverageDuration: res.olddur,
+		NewAverageDuration: res.newdur,
 		ResultParameters: []*refactorResultParameters{
 			{
 				ArgsType: argsType,
 				Args:     args,
 				OldType:  oldType,
 				Old:      oldRet,
+				OldErr:   errString(res.oldErr),
 				NewType:  newType,
 				New:      newRet,
+				NewErr:   errString(res.newErr),
 			},
 		},
 	}
 }
 
+// idempotencyKey returns a key that uniquely identifies a single refactor
+// result, derived from the refactor key, its arguments, and the time it ran.
+func idempotencyKey(key, argsType string, args []*refactorParameter, at time.Time) string {
+	data := []byte(key + "\x00" + argsType)
+	for _, arg := range args {
+		data = append(data, "\x00"+arg.Name+"="+arg.Value...)
+	}
+	data = binary.LittleEndian.AppendUint64(data, uint64(at.UnixNano()))
+
+	return strconv.FormatUint(hash(data), 16)
+}
+
+// cyclePlaceholder is the value of an embedded field whose type is already
+// being flattened, which would otherwise recurse forever.
+const cyclePlaceholder = "<cycle>"
+
 func extractParam(i any) (string, []*refactorParameter) {
 	rv := reflect.Indirect(reflect.ValueOf(i))
-	rt := rv.Type()
+	if !rv.IsValid() {
+		return fmt.Sprintf("%T", i), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		visited := map[reflect.Type]bool{rv.Type(): true}
+		return fmt.Sprintf("%T", i), structParams(rv, "", visited)
+	case reflect.Map:
+		return fmt.Sprintf("%T", i), mapParams(rv)
+	case reflect.Slice, reflect.Array:
+		return fmt.Sprintf("%T", i), sliceParams(rv)
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%T", i), []*refactorParameter{{
+			Name:  valueParamName,
+			Type:  rv.Type().String(),
+			Value: fmt.Sprintf("%v", rv),
+		}}
+	}
+
+	log.Printf("[temper] type %s isn't supported\n", rv.Type().Kind())
+	return "", nil
+}
+
+// valueParamName is the name of the only parameter of a value that isn't a
+// struct, map, slice, or array, like an int or a string.
+const valueParamName = "value"
+
+// elemParams returns the parameters for an element of a map, slice, or array
+// with the given name, which are the fields of the element prefixed by the
+// name when it's a struct, and the element itself otherwise.
+func elemParams(name string, v reflect.Value) []*refactorParameter {
+	if ev := reflect.Indirect(v); ev.IsValid() && ev.Kind() == reflect.Struct {
+		visited := map[reflect.Type]bool{ev.Type(): true}
+		return structParams(ev, name+".", visited)
+	}
+
+	return []*refactorParameter{{
+		Name:  name,
+		Type:  v.Type().String(),
+		Value: fmt.Sprintf("%v", v),
+	}}
+}
 
-	if rv.Type().Kind() != reflect.Struct {
-		log.Printf("[temper] type %s is not a struct\n", rv.Type().Kind())
-		return "", nil
+// sliceParams returns the parameters for each element of a slice or array,
+// named by their index, like `[0]`.
+func sliceParams(rv reflect.Value) []*refactorParameter {
+	params := make([]*refactorParameter, 0, rv.Len())
+	for i := range rv.Len() {
+		params = append(params, elemParams("["+strconv.Itoa(i)+"]", rv.Index(i))...)
 	}
+	return params
+}
 
+// structParams returns a parameter for each field of the struct rv, with the
+// fields of embedded structs flattened into it and named with the given
+// prefix. The struct types being flattened are tracked in visited, so that a
+// type that embeds itself ends in a placeholder rather than looping forever.
+func structParams(rv reflect.Value, prefix string, visited map[reflect.Type]bool) []*refactorParameter {
+	rt := rv.Type()
 	params := make([]*refactorParameter, 0)
 
 	for n := range rt.NumField() {
 		f := rt.Field(n)
-		v := rv.FieldByName(f.Name).Interface()
+		v := rv.Field(n)
+		name := prefix + f.Name
+
+		if et := f.Type; f.Anonymous {
+			if et.Kind() == reflect.Pointer {
+				et = et.Elem()
+			}
+
+			if et.Kind() == reflect.Struct {
+				if visited[et] {
+					params = append(params, &refactorParameter{
+						Name:  name,
+						Type:  f.Type.String(),
+						Value: cyclePlaceholder,
+					})
+					continue
+				}
+
+				if ev := reflect.Indirect(v); ev.IsValid() {
+					visited[et] = true
+					params = append(params, structParams(ev, name+".", visited)...)
+					delete(visited, et)
+					continue
+				}
+			}
+		}
 
 		// TODO Need special case for timestamp potentially.
 		params = append(params, &refactorParameter{
-			Name:  f.Name,
+			Name:  name,
 			Type:  f.Type.String(),
 			Value: fmt.Sprintf("%v", v),
 		})
 	}
 
-	return fmt.Sprintf("%T", i), params
+	return params
+}
+
+// mapParams returns a parameter for each entry of the map rv, named after its
+// key. Map iteration order is random, so the parameters are sorted by name to
+// keep them comparable.
+func mapParams(rv reflect.Value) []*refactorParameter {
+	params := make([]*refactorParameter, 0, rv.Len())
+
+	iter := rv.MapRange()
+	for iter.Next() {
+		params = append(params, elemParams(fmt.Sprintf("%v", iter.Key()), iter.Value())...)
+	}
+
+	slices.SortFunc(params, func(a, b *refactorParameter) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return params
 }
@@ -1,9 +1,25 @@
 package temper
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRefactorExactMatch(t *testing.T) {
@@ -103,3 +119,1080 @@ func TestRefactor_results_exactMatch(t *testing.T) {
 		t.Fatalf("refactor result parameters don't match, expected:\n%s\n  but got:\n%s", allExpectedResultParameters, allActualResultParameters)
 	}
 }
+
+func TestRefactor_Output(t *testing.T) {
+	type in struct {
+		V string
+	}
+	type out struct {
+		V string
+	}
+
+	var buf bytes.Buffer
+	refactor := RefactorArgs[in, out]{
+		Name: "test",
+		New: func(args in) out {
+			return out{V: args.V + "!"}
+		},
+		Old: func(args in) out {
+			return out(args)
+		},
+		Output: &buf,
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Refactor(&refactor, in{V: "test"})
+		}()
+	}
+	wg.Wait()
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 10 {
+		t.Fatalf("expected 10 lines of output but got %d", len(lines))
+	}
+	for _, line := range lines {
+		req := &addRefactorResultRequest{}
+		if err := json.Unmarshal(line, req); err != nil {
+			t.Fatalf("failed to decode output line %q: %v", line, err)
+		}
+		if req.Key != "test" {
+			t.Errorf("expected key test but got %s", req.Key)
+		}
+		if v := req.ResultParameters[0].New[0].Value; v != "test!" {
+			t.Errorf("expected new value test! but got %s", v)
+		}
+	}
+}
+
+func TestRefactor_results_idempotencyKey(t *testing.T) {
+	type in struct {
+		V string
+	}
+	type out struct {
+		V string
+	}
+
+	refactor := RefactorArgs[in, out]{
+		Name: "test",
+		New: func(args in) out {
+			return out(args)
+		},
+		Old: func(args in) out {
+			return out(args)
+		},
+	}
+
+	refactor.run(in{V: "test"})
+	first := refactor.results().IdempotencyKey
+	if first == "" {
+		t.Fatal("expected an idempotency key but got none")
+	}
+	if again := refactor.results().IdempotencyKey; first != again {
+		t.Errorf("expected the same result to have the same idempotency key, got %s vs %s", first, again)
+	}
+
+	// The same arguments run at a different time are a different result.
+	time.Sleep(time.Millisecond)
+	refactor.run(in{V: "test"})
+	if second := refactor.results().IdempotencyKey; first == second {
+		t.Errorf("expected different runs to have different idempotency keys, got %s for both", first)
+	}
+}
+
+func TestRefactor_runCtxLabels(t *testing.T) {
+	type in struct {
+		V string
+	}
+	type out struct {
+		V string
+	}
+
+	running := make(chan struct{})
+	done := make(chan struct{})
+	refactor := RefactorArgs[in, out]{
+		Name: "labelled",
+		New: func(args in) out {
+			close(running)
+			<-done
+			return out(args)
+		},
+		Old: func(args in) out {
+			return out(args)
+		},
+	}
+
+	go func() {
+		<-running
+		defer close(done)
+
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+			t.Errorf("failed to write goroutine profile: %v", err)
+			return
+		}
+		if !strings.Contains(buf.String(), `"endpoint":"/test"`) || !strings.Contains(buf.String(), `"temper_refactor":"labelled"`) {
+			t.Errorf("expected New to run with the caller's labels, got profile:\n%s", buf.String())
+		}
+	}()
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("endpoint", "/test"))
+	refactor.runCtx(ctx, in{V: "test"})
+}
+
+// recordingTB records the errors reported to it.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (tb *recordingTB) Helper() {}
+
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRefactor_AssertMatch(t *testing.T) {
+	type in struct {
+		A int
+		B int
+	}
+	type out struct {
+		Sum  int
+		Note string
+	}
+
+	refactor := RefactorArgs[in, out]{
+		Name: "sum",
+		Old: func(args in) out {
+			return out{Sum: args.A + args.B, Note: "ok"}
+		},
+		New: func(args in) out {
+			// Wrong whenever A is negative.
+			if args.A < 0 {
+				return out{Sum: args.B - args.A, Note: "ok"}
+			}
+			return out{Sum: args.A + args.B, Note: "ok"}
+		},
+	}
+
+	for _, args := range []in{{1, 2}, {0, 0}, {10, -3}} {
+		refactor.AssertMatch(t, args)
+	}
+
+	tb := &recordingTB{TB: t}
+	refactor.AssertMatch(tb, in{A: -1, B: 2})
+	if len(tb.errors) != 1 {
+		t.Fatalf("expected one error for a mismatch but got %v", tb.errors)
+	}
+	if !strings.Contains(tb.errors[0], `Sum: old int "1", new int "3"`) {
+		t.Errorf("expected the error to describe the mismatched field but got %q", tb.errors[0])
+	}
+	if strings.Contains(tb.errors[0], "Note") {
+		t.Errorf("expected the error to only describe mismatched fields but got %q", tb.errors[0])
+	}
+}
+
+func TestRefactor_AssertGolden(t *testing.T) {
+	type in struct {
+		A int
+		B int
+	}
+	type out struct {
+		Sum int
+	}
+
+	refactor := RefactorArgs[in, out]{
+		Name: "sum",
+		Old: func(args in) out {
+			return out{Sum: args.A + args.B}
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "sum.golden")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create golden file: %v", err)
+	}
+	if err := refactor.RecordGolden(f, in{A: 1, B: 2}, in{A: -1, B: 2}); err != nil {
+		t.Fatalf("failed to record golden file: %v", err)
+	}
+	f.Close()
+
+	// The old function is gone, and only the new one is checked.
+	refactor.Old = nil
+	refactor.New = func(args in) out {
+		if args.A < 0 {
+			return out{Sum: -args.A + args.B}
+		}
+		return out{Sum: args.A + args.B}
+	}
+
+	tb := &recordingTB{TB: t}
+	refactor.AssertGolden(tb, path)
+	if len(tb.errors) != 1 {
+		t.Fatalf("expected one error for a regression but got %v", tb.errors)
+	}
+	if !strings.Contains(tb.errors[0], "golden record 2") || !strings.Contains(tb.errors[0], `Sum: old int "1", new int "3"`) {
+		t.Errorf("expected the error to describe the regressed record but got %q", tb.errors[0])
+	}
+}
+
+// list is a linked list that embeds its own type.
+type list struct {
+	Value int
+	*list
+}
+
+func TestExtractParam_recursiveType(t *testing.T) {
+	type base struct {
+		ID int
+	}
+	type result struct {
+		base
+		Head list
+	}
+
+	l := list{Value: 1, list: &list{Value: 2}}
+	typ, params := extractParam(l)
+	if typ != "temper.list" {
+		t.Errorf("expected type temper.list but got %s", typ)
+	}
+
+	expected := []*refactorParameter{
+		{Name: "Value", Type: "int", Value: "1"},
+		{Name: "list", Type: "*temper.list", Value: cyclePlaceholder},
+	}
+	if !reflect.DeepEqual(expected, params) {
+		t.Errorf("expected %v but got %v", expected, params)
+	}
+
+	// Embedded structs are flattened, but fields that aren't embedded are
+	// formatted as is.
+	_, params = extractParam(result{base: base{ID: 7}, Head: l})
+	if len(params) != 2 || params[0].Name != "base.ID" || params[0].Value != "7" || params[1].Name != "Head" {
+		t.Errorf("expected the embedded struct to be flattened but got %v", params)
+	}
+}
+
+func TestExtractParam_kinds(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	n := 5
+
+	tests := []struct {
+		name     string
+		in       any
+		typ      string
+		expected []*refactorParameter
+	}{
+		{"string", "abc", "string", []*refactorParameter{{Name: "value", Type: "string", Value: "abc"}}},
+		{"int", -3, "int", []*refactorParameter{{Name: "value", Type: "int", Value: "-3"}}},
+		{"int64", int64(1 << 40), "int64", []*refactorParameter{{Name: "value", Type: "int64", Value: "1099511627776"}}},
+		{"uint8", uint8(255), "uint8", []*refactorParameter{{Name: "value", Type: "uint8", Value: "255"}}},
+		{"float64", 1.5, "float64", []*refactorParameter{{Name: "value", Type: "float64", Value: "1.5"}}},
+		{"bool", true, "bool", []*refactorParameter{{Name: "value", Type: "bool", Value: "true"}}},
+		{"pointer", &n, "*int", []*refactorParameter{{Name: "value", Type: "int", Value: "5"}}},
+		{"slice", []string{"a", "b"}, "[]string", []*refactorParameter{
+			{Name: "[0]", Type: "string", Value: "a"},
+			{Name: "[1]", Type: "string", Value: "b"},
+		}},
+		{"array", [2]int{1, 2}, "[2]int", []*refactorParameter{
+			{Name: "[0]", Type: "int", Value: "1"},
+			{Name: "[1]", Type: "int", Value: "2"},
+		}},
+		{"map", map[string]bool{"b": false, "a": true}, "map[string]bool", []*refactorParameter{
+			{Name: "a", Type: "bool", Value: "true"},
+			{Name: "b", Type: "bool", Value: "false"},
+		}},
+		{"slice of structs", []point{{X: 1, Y: 2}}, "[]temper.point", []*refactorParameter{
+			{Name: "[0].X", Type: "int", Value: "1"},
+			{Name: "[0].Y", Type: "int", Value: "2"},
+		}},
+		{"map of structs", map[string]*point{"p": {X: 3, Y: 4}}, "map[string]*temper.point", []*refactorParameter{
+			{Name: "p.X", Type: "int", Value: "3"},
+			{Name: "p.Y", Type: "int", Value: "4"},
+		}},
+		{"struct", point{X: 5, Y: 6}, "temper.point", []*refactorParameter{
+			{Name: "X", Type: "int", Value: "5"},
+			{Name: "Y", Type: "int", Value: "6"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			typ, params := extractParam(tt.in)
+			if typ != tt.typ {
+				t.Errorf("expected type %s but got %s", tt.typ, typ)
+			}
+			if !reflect.DeepEqual(tt.expected, params) {
+				t.Errorf("expected %v but got %v", tt.expected, params)
+			}
+		})
+	}
+}
+
+func TestExtractParam_mapOrder(t *testing.T) {
+	m := map[string]int{"d": 4, "b": 2, "a": 1, "e": 5, "c": 3}
+
+	typ, first := extractParam(m)
+	if typ != "map[string]int" {
+		t.Errorf("expected type map[string]int but got %s", typ)
+	}
+	for range 20 {
+		if _, params := extractParam(m); !reflect.DeepEqual(first, params) {
+			t.Fatalf("expected the same parameters every time but got %v and %v", first, params)
+		}
+	}
+
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		if first[i].Name != name || first[i].Type != "int" || first[i].Value != fmt.Sprint(i+1) {
+			t.Errorf("expected parameter %d to be %s but got %+v", i, name, first[i])
+		}
+	}
+}
+
+func TestRefactor_CompareFeature(t *testing.T) {
+	prev := c
+	t.Cleanup(func() { c = prev })
+	c = newTestClient(t, "FAKE_SECRET", nil)
+
+	var newCalls atomic.Int64
+	refactor := RefactorArgs[int, int]{
+		Name: "double",
+		Old: func(n int) int {
+			return n * 2
+		},
+		New: func(n int) int {
+			newCalls.Add(1)
+			return n << 1
+		},
+		CompareFeature: "temper_api_e2e_off",
+	}
+
+	if v := refactor.run(2); v != 4 {
+		t.Errorf("expected 4 but got %d", v)
+	}
+	if n := newCalls.Load(); n != 0 {
+		t.Errorf("expected new not to run while the feature is off but it ran %d times", n)
+	}
+
+	refactor.CompareFeature = "temper_api_e2e_rollout"
+	if v := refactor.run(2); v != 4 {
+		t.Errorf("expected 4 but got %d", v)
+	}
+	if n := newCalls.Load(); n != 1 {
+		t.Errorf("expected new to run once while the feature is on but it ran %d times", n)
+	}
+}
+
+func TestRefactorWith(t *testing.T) {
+	client := newTestClient(t, "FAKE_SECRET", nil)
+
+	var newCalls atomic.Int64
+	refactor := &RefactorArgs[int, int]{
+		Name:           "client_double",
+		Old:            func(n int) int { return n * 2 },
+		New:            func(n int) int { newCalls.Add(1); return n << 1 },
+		CompareFeature: "temper_api_e2e_off",
+	}
+
+	if v := RefactorWith(client, refactor, 2); v != 4 {
+		t.Errorf("expected 4 but got %d", v)
+	}
+	refactor.CompareFeature = "temper_api_e2e_rollout"
+	if v := RefactorWith(client, refactor, 2); v != 4 {
+		t.Errorf("expected 4 but got %d", v)
+	}
+	if n := newCalls.Load(); n != 1 {
+		t.Errorf("expected new to only run while the feature is on in the client but it ran %d times", n)
+	}
+}
+
+func TestRefactorWith_OnRefactor(t *testing.T) {
+	var reported []bool
+	client := newTestClient(t, "", &Option{
+		OnRefactor: func(name string, matched bool, olddur, newdur time.Duration) {
+			if name != "client_abs" {
+				t.Errorf("expected the refactor's name but got %q", name)
+			}
+			reported = append(reported, matched)
+		},
+	})
+
+	refactor := &RefactorArgs[int, int]{
+		Name: "client_abs",
+		Old: func(n int) int {
+			if n < 0 {
+				return -n
+			}
+			return n
+		},
+		New: func(n int) int { return n },
+	}
+	RefactorWith(client, refactor, 1)
+	RefactorWith(client, refactor, -1)
+
+	refactor.ShadowOnly = true
+	RefactorWith(client, refactor, 1)
+
+	if !slices.Equal(reported, []bool{true, false}) {
+		t.Errorf("expected a match then a mismatch to be reported but got %v", reported)
+	}
+}
+
+func TestRefactorWith_Submit(t *testing.T) {
+	submitted := make(chan *http.Request, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		submitted <- r
+		if r.URL.Query().Get("fail") != "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	logger := make(chanLogger, 4)
+	client := newTestClient(t, "FAKE_SECRET", &Option{BaseURL: srv.URL, Logger: logger, PollInterval: time.Hour})
+
+	// Results are submitted by the client while it's polling.
+	client.startPolling()
+	t.Cleanup(func() { client.Close() })
+
+	refactor := &RefactorArgs[int, int]{
+		Name: "client_submit",
+		Old:  func(n int) int { return n * 2 },
+		New:  func(n int) int { return n + 2 },
+	}
+
+	// Only mismatches are submitted.
+	if v := RefactorWith(client, refactor, 2); v != 4 {
+		t.Errorf("expected 4 but got %d", v)
+	}
+	if v := RefactorWith(client, refactor, 3); v != 6 {
+		t.Errorf("expected 6 but got %d", v)
+	}
+
+	var r *http.Request
+	select {
+	case r = <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the mismatch to be submitted")
+	}
+	if r.Method != http.MethodPost || r.URL.Path != defaultRefactorResultsPath {
+		t.Errorf("expected a POST to %s but got %s %s", defaultRefactorResultsPath, r.Method, r.URL.Path)
+	}
+	if got := r.Header.Get("Authorization"); got != "Bearer FAKE_SECRET" {
+		t.Errorf("expected the secret key to be used but got %q", got)
+	}
+	if r.Header.Get(idempotencyKeyHeader) == "" {
+		t.Errorf("expected an idempotency key")
+	}
+	var req addRefactorResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		t.Fatalf("failed to decode submitted result: %v", err)
+	}
+	if req.Key != "client_submit" {
+		t.Errorf("expected the refactor's name but got %q", req.Key)
+	}
+	select {
+	case r := <-submitted:
+		t.Errorf("expected the match not to be submitted but got %s", r.URL)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Matches are submitted too when AlwaysSubmit is set.
+	refactor.AlwaysSubmit = true
+	RefactorWith(client, refactor, 2)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("expected the match to be submitted")
+	}
+	refactor.AlwaysSubmit = false
+
+	// A failed submission is logged without affecting the result.
+	client.opt.RefactorResultsPath = defaultRefactorResultsPath + "?fail=1"
+	if v := RefactorWith(client, refactor, 3); v != 6 {
+		t.Errorf("expected 6 but got %d", v)
+	}
+	<-submitted
+	select {
+	case msg := <-logger:
+		if !strings.Contains(msg, "failed to submit result for refactor client_submit") {
+			t.Errorf("expected the failed submission to be logged but got %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the failed submission to be logged")
+	}
+}
+
+func TestClient_queueRefactorResultFull(t *testing.T) {
+	logger := make(chanLogger, 1)
+	client := newTestClient(t, "FAKE_SECRET", &Option{Logger: logger})
+
+	// Nothing is queued while the client isn't polling.
+	client.queueRefactorResult(&addRefactorResultRequest{Key: "queued"})
+	if n := len(client.results); n != 0 {
+		t.Fatalf("expected no results to be queued without polling but got %d", n)
+	}
+
+	// Pretend to poll without a submitter, so the queue fills up.
+	client.polling.Store(true)
+	for range maxQueuedRefactorResults + 1 {
+		client.queueRefactorResult(&addRefactorResultRequest{Key: "queued"})
+	}
+	if n := len(client.results); n != maxQueuedRefactorResults {
+		t.Errorf("expected %d queued results but got %d", maxQueuedRefactorResults, n)
+	}
+	select {
+	case msg := <-logger:
+		if !strings.Contains(msg, "dropped result for refactor queued") {
+			t.Errorf("expected the dropped result to be logged but got %q", msg)
+		}
+	default:
+		t.Error("expected the dropped result to be logged")
+	}
+}
+
+// chanLogger sends each message it logs to the channel.
+type chanLogger chan string
+
+func (l chanLogger) Printf(format string, v ...any) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+// Ensure the testing types satisfy TestingT.
+var (
+	_ TestingT = (*testing.T)(nil)
+	_ TestingT = testing.TB(nil)
+)
+
+func TestRefactor_ExportStats(t *testing.T) {
+	refactor := RefactorArgs[int, int]{
+		Name: "abs",
+		Old: func(n int) int {
+			if n < 0 {
+				return -n
+			}
+			return n
+		},
+		New: func(n int) int {
+			return n
+		},
+	}
+
+	for _, n := range []int{1, 2, -3, 4} {
+		refactor.run(n)
+	}
+	stats := refactor.Stats()
+	if stats.Runs != 4 || stats.Matches != 3 || stats.Mismatches != 1 {
+		t.Fatalf("expected 4 runs with 3 matches but got %+v", stats)
+	}
+
+	// Restore the stats into a fresh refactor, as if after a restart.
+	restarted := RefactorArgs[int, int]{Name: "abs", Old: refactor.Old, New: refactor.New}
+	if err := restarted.ImportStats(refactor.ExportStats()); err != nil {
+		t.Fatalf("failed to import stats: %v", err)
+	}
+	if got := restarted.Stats(); got != stats {
+		t.Errorf("expected %+v but got %+v", stats, got)
+	}
+
+	restarted.run(-5)
+	if got := restarted.Stats(); got.Runs != 5 || got.Mismatches != 2 {
+		t.Errorf("expected the stats to keep accumulating but got %+v", got)
+	}
+
+	if err := restarted.ImportStats([]byte(`{"runs":2,"matches":5}`)); err == nil {
+		t.Error("expected an error importing inconsistent stats")
+	}
+	if err := restarted.ImportStats([]byte(`not json`)); err == nil {
+		t.Error("expected an error importing invalid stats")
+	}
+}
+
+func TestRefactor_FloatTolerance(t *testing.T) {
+	type in struct {
+		A, B  float64
+		Label string
+	}
+	type out struct {
+		Sum    float64
+		Parts  []float64
+		Label  string
+		Nested *out
+	}
+
+	refactor := RefactorArgs[in, out]{
+		Name: "sum",
+		Old: func(args in) out {
+			return out{Sum: 0.3, Parts: []float64{0.3}, Label: "sum", Nested: &out{Sum: 0.3}}
+		},
+		New: func(args in) out {
+			sum := args.A + args.B
+			return out{Sum: sum, Parts: []float64{sum}, Label: args.Label, Nested: &out{Sum: sum}}
+		},
+	}
+
+	args := in{A: 0.1, B: 0.2, Label: "sum"}
+	if 0.1+args.B == 0.3 {
+		t.Fatal("expected 0.1+0.2 not to equal 0.3 exactly")
+	}
+
+	tb := &recordingTB{TB: t}
+	refactor.AssertMatch(tb, args)
+	if len(tb.errors) != 1 {
+		t.Fatalf("expected an exact comparison to mismatch but got %v", tb.errors)
+	}
+
+	refactor.FloatTolerance = 1e-9
+	tb = &recordingTB{TB: t}
+	refactor.AssertMatch(tb, args)
+	if len(tb.errors) != 0 {
+		t.Errorf("expected floats within the tolerance to match but got %v", tb.errors)
+	}
+
+	// Other fields are still compared exactly.
+	tb = &recordingTB{TB: t}
+	refactor.AssertMatch(tb, in{A: 0.1, B: 0.2, Label: "total"})
+	if len(tb.errors) != 1 {
+		t.Errorf("expected a different label to mismatch but got %v", tb.errors)
+	}
+
+	tb = &recordingTB{TB: t}
+	refactor.AssertMatch(tb, in{A: 0.1, B: 0.2001, Label: "sum"})
+	if len(tb.errors) != 1 {
+		t.Errorf("expected floats outside the tolerance to mismatch but got %v", tb.errors)
+	}
+}
+
+func Test_equalWithin_infinities(t *testing.T) {
+	inf, nan := math.Inf(1), math.NaN()
+	for _, tt := range []struct {
+		a, b any
+		want bool
+	}{
+		{inf, inf, true},
+		{-inf, -inf, true},
+		{inf, -inf, false},
+		{inf, 1.0, false},
+		{nan, nan, false},
+		{complex(inf, 0), complex(inf, 0), true},
+		{complex(inf, 0), complex(0, inf), false},
+	} {
+		a, b := reflect.ValueOf(tt.a), reflect.ValueOf(tt.b)
+		if got := equalWithin(a, b, 1e-9, make(map[[2]uintptr]bool)); got != tt.want {
+			t.Errorf("expected %v and %v to be equal %v but got %v", tt.a, tt.b, tt.want, got)
+		}
+		if want := reflect.DeepEqual(tt.a, tt.b); tt.want != want {
+			t.Errorf("expected %v and %v to be equal %v like reflect.DeepEqual", tt.a, tt.b, want)
+		}
+	}
+}
+
+func TestRefactor_RecentMismatches(t *testing.T) {
+	refactor := RefactorArgs[int, int]{
+		Name: "abs",
+		Old: func(n int) int {
+			if n < 0 {
+				return -n
+			}
+			return n
+		},
+		New: func(n int) int {
+			return n
+		},
+	}
+
+	refactor.run(-1)
+	if got := refactor.RecentMismatches(); len(got) != 0 {
+		t.Fatalf("expected no mismatches to be kept without a history but got %v", got)
+	}
+
+	refactor.MismatchHistory = 3
+	for _, n := range []int{-1, 2, -3, -4, 5, -6, -7} {
+		refactor.run(n)
+	}
+
+	got := refactor.RecentMismatches()
+	var args []int
+	for _, m := range got {
+		args = append(args, m.Args.(int))
+		if m.Old.(int) != -m.New.(int) {
+			t.Errorf("expected old and new results of %v but got %v and %v", m.Args, m.Old, m.New)
+		}
+	}
+	if !slices.Equal(args, []int{-4, -6, -7}) {
+		t.Errorf("expected the 3 most recent mismatches from oldest to newest but got %v", args)
+	}
+
+	got[0].Args = 0
+	if refactor.RecentMismatches()[0].Args != -4 {
+		t.Error("expected the mismatches returned to be copies")
+	}
+}
+
+func TestRefactor_ShadowOnly(t *testing.T) {
+	var newRuns atomic.Int64
+	var out bytes.Buffer
+	refactor := RefactorArgs[int, int]{
+		Name:            "shadow",
+		ShadowOnly:      true,
+		Output:          &out,
+		MismatchHistory: 10,
+		Old: func(n int) int {
+			return n
+		},
+		New: func(n int) int {
+			newRuns.Add(1)
+			return -n
+		},
+	}
+
+	for n := range 3 {
+		if v := refactor.run(n + 1); v != n+1 {
+			t.Errorf("expected the old result %d but got %d", n+1, v)
+		}
+	}
+
+	if n := newRuns.Load(); n != 3 {
+		t.Errorf("expected the new function to run 3 times but got %d", n)
+	}
+	stats := refactor.Stats()
+	if stats.Shadowed != 3 || stats.Runs != 0 || stats.Mismatches != 0 {
+		t.Errorf("expected 3 shadowed runs and no comparisons but got %+v", stats)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no output but got %q", out.String())
+	}
+	if got := refactor.RecentMismatches(); len(got) != 0 {
+		t.Errorf("expected no mismatches but got %v", got)
+	}
+}
+
+func TestRefactor_RunAll(t *testing.T) {
+	refactor := RefactorArgs[int, int]{
+		Name: "abs",
+		Old: func(n int) int {
+			if n < 0 {
+				return -n
+			}
+			return n
+		},
+		New: func(n int) int {
+			return n
+		},
+	}
+
+	ar := refactor.RunAll([]int{1, -2, 3, -4, 5})
+	if ar.Runs != 5 || ar.Matches != 3 || ar.Passed() {
+		t.Errorf("expected 3 of 5 runs to match but got %+v", ar)
+	}
+	var args []int
+	for _, m := range ar.Mismatches {
+		args = append(args, m.Args.(int))
+	}
+	if !slices.Equal(args, []int{-2, -4}) {
+		t.Errorf("expected the mismatching inputs in order but got %v", args)
+	}
+	if stats := refactor.Stats(); stats.Runs != 5 {
+		t.Errorf("expected every run to be recorded in the stats but got %+v", stats)
+	}
+
+	if ar := refactor.RunAll([]int{1, 2}); !ar.Passed() || ar.Matches != 2 {
+		t.Errorf("expected every run to match but got %+v", ar)
+	}
+}
+
+func TestRefactor_MaxConcurrency(t *testing.T) {
+	var newRuns atomic.Int64
+	started, unblock := make(chan struct{}), make(chan struct{})
+	refactor := RefactorArgs[int, int]{
+		Name:           "expensive",
+		MaxConcurrency: 1,
+		Old: func(n int) int {
+			return n
+		},
+		New: func(n int) int {
+			if newRuns.Add(1) == 1 {
+				close(started)
+				<-unblock
+			}
+			return n
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		refactor.run(1)
+	}()
+	<-started
+
+	if v := refactor.run(2); v != 2 {
+		t.Errorf("expected the old result 2 but got %d", v)
+	}
+	if n := newRuns.Load(); n != 1 {
+		t.Errorf("expected the new function not to run over the limit but it ran %d times", n)
+	}
+
+	other := RefactorArgs[int, int]{
+		Name:           "cheap",
+		MaxConcurrency: 1,
+		Old:            func(n int) int { return n },
+		New:            func(n int) int { return n },
+	}
+	other.run(3)
+	if stats := other.Stats(); stats.Runs != 1 {
+		t.Errorf("expected other refactors to be unaffected but got %+v", stats)
+	}
+
+	close(unblock)
+	<-done
+
+	refactor.run(4)
+	if n := newRuns.Load(); n != 2 {
+		t.Errorf("expected the new function to run once the slot was released but it ran %d times", n)
+	}
+}
+
+func TestRefactorErr(t *testing.T) {
+	errNegative := errors.New("negative")
+	refactor := &RefactorArgs[int, int]{
+		Name: "sqrt_err",
+		OldErr: func(n int) (int, error) {
+			if n < 0 {
+				return 0, errNegative
+			}
+			return n / 2, nil
+		},
+		NewErr: func(n int) (int, error) {
+			if n == 0 {
+				return 0, errors.New("zero")
+			}
+			if n < 0 {
+				return 0, errNegative
+			}
+			return n >> 1, nil
+		},
+		MismatchHistory: 10,
+	}
+
+	if v, err := RefactorErr(refactor, 4); v != 2 || err != nil {
+		t.Errorf("expected 2 and no error but got %d and %v", v, err)
+	}
+	if v, err := RefactorErr(refactor, -1); v != 0 || err != errNegative {
+		t.Errorf("expected the old function's error but got %d and %v", v, err)
+	}
+	if stats := refactor.Stats(); stats.Matches != 2 || stats.Mismatches != 0 {
+		t.Errorf("expected 2 matches but got %+v", stats)
+	}
+
+	// The old function succeeds, but the new one fails.
+	if v, err := RefactorErr(refactor, 0); v != 0 || err != nil {
+		t.Errorf("expected 0 and no error but got %d and %v", v, err)
+	}
+	// The old function fails, but the new one succeeds.
+	refactor.NewErr = func(n int) (int, error) { return n, nil }
+	if _, err := RefactorErr(refactor, -2); err != errNegative {
+		t.Errorf("expected the old function's error but got %v", err)
+	}
+	// Both fail with different messages.
+	refactor.NewErr = func(n int) (int, error) { return 0, errors.New("out of range") }
+	if _, err := RefactorErr(refactor, -3); err != errNegative {
+		t.Errorf("expected the old function's error but got %v", err)
+	}
+
+	if stats := refactor.Stats(); stats.Runs != 5 || stats.Mismatches != 3 {
+		t.Errorf("expected 3 mismatches out of 5 runs but got %+v", stats)
+	}
+	want := []Mismatch{
+		{Args: 0, Old: 0, New: 0, NewErr: "zero"},
+		{Args: -2, Old: 0, New: -2, OldErr: "negative"},
+		{Args: -3, Old: 0, New: 0, OldErr: "negative", NewErr: "out of range"},
+	}
+	got := refactor.RecentMismatches()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d mismatches but got %+v", len(want), got)
+	}
+	for i, m := range got {
+		if m.Args != want[i].Args || m.Old != want[i].Old || m.New != want[i].New || m.OldErr != want[i].OldErr || m.NewErr != want[i].NewErr {
+			t.Errorf("expected mismatch %d to be %+v but got %+v", i, want[i], m)
+		}
+	}
+}
+
+func TestRefactor_FuncResults(t *testing.T) {
+	type handler struct {
+		Name string
+		Fn   func() int
+	}
+	one := func() int { return 1 }
+	two := func() int { return 2 }
+
+	refactor := &RefactorArgs[string, *handler]{
+		Name: "handlers",
+		Old:  func(name string) *handler { return &handler{Name: name, Fn: one} },
+		New: func(name string) *handler {
+			if name == "" {
+				return nil
+			}
+			if name == "two" {
+				return &handler{Name: name, Fn: two}
+			}
+			return &handler{Name: name, Fn: one}
+		},
+	}
+
+	refactor.run("one")
+	if stats := refactor.Stats(); stats.Matches != 1 {
+		t.Errorf("expected results with the same funcs to match but got %+v", stats)
+	}
+	refactor.run("two")
+	refactor.run("")
+	if stats := refactor.Stats(); stats.Matches != 1 || stats.Mismatches != 2 {
+		t.Errorf("expected results with different funcs and nil results to mismatch but got %+v", stats)
+	}
+}
+
+func TestRefactor_SampleRate(t *testing.T) {
+	var newCalls atomic.Int64
+	refactor := &RefactorArgs[int, int]{
+		Name:       "sampled_double",
+		Old:        func(n int) int { return n * 2 },
+		New:        func(n int) int { newCalls.Add(1); return n << 1 },
+		SampleRate: 0.1,
+	}
+
+	for n := range 1000 {
+		if v := refactor.run(n); v != n*2 {
+			t.Fatalf("expected %d but got %d", n*2, v)
+		}
+	}
+	// The number of sampled runs is binomial, so this is many standard
+	// deviations from the expected 100.
+	if n := newCalls.Load(); n < 40 || n > 200 {
+		t.Errorf("expected about 100 of 1000 runs to be sampled but got %d", n)
+	}
+
+	newCalls.Store(0)
+	refactor.SampleRate = 0
+	for n := range 10 {
+		refactor.run(n)
+	}
+	if n := newCalls.Load(); n != 10 {
+		t.Errorf("expected every run to be sampled with a rate of 0 but got %d", n)
+	}
+
+	for _, rate := range []float64{1, 1.5, -0.5, math.NaN()} {
+		newCalls.Store(0)
+		refactor := &RefactorArgs[int, int]{
+			Name:       "sampled_double",
+			Old:        func(n int) int { return n * 2 },
+			New:        func(n int) int { newCalls.Add(1); return n << 1 },
+			SampleRate: rate,
+		}
+		for n := range 10 {
+			refactor.run(n)
+		}
+		if n := newCalls.Load(); n != 10 {
+			t.Errorf("expected every run to be sampled with a rate of %v but got %d", rate, n)
+		}
+	}
+}
+
+func TestRefactor_NewTimeout(t *testing.T) {
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	refactor := &RefactorArgs[int, int]{
+		Name: "slow_double",
+		Old:  func(n int) int { return n * 2 },
+		New: func(n int) int {
+			defer close(finished)
+			<-release
+			return n << 1
+		},
+		NewTimeout:      10 * time.Millisecond,
+		MismatchHistory: 1,
+	}
+
+	start := time.Now()
+	if v := refactor.run(2); v != 4 {
+		t.Errorf("expected the old result 4 but got %d", v)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the run to stop waiting after the timeout but it took %s", elapsed)
+	}
+
+	if stats := refactor.Stats(); stats.Runs != 1 || stats.Mismatches != 1 {
+		t.Errorf("expected the timeout to be a mismatch but got %+v", stats)
+	}
+	mismatches := refactor.RecentMismatches()
+	if len(mismatches) != 1 || !strings.Contains(mismatches[0].NewErr, "timeout") {
+		t.Errorf("expected a timeout mismatch but got %+v", mismatches)
+	}
+
+	// The abandoned new function can still finish.
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("expected the new function to finish")
+	}
+}
+
+func TestRefactor_NewTimeoutMaxConcurrency(t *testing.T) {
+	var running, maxRunning, entered atomic.Int64
+	unblock := make(chan struct{})
+	refactor := &RefactorArgs[int, int]{
+		Name: "hung_double",
+		Old:  func(n int) int { return n * 2 },
+		New: func(n int) int {
+			entered.Add(1)
+			cur := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if cur <= m || maxRunning.CompareAndSwap(m, cur) {
+					break
+				}
+			}
+			<-unblock
+			running.Add(-1)
+			return n << 1
+		},
+		NewTimeout:     5 * time.Millisecond,
+		MaxConcurrency: 2,
+	}
+
+	for n := range 10 {
+		if v := refactor.run(n); v != n*2 {
+			t.Errorf("expected the old result %d but got %d", n*2, v)
+		}
+	}
+	if n := maxRunning.Load(); n > 2 {
+		t.Errorf("expected at most 2 hung new functions at once but got %d", n)
+	}
+	if n := entered.Load(); n != 2 {
+		t.Errorf("expected the new function to be entered twice while hung but got %d", n)
+	}
+
+	// The slots are released once the hung functions return.
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for refactor.running.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the slots to be released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	refactor.run(1)
+	if n := entered.Load(); n != 3 {
+		t.Errorf("expected the new function to run once the slots were released but it was entered %d times", n)
+	}
+}
@@ -0,0 +1,355 @@
+package temper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// snapshotMagic identifies a filter snapshot, and snapshotVersion is the
+// version of its format. Version 2 added variants.
+const (
+	snapshotMagic   = "TMPF"
+	snapshotVersion = 2
+)
+
+// Flags of a snapshot. snapshotCompact is set for a compact filter, and
+// snapshotSHA256 is set for a filter that uses sha256 as its rollout hash.
+const (
+	snapshotCompact = 1 << 0
+	snapshotSHA256  = 1 << 1
+)
+
+// A Filter is a snapshot of the filter and rollout data used to evaluate
+// features. It's used to hand off the live filter between processes, so that
+// a restarted process can evaluate features without waiting for the backend.
+type Filter struct {
+	f *filter
+}
+
+// CurrentFilter returns the filter that's currently used to evaluate
+// features.
+func CurrentFilter() *Filter {
+	return c.CurrentFilter()
+}
+
+func (c *Client) CurrentFilter() *Filter {
+	return &Filter{f: c.filter.Load()}
+}
+
+// Version returns an identifier of the filter's data, which is the same for
+// any two filters with the same data, and is used to trace an evaluation back
+// to the filter it was made against. It's empty for a nil filter.
+func (f *Filter) Version() string {
+	if f == nil {
+		return ""
+	}
+	return f.f.version()
+}
+
+// version returns the hex encoded fnv-1a hash of the filter's snapshot,
+// computing it the first time it's needed.
+func (f *filter) version() string {
+	if f == nil {
+		return ""
+	}
+	if v := f.versionID.Load(); v != nil {
+		return *v
+	}
+
+	data, err := (&Filter{f: f}).MarshalBinary()
+	if err != nil {
+		return ""
+	}
+	v := strconv.FormatUint(hash(data), 16)
+	f.versionID.Store(&v)
+	return v
+}
+
+// Validate checks that the filter's data is plausible, returning an error
+// describing every problem, such as a rollout percentage over 100, or counts
+// that don't match the buckets. It catches data that's corrupt in a way that
+// still decodes, but that would evaluate features incorrectly.
+func (f *Filter) Validate() error {
+	if f == nil || f.f == nil {
+		return errors.New("go-temper: can't validate a nil filter")
+	}
+	return f.f.validate()
+}
+
+// MarshalBinary encodes the filter in a compact binary format that's only
+// meant to be read by UnmarshalBinary, and is unrelated to the format the
+// backend serves the filter in.
+//
+// The format is the magic bytes "TMPF", a version byte, a flags byte, then
+// the number of buckets, occupied entries, and full buckets, followed by the
+// buckets, the rollouts, the rollouts for the environment, the killed
+// features, and the variants, all little endian.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	if f == nil || f.f == nil {
+		return nil, errors.New("go-temper: can't marshal a nil filter")
+	}
+	filter := f.f
+
+	var flags byte
+	if filter.buckets == nil && filter.cap > 0 {
+		flags |= snapshotCompact
+	}
+	if filter.rolloutHash == RolloutHashSHA256 {
+		flags |= snapshotSHA256
+	}
+
+	buf := bytes.NewBufferString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	buf.WriteByte(flags)
+
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(filter.cap)))
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(filter.count)))
+	buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(filter.full)))
+
+	if flags&snapshotCompact != 0 {
+		binary.Write(buf, binary.LittleEndian, uint32(len(filter.sparseIndexes)))
+		binary.Write(buf, binary.LittleEndian, filter.sparseIndexes)
+		binary.Write(buf, binary.LittleEndian, filter.sparseBuckets)
+	} else {
+		binary.Write(buf, binary.LittleEndian, filter.buckets)
+	}
+
+	writeRollouts(buf, filter.rollouts)
+	writeRollouts(buf, filter.envRollouts)
+
+	killed := make([]uint64, 0, len(filter.killed))
+	for h := range filter.killed {
+		killed = append(killed, h)
+	}
+	slices.Sort(killed)
+	binary.Write(buf, binary.LittleEndian, uint32(len(killed)))
+	binary.Write(buf, binary.LittleEndian, killed)
+
+	if err := writeVariants(buf, filter.variants); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeVariants writes the number of features with variants, followed by
+// each feature's rollout key, number of variants, and each variant's weight
+// and length prefixed name, sorted by rollout key.
+func writeVariants(buf *bytes.Buffer, variants map[uint64][]WeightedVariant) error {
+	keys := make([]uint64, 0, len(variants))
+	for high := range variants {
+		keys = append(keys, high)
+	}
+	slices.Sort(keys)
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(keys)))
+	for _, high := range keys {
+		vs := variants[high]
+		if len(vs) > math.MaxUint8 {
+			return fmt.Errorf("go-temper: can't marshal %d variants of feature %#x", len(vs), high)
+		}
+		binary.Write(buf, binary.LittleEndian, high)
+		buf.WriteByte(uint8(len(vs)))
+
+		for _, v := range vs {
+			if len(v.Name) > math.MaxUint16 {
+				return fmt.Errorf("go-temper: can't marshal variant name of %d bytes", len(v.Name))
+			}
+			buf.WriteByte(v.Weight)
+			binary.Write(buf, binary.LittleEndian, uint16(len(v.Name)))
+			buf.WriteString(v.Name)
+		}
+	}
+	return nil
+}
+
+// writeRollouts writes the number of rollouts, followed by each rollout
+// encoded the same way as the backend encodes them, sorted so that the same
+// filter always encodes the same way.
+func writeRollouts(buf *bytes.Buffer, rollouts map[uint64]uint8) {
+	entries := make([]uint64, 0, len(rollouts))
+	for high, rollout := range rollouts {
+		entries = append(entries, high|uint64(rollout))
+	}
+	slices.Sort(entries)
+
+	binary.Write(buf, binary.LittleEndian, uint32(len(entries)))
+	binary.Write(buf, binary.LittleEndian, entries)
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary.
+func UnmarshalBinary(data []byte) (*Filter, error) {
+	r := bytes.NewReader(data)
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("go-temper: data is not a filter snapshot")
+	}
+	version := header[len(snapshotMagic)]
+	if version < 1 || version > snapshotVersion {
+		return nil, fmt.Errorf("go-temper: unsupported filter snapshot version %d", version)
+	}
+	flags := header[len(snapshotMagic)+1]
+
+	var sizes [3]uint64
+	if err := binary.Read(r, binary.LittleEndian, &sizes); err != nil {
+		return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+	}
+	capacity := sizes[0]
+	if p, ok := nextPowerOf2(capacity); !ok {
+		return nil, fmt.Errorf("go-temper: filter snapshot of %d buckets is too large", capacity)
+	} else if capacity != 0 && p != uint(capacity) {
+		return nil, errors.New("go-temper: filter snapshot size must be a power of 2")
+	}
+
+	filter := &filter{
+		cap:   uint(capacity),
+		count: uint(sizes[1]),
+		full:  uint(sizes[2]),
+	}
+	if capacity > 0 {
+		filter.bucketIndexMask = uint(capacity - 1)
+	}
+	if flags&snapshotSHA256 != 0 {
+		filter.rolloutHash = RolloutHashSHA256
+	}
+
+	if flags&snapshotCompact != 0 {
+		n, err := readLen(r, 4+bytesPerBucket)
+		if err != nil {
+			return nil, err
+		}
+		filter.sparseIndexes = make([]uint32, n)
+		filter.sparseBuckets = make([]bucket, n)
+		if err := binary.Read(r, binary.LittleEndian, filter.sparseIndexes); err != nil {
+			return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+		}
+		if err := binary.Read(r, binary.LittleEndian, filter.sparseBuckets); err != nil {
+			return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+		}
+		for i, index := range filter.sparseIndexes {
+			if uint64(index) >= capacity || (i > 0 && index <= filter.sparseIndexes[i-1]) {
+				return nil, errors.New("go-temper: filter snapshot has invalid bucket indexes")
+			}
+		}
+	} else if capacity > 0 {
+		if capacity > uint64(r.Len()/bytesPerBucket) {
+			return nil, errors.New("go-temper: filter snapshot is truncated")
+		}
+		filter.buckets = make([]bucket, capacity)
+		if err := binary.Read(r, binary.LittleEndian, filter.buckets); err != nil {
+			return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+		}
+	}
+
+	var err error
+	if filter.rollouts, err = readRollouts(r); err != nil {
+		return nil, err
+	}
+	if filter.envRollouts, err = readRollouts(r); err != nil {
+		return nil, err
+	}
+
+	n, err := readLen(r, 8)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		killed := make([]uint64, n)
+		if err := binary.Read(r, binary.LittleEndian, killed); err != nil {
+			return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+		}
+		filter.killed = make(map[uint64]struct{}, n)
+		for _, h := range killed {
+			filter.killed[h] = struct{}{}
+		}
+	}
+
+	if version >= 2 {
+		if filter.variants, err = readVariants(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("go-temper: filter snapshot has %d unexpected trailing bytes", r.Len())
+	}
+
+	return &Filter{f: filter}, nil
+}
+
+// readLen reads the number of entries that follow, each of the given size,
+// and checks that there's enough data left for them.
+func readLen(r *bytes.Reader, size int) (int, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return 0, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+	}
+	if uint64(n) > uint64(r.Len()/size) {
+		return 0, errors.New("go-temper: filter snapshot is truncated")
+	}
+	return int(n), nil
+}
+
+// readRollouts reads rollouts written by writeRollouts.
+func readRollouts(r *bytes.Reader) (map[uint64]uint8, error) {
+	n, err := readLen(r, 8)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, n*8)
+	r.Read(data)
+	return decodeRollouts(data, 0)
+}
+
+// readVariants reads variants written by writeVariants.
+func readVariants(r *bytes.Reader) (map[uint64][]WeightedVariant, error) {
+	n, err := readLen(r, 9)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	variants := make(map[uint64][]WeightedVariant, n)
+	for range n {
+		var header struct {
+			High  uint64
+			Count uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+		}
+
+		vs := make([]WeightedVariant, header.Count)
+		for i := range vs {
+			var v struct {
+				Weight uint8
+				Len    uint16
+			}
+			if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+				return nil, fmt.Errorf("go-temper: failed to decode filter snapshot: %w", err)
+			}
+			if int(v.Len) > r.Len() {
+				return nil, errors.New("go-temper: filter snapshot is truncated")
+			}
+			name := make([]byte, v.Len)
+			r.Read(name)
+			vs[i] = WeightedVariant{Name: string(name), Weight: v.Weight}
+		}
+		variants[header.High] = vs
+	}
+
+	return variants, nil
+}
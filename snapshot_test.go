@@ -0,0 +1,183 @@
+package temper
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFilter_MarshalBinary(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+	fr.EnvRollouts = map[string][]byte{"staging": encodeRollouts(map[string]uint8{"env_feature": 40})}
+	fr.Killed = binary.LittleEndian.AppendUint64(nil, hash([]byte("killed_feature")))
+	fr.Variants = []FeatureVariants{{
+		Feature:  hash([]byte("temper_api_e2e_rollout")),
+		Variants: []WeightedVariant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}},
+	}}
+
+	keys := [][]byte{
+		[]byte("temper_api_e2e"),
+		[]byte("temper_api_e2e_rollout"),
+		[]byte("env_feature"),
+		[]byte("killed_feature"),
+	}
+	for i := range 100 {
+		for _, feature := range []string{"temper_api_e2e", "temper_api_e2e_rollout", "env_feature", "killed_feature", "unknown"} {
+			keys = append(keys, []byte(fmt.Sprintf("%s:user:%d", feature, i)))
+		}
+	}
+
+	for _, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%t", compact), func(t *testing.T) {
+			f, err := from(fr, &Option{Environment: "staging", CompactFilter: compact})
+			if err != nil {
+				t.Fatalf("failed to create filter from response: %v", err)
+			}
+
+			data, err := (&Filter{f: f}).MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal filter: %v", err)
+			}
+			got, err := UnmarshalBinary(data)
+			if err != nil {
+				t.Fatalf("failed to unmarshal filter: %v", err)
+			}
+
+			for _, key := range keys {
+				if want, v := f.lookup(key), got.f.lookup(key); v != want {
+					t.Errorf("expected %s to be %v but got %v", key, want, v)
+				}
+				if want, v := f.lookupGlobal(key), got.f.lookupGlobal(key); v != want {
+					t.Errorf("expected global %s to be %v but got %v", key, want, v)
+				}
+				if want, v := f.variant(key), got.f.variant(key); v != want {
+					t.Errorf("expected %s to be variant %q but got %q", key, want, v)
+				}
+			}
+			if f.stats() != got.f.stats() {
+				t.Errorf("expected stats %+v but got %+v", f.stats(), got.f.stats())
+			}
+
+			again, err := got.MarshalBinary()
+			if err != nil {
+				t.Fatalf("failed to marshal filter: %v", err)
+			}
+			if string(again) != string(data) {
+				t.Error("expected the same filter to marshal the same way every time")
+			}
+
+			for _, n := range []int{0, 5, len(data) - 1} {
+				if _, err := UnmarshalBinary(data[:n]); err == nil {
+					t.Errorf("expected an error unmarshalling %d of %d bytes", n, len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestClient_InitialFilter(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	data, err := newTestClient(t, "FAKE_SECRET", nil).CurrentFilter().MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal filter: %v", err)
+	}
+	f, err := UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal filter: %v", err)
+	}
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, InitialFilter: f})
+	if err := c.initialFetch(context.Background()); err != nil {
+		t.Fatalf("expected no error with an initial filter but got %v", err)
+	}
+	if err := c.Ready(context.Background()); err != nil {
+		t.Fatalf("expected the client to be ready but got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no requests to the backend but got %d", requests)
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+}
+
+func TestClient_FallbackFilter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	fallback := newTestClient(t, "FAKE_SECRET", nil).CurrentFilter()
+
+	c := newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, FallbackFilter: fallback, Logger: &recordingLogger{}})
+	if err := c.initialFetch(context.Background()); err == nil {
+		t.Fatal("expected an error fetching from an unavailable backend")
+	}
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true with the fallback filter but got %v", v)
+	}
+
+	c = newClient("FAKE_KEY", "FAKE_SECRET", &Option{BaseURL: srv.URL, Logger: &recordingLogger{}})
+	c.initialFetch(context.Background())
+	if v := c.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false without a fallback filter but got %v", v)
+	}
+}
+
+func TestFilter_Validate(t *testing.T) {
+	fr := &FilterResponse{}
+	if err := json.Unmarshal(testFilterResp, fr); err != nil {
+		t.Fatalf("failed to decode json: %v", err)
+	}
+
+	for _, compact := range []bool{false, true} {
+		f, err := from(fr, &Option{CompactFilter: compact})
+		if err != nil {
+			t.Fatalf("failed to create filter from response: %v", err)
+		}
+		if err := (&Filter{f: f}).Validate(); err != nil {
+			t.Errorf("expected a valid filter with compact=%t but got %v", compact, err)
+		}
+	}
+
+	f, err := from(&FilterResponse{
+		Filter:  fr.Filter,
+		Rollout: encodeRollouts(map[string]uint8{"over": 150, "fine": 100}),
+	})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	f.count++
+	f.variants = map[uint64][]WeightedVariant{1: {{Name: "a", Weight: 60}, {Name: "b", Weight: 60}}}
+
+	err = (&Filter{f: f}).Validate()
+	if err == nil {
+		t.Fatal("expected an invalid filter")
+	}
+	for _, want := range []string{"count of", "150%", "add up to 120"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q but got %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "power of 2") {
+		t.Errorf("expected only the broken invariants to be reported but got %v", err)
+	}
+
+	if err := (&Filter{}).Validate(); err == nil {
+		t.Error("expected an error validating a nil filter")
+	}
+}
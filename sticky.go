@@ -0,0 +1,136 @@
+package temper
+
+import (
+	"sync"
+	"time"
+)
+
+// A StickyStore remembers the results of rollout evaluations, so that an
+// actor keeps the result they were first given, even as the rollout
+// percentage changes. Results are stored under the fully qualified key, which
+// is followed by a NUL byte and the seed when the key was checked with a seed
+// or the RolloutSalt option, and by a NUL byte and the rollout hash when it
+// isn't fnv-1a.
+type StickyStore interface {
+	// Get returns the stored result for the key, when it expires, and
+	// whether there's a result stored. A zero expiry never expires.
+	Get(key string) (enabled bool, expires time.Time, ok bool)
+
+	// Set stores the result for the key until it expires. A zero expiry
+	// never expires.
+	Set(key string, enabled bool, expires time.Time)
+}
+
+// MemoryStickyStore is a StickyStore that keeps results in memory, so they
+// only last as long as the process. The zero value is ready to use.
+//
+// Expired results are deleted when they're read, and swept whenever the
+// number of results doubles, but results that never expire are kept for as
+// long as the process runs. Since keys include the seed and RolloutSalt, the
+// store grows with every new salt, so a StickyTTL should be set for features
+// checked with a salt that changes, such as a daily one.
+type MemoryStickyStore struct {
+	mu      sync.RWMutex
+	entries map[string]stickyEntry
+
+	// nextSweep is the number of entries at which expired entries are next
+	// swept by Set.
+	nextSweep int
+}
+
+// minStickySweep is the fewest entries a MemoryStickyStore sweeps at.
+const minStickySweep = 1024
+
+type stickyEntry struct {
+	enabled bool
+	expires time.Time
+}
+
+// expired returns true if the entry has an expiry that's passed.
+func (e stickyEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// Get returns the stored result for the key, deleting it if it's expired.
+func (s *MemoryStickyStore) Get(key string) (bool, time.Time, bool) {
+	s.mu.RLock()
+	e, ok := s.entries[key]
+	s.mu.RUnlock()
+
+	if ok && e.expired(time.Now()) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// The entry may have been set again since it was read.
+		if e, ok := s.entries[key]; ok && e.expired(time.Now()) {
+			delete(s.entries, key)
+		}
+		return false, time.Time{}, false
+	}
+	return e.enabled, e.expires, ok
+}
+
+// Set stores the result for the key.
+func (s *MemoryStickyStore) Set(key string, enabled bool, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[string]stickyEntry)
+	}
+	s.entries[key] = stickyEntry{enabled: enabled, expires: expires}
+
+	if len(s.entries) >= max(s.nextSweep, minStickySweep) {
+		now := time.Now()
+		for k, e := range s.entries {
+			if e.expired(now) {
+				delete(s.entries, k)
+			}
+		}
+		s.nextSweep = 2 * len(s.entries)
+	}
+}
+
+// stickyKey returns the key that the result for data is stored under, which
+// is data itself, followed by the seed and the rollout hash when they're set,
+// so that a result is never reused for a different seed or hash.
+func stickyKey(f *filter, data, seed []byte) string {
+	key := string(data)
+	if len(seed) > 0 {
+		key += "\x00" + string(seed)
+	}
+	if f.rolloutHash != "" {
+		key += "\x00" + f.rolloutHash
+	}
+	return key
+}
+
+// lookupSticky looks up a key the same way as lookupSeeded, except that the
+// result for a key of a feature with a rollout is taken from the sticky store
+// when it has one that hasn't expired, and is stored otherwise, expiring
+// after the feature's StickyTTL option.
+func (c *Client) lookupSticky(f *filter, data, seed []byte) bool {
+	hfeat := hash(featureSegment(data))
+	if len(f.killed) > 0 && f.isKilled(hfeat) {
+		return false
+	}
+	if _, ok := f.rollout(rolloutKey(hfeat)); !ok {
+		return f.lookupSeeded(data, seed)
+	}
+
+	key := stickyKey(f, data, seed)
+	now := time.Now()
+	if enabled, expires, ok := c.opt.StickyStore.Get(key); ok && (expires.IsZero() || now.Before(expires)) {
+		return enabled
+	}
+
+	enabled := f.lookupSeeded(data, seed)
+
+	var expires time.Time
+	if ttl := c.opt.StickyTTL[string(featureSegment(data))]; ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	c.opt.StickyStore.Set(key, enabled, expires)
+
+	return enabled
+}
@@ -0,0 +1,149 @@
+package temper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClientCheck_Sticky(t *testing.T) {
+	store := &MemoryStickyStore{}
+	c := newTestClient(t, "FAKE_SECRET", &Option{
+		StickyStore: store,
+		StickyTTL:   map[string]time.Duration{"session": time.Hour},
+	})
+
+	setRollouts := func(rollouts map[string]uint8) {
+		t.Helper()
+		f, err := from(&FilterResponse{Rollout: encodeRollouts(rollouts)})
+		if err != nil {
+			t.Fatalf("failed to create filter from response: %v", err)
+		}
+		c.filter.Store(f)
+	}
+
+	setRollouts(map[string]uint8{"permanent": 100, "session": 100})
+	for _, key := range []string{"permanent:user:1", "session:user:1"} {
+		if v := c.Check(key); !v {
+			t.Fatalf("expected %s to be true but got %v", key, v)
+		}
+	}
+
+	_, expires, _ := store.Get("permanent:user:1")
+	if !expires.IsZero() {
+		t.Errorf("expected permanent:user:1 to never expire but got %s", expires)
+	}
+	_, expires, _ = store.Get("session:user:1")
+	if d := time.Until(expires); d <= 0 || d > time.Hour {
+		t.Errorf("expected session:user:1 to expire in an hour but got %s", expires)
+	}
+
+	// Rolling back doesn't affect actors that have already been evaluated.
+	setRollouts(map[string]uint8{"permanent": 0, "session": 0})
+	for _, key := range []string{"permanent:user:1", "session:user:1"} {
+		if v := c.Check(key); !v {
+			t.Errorf("expected %s to stay true but got %v", key, v)
+		}
+	}
+	if v := c.Check("permanent:user:2"); v {
+		t.Errorf("expected permanent:user:2 to be false but got %v", v)
+	}
+
+	// Once the result expires, the actor is evaluated again.
+	store.Set("session:user:1", true, time.Now().Add(-time.Second))
+	if v := c.Check("session:user:1"); v {
+		t.Errorf("expected session:user:1 to be evaluated again but got %v", v)
+	}
+}
+
+func TestClientCheck_StickyOnlyRollouts(t *testing.T) {
+	store := &MemoryStickyStore{}
+	c := newTestClient(t, "FAKE_SECRET", &Option{StickyStore: store})
+
+	if v := c.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	if _, _, ok := store.Get("temper_api_e2e:user:1"); ok {
+		t.Error("expected a feature without a rollout not to be stored")
+	}
+}
+
+func TestClientCheckAudited_Sticky(t *testing.T) {
+	c := newTestClient(t, "FAKE_SECRET", &Option{StickyStore: &MemoryStickyStore{}})
+
+	for _, tt := range []struct {
+		key    string
+		want   bool
+		reason string
+	}{
+		{"temper_api_e2e_rollout:user:3", true, "sticky"},
+		{"temper_api_e2e:user:1", true, "filter"},
+		{"unknown_feature:user:1", false, "no_match"},
+	} {
+		if r := c.CheckAudited(tt.key); r.Enabled != tt.want || r.Reason != tt.reason {
+			t.Errorf("expected %s to be %v with reason %q but got %+v", tt.key, tt.want, tt.reason, r)
+		}
+	}
+}
+
+func TestClientCheckSeeded_Sticky(t *testing.T) {
+	store := &MemoryStickyStore{}
+	c := newTestClient(t, "FAKE_SECRET", &Option{StickyStore: store})
+
+	f, err := from(&FilterResponse{Rollout: encodeRollouts(map[string]uint8{"seeded": 50})})
+	if err != nil {
+		t.Fatalf("failed to create filter from response: %v", err)
+	}
+	c.filter.Store(f)
+
+	// Find a key that's enabled under one seed but not the other.
+	var key string
+	for i := range 1000 {
+		k := fmt.Sprintf("seeded:user:%d", i)
+		if f.lookupSeeded([]byte(k), []byte("a")) && !f.lookupSeeded([]byte(k), []byte("b")) {
+			key = k
+			break
+		}
+	}
+	if key == "" {
+		t.Fatal("expected a key whose result depends on the seed")
+	}
+
+	if v := c.CheckSeeded(key, "a"); !v {
+		t.Errorf("expected %s to be true with seed a but got %v", key, v)
+	}
+	if v := c.CheckSeeded(key, "b"); v {
+		t.Errorf("expected %s to be false with seed b but got %v", key, v)
+	}
+	if _, _, ok := store.Get(key + "\x00a"); !ok {
+		t.Errorf("expected the result for seed a to be stored under its own key")
+	}
+	if _, _, ok := store.Get(key + "\x00b"); !ok {
+		t.Errorf("expected the result for seed b to be stored under its own key")
+	}
+}
+
+func TestMemoryStickyStore_Expired(t *testing.T) {
+	store := &MemoryStickyStore{}
+	past := time.Now().Add(-time.Second)
+
+	store.Set("expired", true, past)
+	if _, _, ok := store.Get("expired"); ok {
+		t.Error("expected an expired result not to be returned")
+	}
+	if n := len(store.entries); n != 0 {
+		t.Errorf("expected the expired result to be deleted but got %d entries", n)
+	}
+
+	// Results that are never read again are swept once the store grows.
+	store.Set("permanent", true, time.Time{})
+	for i := range minStickySweep {
+		store.Set(fmt.Sprintf("expired:%d", i), true, past)
+	}
+	if n := len(store.entries); n >= minStickySweep {
+		t.Errorf("expected the expired results to be swept but got %d entries", n)
+	}
+	if v, _, ok := store.Get("permanent"); !ok || !v {
+		t.Errorf("expected the result that never expires to be kept but got %v, %v", v, ok)
+	}
+}
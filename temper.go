@@ -1,12 +1,27 @@
 package temper
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,15 +30,86 @@ const (
 	Version = "0.0.6"
 
 	defaultBaseURL = "https://temperhq.com"
+
+	// defaultFilterPath is the path of the public filter endpoint.
+	defaultFilterPath = "/api/public/filter"
+
+	// defaultRefactorResultsPath is the path of the endpoint that refactor
+	// results are submitted to.
+	defaultRefactorResultsPath = "/api/refactors/results"
+
+	// environmentHeader is the response header that identifies the backend
+	// environment the filter was served from.
+	environmentHeader = "X-Temper-Env"
+
+	// featuresPath is the path of the endpoint that lists the names of every
+	// feature, which requires the secret key.
+	featuresPath = "/api/features"
+
+	// defaultPollInterval is how often the filter is fetched from the
+	// backend by default.
+	defaultPollInterval = 60 * time.Second
+
+	// defaultKeyCacheTTL is how long the keys returned by the key funcs are
+	// cached by default.
+	defaultKeyCacheTTL = time.Minute
+
+	// defaultMinPollInterval is the default floor for the poll interval,
+	// which protects the backend from a misconfigured client.
+	defaultMinPollInterval = 100 * time.Millisecond
+
+	// defaultMaxFilterBytes and defaultMaxRolloutEntries are far larger than
+	// any real filter, and only exist to protect against a runaway response.
+	defaultMaxFilterBytes    = 64 << 20
+	defaultMaxRolloutEntries = 1 << 20
+
+	// responseOverheadBytes is the room left in a filter response for
+	// everything other than the filter and rollout data, such as the JSON
+	// around them.
+	responseOverheadBytes = 1 << 20
+
+	// defaultMaxDecodeFailures is how many polls in a row can fail to decode
+	// the filter before the client is unhealthy, which is 10 minutes with
+	// the default poll interval.
+	defaultMaxDecodeFailures = 10
+)
+
+// PreReadyBehavior controls what Check does before the filter has been
+// fetched successfully for the first time.
+type PreReadyBehavior int
+
+const (
+	// ReturnFalse evaluates features against whichever filter is installed,
+	// which is empty unless the FallbackFilter option is set, so every
+	// feature is disabled. It's the default.
+	ReturnFalse PreReadyBehavior = iota
+
+	// Block waits until the filter has been fetched, or until the
+	// PreReadyTimeout option has elapsed, if it's set.
+	Block
+
+	// ReturnDefault returns the value from the PreReadyDefaults option.
+	ReturnDefault
+)
+
+// Hashes for the RolloutHash option.
+const (
+	RolloutHashFNV    = "fnv1a"
+	RolloutHashSHA256 = "sha256"
 )
 
 var (
-	// c contains the one and only instance of client.
-	c *client
+	// c contains the one and only instance of Client, which the package level
+	// functions use, and current is the same client, for readers that run on
+	// other goroutines than the ones that initialize it, such as expvar.
+	c       *Client
+	current atomic.Pointer[Client]
 
-	// once is used to ensure the client instance is only ever initialized a
-	// single time throughout the calling program's lifetime.
-	once sync.Once
+	// initialized is true once the client has been initialized, until it's
+	// closed by Close, so that it's only initialized a single time, guarded
+	// by initMu.
+	initMu      sync.Mutex
+	initialized bool
 )
 
 // base are the base configuration options for the Temper API client.
@@ -32,10 +118,122 @@ type base struct {
 	baseURL string
 }
 
-// client is a Temper API client.
-type client struct {
+// A Client is a Temper API client. Most programs use the package level
+// functions, which use the client created by Init, rather than creating their
+// own.
+type Client struct {
 	base
-	filter *filter
+
+	// filter is the filter that features are checked against, which is
+	// swapped atomically when a new one is fetched, so that checks never
+	// take a lock.
+	filter atomic.Pointer[filter]
+
+	// devMode is true when no secret key was provided, which is how local
+	// development is distinguished from a production-like environment.
+	devMode bool
+	opt     *Option
+
+	// defaults are the local development defaults loaded from the
+	// DefaultsFile option.
+	defaults map[string]bool
+
+	// testOverrides are the keys enabled by the TestModeOverrides option,
+	// which is nil when a secret key is provided.
+	testOverrides map[string]struct{}
+
+	// caches are the lookup caches enabled by the options, which are
+	// registered when the client is created.
+	caches []cache
+
+	// negative is the cache of disabled keys enabled by the
+	// NegativeCacheTTL option.
+	negative *negativeCache
+
+	// scopes are the named filters configured by the Scopes option.
+	scopes map[string]*scope
+
+	// alwaysOn is the set of actors from the AlwaysOnActors option.
+	alwaysOn map[string]struct{}
+
+	// overrides are the forced values from the QA overrides service.
+	overrides atomic.Pointer[map[string]bool]
+
+	// ready is closed once the filter has been fetched successfully.
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// fetcher fetches the filter, which is the Fetcher option, or the
+	// filter endpoint over HTTP.
+	fetcher FilterFetcher
+
+	// tokens authenticates the requests to the backend.
+	tokens *tokenSource
+
+	// polling is true once polling has started, and paused is true while
+	// polling is paused by PausePolling.
+	polling atomic.Bool
+	paused  atomic.Bool
+
+	// stopPolling stops the poll goroutines started by startPolling, which
+	// are tracked by pollers, guarded by pollMu.
+	pollMu      sync.Mutex
+	stopPolling context.CancelFunc
+	pollers     sync.WaitGroup
+
+	// results are the refactor results queued for submission by
+	// submitRefactorResults, which runs while the client is polling.
+	results chan *addRefactorResultRequest
+
+	// updated is when the filter was last fetched successfully, in unix
+	// nanoseconds, or 0 if it's never been fetched.
+	updated atomic.Int64
+
+	// fetchSuccesses and fetchFailures are the number of fetches of the
+	// filter that succeeded and failed.
+	fetchSuccesses atomic.Int64
+	fetchFailures  atomic.Int64
+
+	// fetchFailuresInRow is the number of fetches of the filter in a row
+	// that failed.
+	fetchFailuresInRow atomic.Int64
+
+	// decodeFailures is the number of fetches in a row that received a
+	// filter that failed to decode.
+	decodeFailures atomic.Int64
+
+	// watchers are the callbacks registered with Watch, and watched are the
+	// results of the keys that are re-evaluated after every poll, both
+	// guarded by watchMu.
+	watchMu  sync.Mutex
+	watchers []*watcher
+	watched  map[string]*watchedResult
+}
+
+// A watcher is a callback for when the result of checking a key changes.
+type watcher struct {
+	key     string
+	fn      func(enabled bool)
+	enabled bool
+}
+
+// A watchedResult is the result of checking a watched key after the last
+// poll, and whether it differs from the result after the poll before it.
+type watchedResult struct {
+	enabled bool
+	changed bool
+}
+
+// A scope is a named filter that's fetched from its own endpoint, so that a
+// single client can evaluate features on behalf of many tenants.
+type scope struct {
+	path   string
+	filter atomic.Pointer[filter]
+}
+
+// A cache is a lookup cache that can be emptied by ClearCaches.
+type cache interface {
+	clear()
 }
 
 // Option contains all of the configuration options for the Temper API client.
@@ -43,28 +241,397 @@ type Option struct {
 	// The base URL of the Temper instance, defaults to https://temperhq.com.
 	BaseURL string
 
-	// Features that are overridden in local development. Changes made here should
+	// FilterPath is the path of the filter endpoint, relative to BaseURL,
+	// defaults to /api/public/filter. It's always authenticated with the
+	// publishable key, so the backend can be served from behind a reverse
+	// proxy with its own path layout.
+	FilterPath string
+
+	// RefactorResultsPath is the path of the endpoint that refactor results
+	// are submitted to, relative to BaseURL, defaults to
+	// /api/refactors/results. It's authenticated with the secret key.
+	// Results are submitted one at a time while the client is polling, and
+	// dropped when too many are waiting to be submitted.
+	RefactorResultsPath string
+
+	// SubmitRefactorMatches, if true, submits the results of refactor runs
+	// that matched to the backend too, rather than only the mismatches.
+	SubmitRefactorMatches bool
+
+	// Environment selects the environment specific rollout percentages sent
+	// by the backend, for example "staging". Features without a rollout for
+	// the environment fall back to their default rollout percentage.
+	Environment string
+
+	// ExpectedEnvironment, if set, is the environment the backend must
+	// identify itself as, for example "production". A filter served by any
+	// other environment is rejected, which catches a client that's been
+	// pointed at the wrong backend by mistake, since InitAndWait returns the
+	// error.
+	ExpectedEnvironment string
+
+	// RolloutHash selects the hash that full keys are compared against
+	// rollout percentages with, either RolloutHashFNV, the default, or
+	// RolloutHashSHA256, which is better distributed for small percentages.
+	// Since the backend has to compute percentages the same way, a hash
+	// other than the default is only used once the backend reports that it
+	// uses it too. The filter itself always uses fnv-1a.
+	RolloutHash string
+
+	// RolloutSalt, if set, is called on every check of a fully qualified
+	// key, and the salt it returns is mixed into the hash that decides
+	// whether the key falls within a percentage rollout, the same way as the
+	// seed passed to CheckSeeded. Returning the current date re-randomizes
+	// which actors are enabled each day, for experiments with a fresh
+	// holdout every day. Actors enabled explicitly, and variants, are
+	// unaffected by the salt.
+	RolloutSalt func() string
+
+	// Keys that are enabled in local development. Changes made here should
 	// never be checked in, but just in case they are, the values here are
 	// ignored when an API key is provided, preventing accidental overrides in
 	// a production-like environment.
 	TestModeOverrides map[string]struct{}
+
+	// InsertRand, if set, chooses which entries are evicted to make room
+	// when a filter is built locally by InitFromMap or NewFilterFromMap,
+	// overriding the source with a fixed seed that's used otherwise, so
+	// filters built from the same keys are byte for byte identical either
+	// way, for example, for test fixtures. It's not safe to build filters
+	// with the same source concurrently.
+	InsertRand *rand.Rand
+
+	// NegativeCacheTTL, if greater than 0, caches the keys that Check finds
+	// disabled for up to this long, so that checking them again skips
+	// hashing them and looking them up in the filter, which speeds up guard
+	// clauses for features that are almost always off. Overrides and local
+	// defaults are still checked first, and the cache is emptied whenever a
+	// new filter is installed, so a cached result is never staler than the
+	// filter. The TTL only bounds how long a rarely checked key stays
+	// cached. Keys checked with a seed, or while the StickyStore or
+	// RolloutSalt options are set, are never cached.
+	NegativeCacheTTL time.Duration
+
+	// AlwaysOnActors are actors that every feature is enabled for, such as
+	// internal staff, regardless of rollout percentages and the filter. Each
+	// is the actor segment of a fully qualified key, which is everything
+	// after the feature, for example, "user:42". It's a deliberate targeting
+	// rule applied by every check of a fully qualified key, not a debugging
+	// aid, so it applies with a secret key too. Killed features are still
+	// disabled for these actors, and overrides and local defaults still take
+	// precedence.
+	AlwaysOnActors []string
+
+	// Parent is a client that checks of fully qualified keys are delegated
+	// to when this client's filter has no data for their feature, as
+	// reported by FeatureKnown, so that, for example, each tenant's client
+	// inherits the global features from a shared client. A feature that's
+	// disabled or killed in this client's filter isn't delegated. Every
+	// check delegates, except for CheckCtx with a filter from
+	// ContextWithFilter, which only ever uses that filter, and CheckIn,
+	// which only ever uses its scope's filter.
+	Parent *Client
+
+	// OverridesURL is the URL of a QA overrides service, which returns a
+	// JSON object that maps features to forced values for the current test
+	// session. When it's set, the overrides are polled alongside the filter,
+	// and take precedence over every other way a feature is evaluated. It's
+	// authenticated with the publishable key, and is off unless it's set.
+	OverridesURL string
+
+	// InitialFilter, if set, is used to evaluate features from the moment
+	// the client is initialized, instead of fetching the filter first, such
+	// as a filter handed off by the process being replaced during a restart.
+	// The filter is still refreshed by polling.
+	InitialFilter *Filter
+
+	// FallbackFilter, if set, is used instead of an empty filter when the
+	// first fetch of the filter fails, so that a curated baseline set of
+	// features stays enabled rather than every feature being disabled until
+	// the next successful poll.
+	FallbackFilter *Filter
+
+	// PreReadyBehavior controls what Check does before the filter has been
+	// fetched successfully for the first time, defaults to ReturnFalse.
+	PreReadyBehavior PreReadyBehavior
+
+	// PreReadyTimeout is the longest Check blocks for when PreReadyBehavior
+	// is Block, after which the feature is evaluated as if PreReadyBehavior
+	// were ReturnFalse. Check blocks until the filter is fetched when it's 0.
+	PreReadyTimeout time.Duration
+
+	// PreReadyDefaults are the values returned by Check when
+	// PreReadyBehavior is ReturnDefault, keyed the same way as the defaults
+	// in the DefaultsFile option. Features without a value are false.
+	PreReadyDefaults map[string]bool
+
+	// StickyStore, if set, enables sticky rollouts, where the result of
+	// checking a key of a feature with a percentage rollout is stored the
+	// first time it's checked, and reused for later checks, so that changes
+	// to the percentage don't flip actors that have already been evaluated.
+	StickyStore StickyStore
+
+	// StickyTTL sets how long stored results last for each feature, after
+	// which actors are evaluated against the current percentage again.
+	// Results for features without a TTL never expire. It's only used when
+	// StickyStore is set.
+	StickyTTL map[string]time.Duration
+
+	// DefaultsFile is the path to a JSON file containing an object that maps
+	// features to whether they're enabled, which is loaded by Init and takes
+	// precedence over the filter. It lets developers share a set of sensible
+	// defaults for local development without a backend. Like
+	// TestModeOverrides, it is ignored when a secret key is provided.
+	DefaultsFile string
+
+	// StrictUnknownFeatures makes Check panic when it's asked about a feature
+	// that the filter has no data for, so that a typo in a feature name fails
+	// loudly instead of silently returning false. Like TestModeOverrides, it
+	// is ignored when a secret key is provided.
+	//
+	// A feature is only known for every actor when it has a rollout entry,
+	// variants, or is killed. The filter only holds hashes of fully
+	// qualified keys, so a feature that's only enabled for specific actors
+	// is unknown when it's checked for any other actor. Such features need
+	// a rollout entry, even of 0%, to be used with this option.
+	StrictUnknownFeatures bool
+
+	// UnknownFeatureHandler, if set, is called instead of panicking when
+	// StrictUnknownFeatures is enabled and an unknown feature is checked.
+	UnknownFeatureHandler func(feature string)
+
+	// MaxFilterBytes is the largest encoded filter that will be decoded,
+	// defaults to 64 MiB. Together with MaxRolloutEntries, it also limits
+	// how much of a filter response is read before it's rejected.
+	MaxFilterBytes int
+
+	// MaxRolloutEntries is the largest number of rollout entries that will be
+	// decoded, defaults to 1048576.
+	MaxRolloutEntries int
+
+	// MaxDecodeFailures is how many fetches in a row can receive a filter
+	// that fails to decode before Healthy returns false, defaults to 10. The
+	// last good filter is still used regardless.
+	MaxDecodeFailures int
+
+	// MaxFilterAge, if set, is how long after the last successful fetch of
+	// the filter its data is trusted. Once the filter is older than this,
+	// Check fails closed, returning false for every feature regardless of
+	// the filter's contents, until a fetch succeeds again. Overrides and
+	// local defaults still apply. Since a filter from the InitialFilter or
+	// FallbackFilter option wasn't fetched, it isn't trusted either. It's
+	// off by default, since most features are better served stale than off.
+	MaxFilterAge time.Duration
+
+	// Scopes maps the names of scopes to the paths of the endpoints their
+	// filters are fetched from, for example, "/api/public/filter?tenant=1".
+	// Each scope's filter is polled independently, and its features are
+	// looked up with CheckIn.
+	Scopes map[string]string
+
+	// CompactFilter stores only the non-empty buckets of the filter, which
+	// uses significantly less memory for sparse filters at a small cost to
+	// the speed of each lookup. Useful for hosts with tight memory budgets.
+	// Filters with too few empty buckets to save memory are kept as is.
+	CompactFilter bool
+
+	// RolloutOnly skips decoding the filter itself, and only keeps the
+	// rollout data, which saves the memory of the filter for services that
+	// only use percentage rollouts. Features enabled for specific actors are
+	// always false.
+	RolloutOnly bool
+
+	// PollInterval is how often the filter is fetched from the backend,
+	// defaults to 60 seconds when it's 0 or negative. Sub-second intervals,
+	// like 500ms for a low-latency environment, are honored down to
+	// MinPollInterval, below which it's clamped up, which is logged.
+	PollInterval time.Duration
+
+	// MinPollInterval is the floor for PollInterval, defaults to 100ms,
+	// which only guards against intervals so short they'd hammer the
+	// backend.
+	MinPollInterval time.Duration
+
+	// LogInterval rate-limits the logging of failed polls. When it's set,
+	// the first failure is logged, then at most one failure per interval
+	// until a poll succeeds again, which is also logged. Every failure is
+	// logged when it's 0.
+	LogInterval time.Duration
+
+	// OnFetch, if set, is called after every attempt to fetch the filter,
+	// whether it succeeds or fails, with how long the attempt took, the
+	// number of bytes downloaded, and the HTTP status code of the response.
+	// The status code is 0 if no response was received.
+	OnFetch func(duration time.Duration, bytes int, status int)
+
+	// OnFetchTrace, if set, is called after every attempt to fetch the
+	// filter that got a connection, with a trace of how the connection was
+	// established. Useful for verifying that connections are reused across
+	// polls.
+	OnFetchTrace func(trace FetchTrace)
+
+	// OnRefactor, if set, is called after every run of a refactor whose
+	// results were compared by Refactor, RefactorErr, RefactorWith, or
+	// RefactorCtx, with the refactor's name, whether the results matched, and
+	// how long the old and new functions took. Refactors that are ShadowOnly
+	// aren't reported.
+	OnRefactor func(name string, matched bool, olddur, newdur time.Duration)
+
+	// OnAudit, if set, is called with the result of every check made with
+	// CheckAudited, for example, to write it to an audit log.
+	OnAudit func(result AuditResult)
+
+	// Fetcher, if set, fetches the filter instead of the filter endpoint,
+	// for example, over gRPC from an internal control plane. The filters for
+	// scopes are still fetched over HTTP, and OnFetch and OnFetchTrace are
+	// only called for fetches over HTTP.
+	Fetcher FilterFetcher
+
+	// SecretKeyFunc, if set, is called to get the secret key instead of
+	// using the one passed to Init, for example, to read it from a file that
+	// rotates, or from a secret manager, without a restart. The key it
+	// returns is cached for KeyCacheTTL, and a request fails if it returns an
+	// error. SecretKeyFromFile returns a func that reads the key from a file.
+	SecretKeyFunc func() (string, error)
+
+	// PublishableKeyFunc is like SecretKeyFunc, but for the publishable key.
+	PublishableKeyFunc func() (string, error)
+
+	// KeyCacheTTL is how long the keys returned by SecretKeyFunc and
+	// PublishableKeyFunc are cached, defaults to 1 minute.
+	KeyCacheTTL time.Duration
+
+	// HTTPClient, if set, is the client that requests to the backend are
+	// sent with, for example, to go through a proxy, use custom TLS, or set
+	// a timeout. Its transport, or http.DefaultTransport if it has none, is
+	// wrapped to authenticate requests with the bearer token. The client
+	// itself isn't modified.
+	HTTPClient *http.Client
+
+	// TransportWrapper, if set, wraps the transport that requests to the
+	// backend are sent with, after they've been authenticated with the
+	// bearer token, for example, to sign them for an API gateway in front of
+	// the backend. It's called once, with the transport of the HTTPClient
+	// option, or http.DefaultTransport.
+	TransportWrapper func(base http.RoundTripper) http.RoundTripper
+
+	// Logger receives the client's log messages, defaults to the standard
+	// logger from the log package.
+	Logger Logger
+
+	// Debug enables debug logging, such as logging the effective
+	// configuration when the client is initialized, and warning about
+	// features whose entries collide in the rollout data.
+	Debug bool
+
+	// Expvar publishes the metrics of the client initialized by Init with
+	// the expvar package, under the name "temper", so that they're served
+	// from /debug/vars. They're always the metrics of the current client
+	// initialized by Init, even when it's closed and initialized again, and
+	// never those of clients created by NewClient.
+	Expvar bool
+}
+
+// A Logger logs messages from the Temper API client. A *log.Logger is a
+// Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// maxResponseBytes is the most of a filter response that's read, which is
+// room for the base64 encoding of the largest filter and rollout data that
+// will be decoded, twice over, for the environment rollouts, killed features,
+// and variants, and responseOverheadBytes.
+func (o *Option) maxResponseBytes() int64 {
+	data := o.MaxFilterBytes + 8*o.MaxRolloutEntries
+	return 2*int64(base64.StdEncoding.EncodedLen(data)) + responseOverheadBytes
 }
 
 func (o *Option) setDefaults() {
 	if o.BaseURL == "" {
 		o.BaseURL = defaultBaseURL
 	}
+	if o.FilterPath == "" {
+		o.FilterPath = defaultFilterPath
+	}
+	if o.RefactorResultsPath == "" {
+		o.RefactorResultsPath = defaultRefactorResultsPath
+	}
+	if o.MaxFilterBytes <= 0 {
+		o.MaxFilterBytes = defaultMaxFilterBytes
+	}
+	if o.MaxRolloutEntries <= 0 {
+		o.MaxRolloutEntries = defaultMaxRolloutEntries
+	}
+	if o.MaxDecodeFailures <= 0 {
+		o.MaxDecodeFailures = defaultMaxDecodeFailures
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	if o.MinPollInterval <= 0 {
+		o.MinPollInterval = defaultMinPollInterval
+	}
+	if o.KeyCacheTTL <= 0 {
+		o.KeyCacheTTL = defaultKeyCacheTTL
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaultPollInterval
+	}
+	if o.PollInterval < o.MinPollInterval {
+		o.Logger.Printf("go-temper: poll interval %s is below the minimum of %s, using %s", o.PollInterval, o.MinPollInterval, o.MinPollInterval)
+		o.PollInterval = o.MinPollInterval
+	}
 }
 
 type tokenSource struct {
 	publishableKey string
 	secretKey      string
 	base           http.RoundTripper
+
+	// publishableKeyFunc and secretKeyFunc, if set, get the keys instead of
+	// publishableKey and secretKey.
+	publishableKeyFunc *keyFunc
+	secretKeyFunc      *keyFunc
+
+	// publicEndpoints are the hosts and paths, outside of the public API,
+	// that are authenticated with the publishable key.
+	publicEndpoints []string
+}
+
+// publicPathPrefix is the path of the public API, whose endpoints are
+// authenticated with the publishable key.
+const publicPathPrefix = "/api/public"
+
+// IsPublicPath returns true if requests to the given path of the Temper API
+// are authenticated with the publishable key, and false if they're
+// authenticated with the secret key. Only the public API, which is the path
+// /api/public and everything beneath it, uses the publishable key. The
+// overrides service configured by the OverridesURL option also uses the
+// publishable key, regardless of its path.
+func IsPublicPath(p string) bool {
+	p = path.Clean("/" + p)
+	return p == publicPathPrefix || strings.HasPrefix(p, publicPathPrefix+"/")
+}
+
+// isPublic returns true if requests to u are authenticated with the
+// publishable key.
+func (ts *tokenSource) isPublic(u *url.URL) bool {
+	if IsPublicPath(u.Path) {
+		return true
+	}
+
+	for _, endpoint := range ts.publicEndpoints {
+		if u.Host+u.Path == endpoint {
+			return true
+		}
+	}
+	return false
 }
 
 // RoundTrip authorizes and authenticates the request with a publishable key
-// when accessing the public filter API endpoint, and the secret key for all
-// other endpoints.
+// when accessing the public filter API endpoint or the overrides service, and
+// the secret key for all other endpoints.
 func (ts *tokenSource) RoundTrip(req *http.Request) (*http.Response, error) {
 	reqBodyClosed := false
 	if req.Body != nil {
@@ -75,18 +642,78 @@ func (ts *tokenSource) RoundTrip(req *http.Request) (*http.Response, error) {
 		}()
 	}
 
-	req2 := cloneRequest(req) // per RoundTripper contract
-	if strings.HasPrefix(req2.URL.Path, "/api/public") {
-		req2.Header.Set("Authorization", "Bearer "+ts.publishableKey)
+	var key string
+	var err error
+	if ts.isPublic(req.URL) {
+		key, err = ts.publishableKeyFunc.get(ts.publishableKey)
 	} else {
-		req2.Header.Set("Authorization", "Bearer "+ts.secretKey)
+		key, err = ts.secretKeyFunc.get(ts.secretKey)
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	req2 := cloneRequest(req) // per RoundTripper contract
+	req2.Header.Set("Authorization", "Bearer "+key)
+
 	// req.Body is assumed to be closed by the base RoundTripper.
 	reqBodyClosed = true
 	return ts.base.RoundTrip(req2)
 }
 
+// A keyFunc caches the key returned by a func for a while, so that it isn't
+// called for every request, while a rotated key is still picked up.
+type keyFunc struct {
+	name string
+	fn   func() (string, error)
+	ttl  time.Duration
+
+	// key is the cached key, which is used until expires, guarded by mu.
+	mu      sync.Mutex
+	key     string
+	expires time.Time
+}
+
+// get returns the cached key, calling the func to get it again once it's
+// expired. It returns static if kf is nil.
+func (kf *keyFunc) get(static string) (string, error) {
+	if kf == nil {
+		return static, nil
+	}
+
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	now := time.Now()
+	if kf.key != "" && now.Before(kf.expires) {
+		return kf.key, nil
+	}
+
+	key, err := kf.fn()
+	if err != nil {
+		return "", fmt.Errorf("go-temper: failed to get %s key: %w", kf.name, err)
+	}
+	key = strings.Trim(strings.TrimSpace(key), "'")
+	if key == "" {
+		return "", fmt.Errorf("go-temper: failed to get %s key: key is empty", kf.name)
+	}
+	kf.key, kf.expires = key, now.Add(kf.ttl)
+	return key, nil
+}
+
+// SecretKeyFromFile returns a func for the SecretKeyFunc or
+// PublishableKeyFunc options that reads the key from the file at path, such
+// as a secret mounted into a container, every time it's called.
+func SecretKeyFromFile(path string) func() (string, error) {
+	return func() (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
 // cloneRequest returns a clone of the provided *http.Request.
 // The clone is a shallow copy of the struct and its Header map.
 func cloneRequest(r *http.Request) *http.Request {
@@ -104,87 +731,1823 @@ func cloneRequest(r *http.Request) *http.Request {
 // Init initializes the Temper API client library using the given keys and
 // optional configuration options.
 func Init(publishableKey, secretKey string, opts ...*Option) {
-	once.Do(func() {
-		publishableKey = strings.Trim(strings.TrimSpace(publishableKey), "'")
-		if publishableKey == "" {
-			log.Fatalln("go-temper: publishable key cannot be empty")
-		}
-		secretKey = strings.Trim(strings.TrimSpace(secretKey), "'")
+	initialize(func() {
+		setClient(newClient(publishableKey, secretKey, opts...))
+		c.initialFetch(context.Background())
+		c.startPolling()
+	})
+}
 
-		ts := &tokenSource{
-			publishableKey: publishableKey,
-			secretKey:      secretKey,
-			base:           http.DefaultTransport,
-		}
+// initialize calls fn to initialize the client with initMu held, unless it's
+// already been initialized, and returns whether fn was called.
+func initialize(fn func()) bool {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if initialized {
+		return false
+	}
+	initialized = true
+	fn()
+	return true
+}
+
+// setClient sets the client that the package level functions use.
+func setClient(client *Client) {
+	c = client
+	current.Store(client)
+}
+
+// NewClient creates a client with its own filter and polling, independent of
+// the client created by Init, for example, to talk to two Temper instances
+// from the same program. Like Init, it fetches the filter before returning,
+// and a failed fetch is logged and retried in the background, which Ready
+// can wait for. An error is only returned when the publishable key is empty
+// and the PublishableKeyFunc option isn't set. The client must be closed with
+// Close to stop polling.
+func NewClient(publishableKey, secretKey string, opts ...*Option) (*Client, error) {
+	if strings.Trim(strings.TrimSpace(publishableKey), "'") == "" && publishableKeyFunc(opts) == nil {
+		return nil, errors.New("go-temper: publishable key cannot be empty")
+	}
+
+	client := newClient(publishableKey, secretKey, opts...)
+	client.initialFetch(context.Background())
+	client.startPolling()
+	return client, nil
+}
+
+// offlineKey is the publishable key of a client that's initialized from data
+// that's already available, and never makes requests to the backend.
+const offlineKey = "offline"
+
+// InitFromBase64 initializes the Temper API client library from the base64
+// encoded filter and rollout data, as served by the backend, without making
+// any requests to the backend, and without polling. Either string can also be
+// a base64 data URI, and an empty string leaves its data empty. It's useful
+// for using a snapshot of a filter injected through an environment variable
+// in an environment without network access.
+//
+// An error is returned if the data can't be decoded, or if the client has
+// already been initialized, in which case the client isn't initialized.
+func InitFromBase64(filterB64, rolloutB64 string, opts ...*Option) error {
+	client, err := newClientFromBase64(filterB64, rolloutB64, opts...)
+	if err != nil {
+		return err
+	}
+
+	if !initialize(func() { setClient(client) }) {
+		return errAlreadyInitialized
+	}
+	return nil
+}
+
+// errAlreadyInitialized is returned when initializing the client after it's
+// already been initialized, for example, by Init.
+var errAlreadyInitialized = errors.New("go-temper: client is already initialized")
+
+// newClientFromBase64 creates a Temper API client that never makes requests
+// to the backend, with its filter decoded from the given base64 data.
+func newClientFromBase64(filterB64, rolloutB64 string, opts ...*Option) (*Client, error) {
+	fr := &FilterResponse{}
+	var err error
+	if fr.Filter, err = decodeBase64(filterB64); err != nil {
+		return nil, fmt.Errorf("go-temper: failed to decode filter: %w", err)
+	}
+	if fr.Rollout, err = decodeBase64(rolloutB64); err != nil {
+		return nil, fmt.Errorf("go-temper: failed to decode rollout data: %w", err)
+	}
+
+	c := newClient(offlineKey, "", opts...)
+	f, err := from(fr, c.opt)
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: failed to create filter from data: %w", err)
+	}
+	c.filter.Store(f)
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+
+	return c, nil
+}
+
+// InitFromMap initializes the Temper API client library with the given state
+// of every feature, without making any requests to the backend, and without
+// polling, so that Check behaves exactly as if the backend had sent that
+// state. The keys of enabled are fully qualified keys, such as
+// `feature:user:1`, that are added to the filter when they're true, and the
+// keys of rollouts are features, such as `feature`, with their rollout
+// percentages. It's the simplest way to set up the client in tests.
+//
+// An error is returned if a rollout percentage is over 100, or if the client
+// has already been initialized, in which case the client isn't initialized.
+func InitFromMap(enabled map[string]bool, rollouts map[string]uint8, opts ...*Option) error {
+	client, err := newClientFromMap(enabled, rollouts, opts...)
+	if err != nil {
+		return err
+	}
+
+	if !initialize(func() { setClient(client) }) {
+		return errAlreadyInitialized
+	}
+	return nil
+}
+
+// newClientFromMap creates a Temper API client that never makes requests to
+// the backend, with its filter built from the given state.
+func newClientFromMap(enabled map[string]bool, rollouts map[string]uint8, opts ...*Option) (*Client, error) {
+	f, err := filterFromMap(enabled, rollouts, insertRand(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(offlineKey, "", opts...)
+	if c.opt.CompactFilter {
+		f.compact()
+	}
+	c.filter.Store(f)
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+
+	return c, nil
+}
+
+// NewFilterFromMap builds a filter from the given state the same way as
+// InitFromMap, for example, to attach to a context with ContextWithFilter.
+// Only the InsertRand option is used.
+func NewFilterFromMap(enabled map[string]bool, rollouts map[string]uint8, opts ...*Option) (*Filter, error) {
+	f, err := filterFromMap(enabled, rollouts, insertRand(opts))
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{f: f}, nil
+}
 
-		httpClient := &http.Client{
-			Transport: ts,
+// insertRand returns the InsertRand option of the last non-nil options.
+func insertRand(opts []*Option) *rand.Rand {
+	var rng *rand.Rand
+	for _, o := range opts {
+		if o != nil {
+			rng = o.InsertRand
 		}
+	}
+	return rng
+}
 
-		opt := &Option{}
-		for _, o := range opts {
-			opt = o
+// publishableKeyFunc returns the PublishableKeyFunc option of the last non-nil
+// option in opts, the same way as newClient.
+func publishableKeyFunc(opts []*Option) func() (string, error) {
+	var fn func() (string, error)
+	for _, o := range opts {
+		if o != nil {
+			fn = o.PublishableKeyFunc
 		}
-		opt.setDefaults()
+	}
+	return fn
+}
 
-		common := &base{
-			http:    httpClient,
-			baseURL: opt.BaseURL,
+// filterFromMap builds a filter containing the keys that are enabled, and the
+// rollout percentages of features, evicting entries chosen by rng to make
+// room.
+func filterFromMap(enabled map[string]bool, rollouts map[string]uint8, rng *rand.Rand) (*filter, error) {
+	keys := make([][]byte, 0, len(enabled))
+	for key, v := range enabled {
+		if v {
+			keys = append(keys, []byte(key))
 		}
-		c = &client{base: *common}
+	}
+	// Map order is random, so the keys are sorted to insert them in the
+	// same order every time.
+	slices.SortFunc(keys, bytes.Compare)
+	f := buildFilter(keys, rng)
 
-		if err := c.fetchFilter(); err != nil {
-			log.Printf("go-temper: failed to fetch and intialize filter: %s, retrying in 60 seconds, all checks will return false", err.Error())
-			c.filter = &filter{}
+	if len(rollouts) > 0 {
+		f.rollouts = make(map[uint64]uint8, len(rollouts))
+		for feature, rollout := range rollouts {
+			if rollout > 100 {
+				return nil, fmt.Errorf("go-temper: rollout of feature %s is %d%%, which is more than 100%%", feature, rollout)
+			}
+			f.rollouts[rolloutKey(hash([]byte(feature)))] = rollout
 		}
-		go c.pollFilter()
+	}
+	return f, nil
+}
+
+// NewClientWithFilter returns a client that evaluates features against the
+// given filter, without making any requests to the backend, and without
+// polling, which is useful for testing code that checks features with
+// precisely controlled flag state. A nil filter disables every feature. Since
+// the client has no secret key, it behaves as it does in local development.
+func NewClientWithFilter(f *Filter, opts ...*Option) *Client {
+	c := newClient(offlineKey, "", opts...)
+	c.filter.Store(&filter{})
+	if f != nil && f.f != nil {
+		c.filter.Store(f.f)
+	}
+	c.readyOnce.Do(func() {
+		close(c.ready)
 	})
+	return c
 }
 
-// fetchFilter gets the filter and rollout data from the Temper backend.
-func (c *client) fetchFilter() error {
-	resp, err := c.http.Get(c.baseURL + "/api/public/filter")
-	if err != nil {
-		return fmt.Errorf("go-temper: failed to fetch filter: %w", err)
+// decodeBase64 decodes a base64 string or data URI, returning nil for an
+// empty string.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
 	}
 
-	fr := &filterResponse{}
-	if err := json.NewDecoder(resp.Body).Decode(fr); err != nil {
-		return fmt.Errorf("go-temper: failed to decode filter response: %w", err)
+	if rest, ok := strings.CutPrefix(s, "data:"); ok {
+		_, data, ok := strings.Cut(rest, ";base64,")
+		if !ok {
+			return nil, errors.New("go-temper: data uri isn't base64 encoded")
+		}
+		s = data
 	}
-	defer resp.Body.Close()
+	return base64.StdEncoding.DecodeString(s)
+}
 
-	f, err := from(fr)
-	if err != nil {
-		return fmt.Errorf("go-temper: failed to create filter from data: %w", err)
+// InitAndWait is like Init, but waits for the filter to be fetched before
+// returning. The initial fetch is made with ctx, so if ctx is cancelled or
+// times out, the request is aborted, and the error is returned. The client is
+// still initialized when an error is returned, and keeps polling for the
+// filter in the background.
+//
+// If the client has already been initialized, InitAndWait waits for it to be
+// ready the same way as Ready.
+func InitAndWait(ctx context.Context, publishableKey, secretKey string, opts ...*Option) error {
+	var err error
+	if initialize(func() {
+		setClient(newClient(publishableKey, secretKey, opts...))
+		err = c.initialFetch(ctx)
+		c.startPolling()
+	}) {
+		return err
+	}
+
+	return c.Ready(ctx)
+}
+
+// Ready waits until the filter has been fetched successfully at least once,
+// or until ctx is done. If the filter hasn't been fetched yet, Ready fetches
+// it with ctx, so cancelling ctx aborts the request rather than leaving it
+// to complete after the caller has given up.
+func Ready(ctx context.Context) error {
+	return c.Ready(ctx)
+}
+
+// Ready waits until the filter has been fetched successfully at least once,
+// or until ctx is done.
+func (c *Client) Ready(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	default:
+	}
+
+	if err := c.fetchFilter(ctx); err == nil {
+		return nil
+	}
+
+	// Wait for the next successful poll instead.
+	select {
+	case <-c.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("go-temper: filter isn't ready: %w", ctx.Err())
+	}
+}
+
+// startPolling starts polling for the filter, the filter for every scope,
+// and the overrides, in the background.
+func (c *Client) startPolling() {
+	c.pollMu.Lock()
+	defer c.pollMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopPolling = cancel
+	c.polling.Store(true)
+
+	c.goPoll(ctx, "filter", c.fetchFilter)
+	for name, s := range c.scopes {
+		c.goPoll(ctx, "filter for scope "+name, func(ctx context.Context) error {
+			return c.fetchScope(ctx, s)
+		})
 	}
-	c.filter = f
+	if c.opt.OverridesURL != "" {
+		c.goPoll(ctx, "overrides", c.fetchOverrides)
+	}
+
+	c.pollers.Add(1)
+	go func() {
+		defer c.pollers.Done()
+		c.submitRefactorResults(ctx)
+	}()
+}
+
+// goPoll starts a poll goroutine that's tracked by pollers.
+func (c *Client) goPoll(ctx context.Context, what string, fetch func(ctx context.Context) error) {
+	c.pollers.Add(1)
+	go func() {
+		defer c.pollers.Done()
+		c.poll(ctx, what, fetch)
+	}()
+}
+
+// Close stops the client started by Init from polling the backend, waiting
+// until every poll goroutine has returned, and cancels any fetch in flight.
+// Features can still be checked against the last filter that was fetched.
+// Once the client is closed, Init can be called again to start a new client.
+func Close() error {
+	initMu.Lock()
+	defer initMu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	err := c.Close()
+	initialized = false
+	return err
+}
+
+func (c *Client) Close() error {
+	c.pollMu.Lock()
+	stop := c.stopPolling
+	c.stopPolling = nil
+	c.pollMu.Unlock()
 
+	if stop == nil {
+		return nil
+	}
+	stop()
+	c.pollers.Wait()
+	c.polling.Store(false)
 	return nil
 }
 
-// TODO Refactor this and the other occasional backend checks to use `time.Ticker`.
-func (c *client) pollFilter() {
-	for {
-		time.Sleep(60 * time.Second)
+// initialFetch fetches the filter, and the filter for every scope, for the
+// first time, falling back to the FallbackFilter option or empty filters when
+// they can't be fetched. The error from fetching the filter, if there is one,
+// is returned.
+func (c *Client) initialFetch(ctx context.Context) error {
+	// A filter provided by the InitialFilter option is used until the next
+	// poll, rather than waiting for the backend.
+	var err error
+	if c.filter.Load() == nil {
+		if err = c.fetchFilter(ctx); err != nil && c.opt.FallbackFilter != nil && c.opt.FallbackFilter.f != nil {
+			c.opt.Logger.Printf("go-temper: failed to fetch and intialize filter: %s, retrying in %s, using the fallback filter", err.Error(), c.opt.PollInterval)
+			c.filter.Store(c.opt.FallbackFilter.f)
+		} else if err != nil {
+			c.opt.Logger.Printf("go-temper: failed to fetch and intialize filter: %s, retrying in %s, all checks will return false", err.Error(), c.opt.PollInterval)
+			c.filter.Store(&filter{})
+		}
+	}
 
-		if err := c.fetchFilter(); err != nil {
-			log.Printf("go-temper: latest filter poll failed at %s due to error: %s", time.Now().String(), err.Error())
+	for name, s := range c.scopes {
+		if err := c.fetchScope(ctx, s); err != nil {
+			c.opt.Logger.Printf("go-temper: failed to fetch and intialize filter for scope %s: %s, retrying in %s, all checks in the scope will return false", name, err.Error(), c.opt.PollInterval)
+			s.filter.Store(&filter{})
 		}
 	}
-}
 
-// Check looks up a single feature, returning true if it's enabled, and false
-// otherwise.
-func Check(feature string) bool {
-	return c.filter.lookup([]byte(feature))
+	if c.opt.OverridesURL != "" {
+		if err := c.fetchOverrides(ctx); err != nil {
+			c.opt.Logger.Printf("go-temper: failed to fetch overrides: %s, retrying in %s", err.Error(), c.opt.PollInterval)
+		}
+	}
+
+	return err
 }
 
-// Refactor runs both functions on the given RefactorArgs simultaneously,
-// saving both results in Temper if they don't match. The return value is the
-// result of the given RefactorArgs's `Old` function.
-//
-// If you need to return an error, use `RefactorErr`.
-func Refactor[Args, Ret any](refactor *RefactorArgs[Args, Ret], args Args) Ret {
-	return refactor.run(args)
+// newClient creates a Temper API client using the given keys and optional
+// configuration options, without fetching the filter.
+func newClient(publishableKey, secretKey string, opts ...*Option) *Client {
+	opt := &Option{}
+	for _, o := range opts {
+		if o != nil {
+			opt = o
+		}
+	}
+	opt.setDefaults()
+
+	publishableKey = strings.Trim(strings.TrimSpace(publishableKey), "'")
+	if publishableKey == "" && opt.PublishableKeyFunc == nil {
+		log.Fatalln("go-temper: publishable key cannot be empty")
+	}
+	secretKey = strings.Trim(strings.TrimSpace(secretKey), "'")
+
+	ts := &tokenSource{
+		publishableKey: publishableKey,
+		secretKey:      secretKey,
+		base:           http.DefaultTransport,
+	}
+	if opt.HTTPClient != nil && opt.HTTPClient.Transport != nil {
+		ts.base = opt.HTTPClient.Transport
+	}
+	if opt.PublishableKeyFunc != nil {
+		ts.publishableKeyFunc = &keyFunc{name: "publishable", fn: opt.PublishableKeyFunc, ttl: opt.KeyCacheTTL}
+	}
+	if opt.SecretKeyFunc != nil {
+		ts.secretKeyFunc = &keyFunc{name: "secret", fn: opt.SecretKeyFunc, ttl: opt.KeyCacheTTL}
+	}
+	if opt.TransportWrapper != nil {
+		ts.base = opt.TransportWrapper(ts.base)
+	}
+	if opt.OverridesURL != "" {
+		u, err := url.Parse(opt.OverridesURL)
+		if err != nil {
+			opt.Logger.Printf("go-temper: invalid overrides url %s: %s", opt.OverridesURL, err.Error())
+			opt.OverridesURL = ""
+		} else {
+			ts.publicEndpoints = append(ts.publicEndpoints, u.Host+u.Path)
+		}
+	}
+
+	// The filter endpoints are part of the public API, but their effective
+	// paths can be anywhere beneath BaseURL, so they're added explicitly.
+	for _, p := range append([]string{opt.FilterPath}, scopePaths(opt.Scopes)...) {
+		if u, err := url.Parse(opt.BaseURL + p); err == nil && !IsPublicPath(u.Path) {
+			ts.publicEndpoints = append(ts.publicEndpoints, u.Host+u.Path)
+		}
+	}
+
+	httpClient := &http.Client{}
+	if opt.HTTPClient != nil {
+		// Copy the client to keep its timeout, redirect policy, and cookie
+		// jar, without modifying it.
+		*httpClient = *opt.HTTPClient
+	}
+	httpClient.Transport = ts
+
+	common := &base{
+		http:    httpClient,
+		baseURL: opt.BaseURL,
+	}
+
+	c := &Client{
+		base:    *common,
+		tokens:  ts,
+		devMode: secretKey == "" && opt.SecretKeyFunc == nil,
+		opt:     opt,
+		ready:   make(chan struct{}),
+		results: make(chan *addRefactorResultRequest, maxQueuedRefactorResults),
+	}
+	c.fetcher = opt.Fetcher
+	if c.fetcher == nil {
+		c.fetcher = &httpFetcher{c: c, path: opt.FilterPath}
+	}
+
+	if opt.InitialFilter != nil && opt.InitialFilter.f != nil {
+		c.filter.Store(opt.InitialFilter.f)
+		c.readyOnce.Do(func() {
+			close(c.ready)
+		})
+	}
+
+	if opt.Debug {
+		opt.Logger.Printf("go-temper: effective config: base_url=%s filter_path=%s poll_interval=%s environment=%q publishable_key=%s secret_key=%s dev_mode=%t defaults_file=%q strict_unknown_features=%t compact_filter=%t max_filter_bytes=%d max_rollout_entries=%d",
+			opt.BaseURL, opt.FilterPath, opt.PollInterval, opt.Environment, redact(publishableKey), redact(secretKey), c.devMode, opt.DefaultsFile, opt.StrictUnknownFeatures, opt.CompactFilter, opt.MaxFilterBytes, opt.MaxRolloutEntries)
+	}
+
+	if opt.NegativeCacheTTL > 0 {
+		c.negative = &negativeCache{ttl: opt.NegativeCacheTTL}
+		c.caches = append(c.caches, c.negative)
+	}
+
+	if len(opt.AlwaysOnActors) > 0 {
+		c.alwaysOn = make(map[string]struct{}, len(opt.AlwaysOnActors))
+		for _, actor := range opt.AlwaysOnActors {
+			c.alwaysOn[actor] = struct{}{}
+		}
+	}
+
+	if len(opt.Scopes) > 0 {
+		c.scopes = make(map[string]*scope, len(opt.Scopes))
+		for name, path := range opt.Scopes {
+			c.scopes[name] = &scope{path: path}
+		}
+	}
+
+	if c.devMode && len(opt.TestModeOverrides) > 0 {
+		c.testOverrides = make(map[string]struct{}, len(opt.TestModeOverrides))
+		for key := range opt.TestModeOverrides {
+			c.testOverrides[key] = struct{}{}
+		}
+	}
+
+	if c.devMode && opt.DefaultsFile != "" {
+		defaults, err := readDefaults(opt.DefaultsFile)
+		if err != nil {
+			opt.Logger.Printf("go-temper: failed to read defaults file: %s", err.Error())
+		}
+		c.defaults = defaults
+	}
+
+	if opt.Expvar {
+		publishExpvar()
+	}
+
+	return c
+}
+
+// scopePaths returns the paths of the given scopes.
+func scopePaths(scopes map[string]string) []string {
+	paths := make([]string, 0, len(scopes))
+	for _, p := range scopes {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// redact returns a redacted form of a key that's safe to log, keeping only
+// enough of its prefix to tell keys apart.
+func redact(key string) string {
+	if key == "" {
+		return "<none>"
+	}
+	if len(key) <= 8 {
+		return "<redacted>"
+	}
+	return key[:4] + "..."
+}
+
+// readDefaults reads the feature defaults from the JSON file at path.
+func readDefaults(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := make(map[string]bool)
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		return nil, fmt.Errorf("go-temper: failed to decode defaults file %s: %w", path, err)
+	}
+	return defaults, nil
+}
+
+// fetchFilter gets the filter and rollout data from the Temper backend.
+func (c *Client) fetchFilter(ctx context.Context) error {
+	f, err := c.fetch(ctx, c.fetcher, c.filter.Load())
+	if err != nil {
+		c.fetchFailures.Add(1)
+		c.fetchFailuresInRow.Add(1)
+		if errors.As(err, &malformedError{}) {
+			if n := c.decodeFailures.Add(1); n == int64(c.opt.MaxDecodeFailures) {
+				c.opt.Logger.Printf("go-temper: the last %d filters failed to decode, serving the last good filter", n)
+			}
+		}
+		return err
+	}
+	c.fetchSuccesses.Add(1)
+	c.fetchFailuresInRow.Store(0)
+	c.decodeFailures.Store(0)
+	c.filter.Store(f)
+	c.ClearCaches()
+	c.updated.Store(time.Now().UnixNano())
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+	c.notifyWatchers()
+
+	return nil
+}
+
+// fetchScope gets the filter and rollout data for a scope from the Temper
+// backend.
+func (c *Client) fetchScope(ctx context.Context, s *scope) error {
+	f, err := c.fetch(ctx, &httpFetcher{c: c, path: s.path}, s.filter.Load())
+	if err != nil {
+		return err
+	}
+	s.filter.Store(f)
+
+	return nil
+}
+
+// A FilterFetcher fetches the filter and rollout data from the Temper
+// backend. The default fetcher gets it from the filter endpoint over HTTP,
+// but any transport that serves the same data can be used with the Fetcher
+// option, while polling, decoding, and lookups work the same way.
+type FilterFetcher interface {
+	Fetch(ctx context.Context) (*FilterResponse, error)
+}
+
+// An httpFetcher fetches the filter and rollout data from a path of the
+// Temper backend over HTTP.
+type httpFetcher struct {
+	c    *Client
+	path string
+}
+
+// Fetch gets the filter and rollout data from the path. The environment the
+// backend identifies itself as in the environmentHeader header takes
+// precedence over the one in the response body.
+func (hf *httpFetcher) Fetch(ctx context.Context) (*FilterResponse, error) {
+	c := hf.c
+	start := time.Now()
+	status := 0
+	body := &countingReader{}
+	if c.opt.OnFetch != nil {
+		defer func() {
+			c.callback("OnFetch", func() {
+				c.opt.OnFetch(time.Since(start), body.n, status)
+			})
+		}()
+	}
+
+	if c.opt.OnFetchTrace != nil {
+		t := &fetchTracer{}
+		ctx = httptrace.WithClientTrace(ctx, t.clientTrace())
+		defer func() {
+			if trace, ok := t.trace(); ok {
+				c.callback("OnFetchTrace", func() {
+					c.opt.OnFetchTrace(trace)
+				})
+			}
+		}()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+hf.path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: failed to create filter request: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: failed to fetch filter: %w", err)
+	}
+	defer func() {
+		// Drain whatever the decoder didn't read, up to maxDrainBytes, so
+		// that the connection can be reused by the next poll. A body with
+		// more left than that is closed with the connection instead.
+		io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+		resp.Body.Close()
+	}()
+	status = resp.StatusCode
+	body.r = resp.Body
+
+	if err := checkContentType(resp.Header.Get("Content-Type"), body); err != nil {
+		return nil, fmt.Errorf("go-temper: unexpected filter response with status %s: %w", resp.Status, err)
+	}
+
+	// The response is limited before it's decoded, so that a runaway
+	// response is never buffered in full.
+	limited := &io.LimitedReader{R: body, N: c.opt.maxResponseBytes()}
+	fr := &FilterResponse{}
+	if err := json.NewDecoder(limited).Decode(fr); err != nil {
+		if limited.N <= 0 {
+			return nil, malformedError{fmt.Errorf("go-temper: filter response is larger than %d bytes", c.opt.maxResponseBytes())}
+		}
+		return nil, malformedError{fmt.Errorf("go-temper: failed to decode filter response: %w", err)}
+	}
+
+	if env := resp.Header.Get(environmentHeader); env != "" {
+		fr.Environment = env
+	}
+
+	return fr, nil
+}
+
+// fetch gets filter and rollout data with the given fetcher. Segments of the
+// data that fail to decode are kept from prev. If ctx is done before the
+// filter is created, an error is returned, so that a caller that has given up
+// never has a filter installed behind its back.
+func (c *Client) fetch(ctx context.Context, fetcher FilterFetcher, prev *filter) (*filter, error) {
+	fr, err := fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if fr == nil {
+		return nil, errors.New("go-temper: fetcher returned no filter response")
+	}
+
+	if expected := c.opt.ExpectedEnvironment; expected != "" && fr.Environment != expected {
+		return nil, fmt.Errorf("go-temper: filter is from the %q environment, but the %q environment was expected", fr.Environment, expected)
+	}
+
+	f, err := from(fr, c.opt)
+	if f == nil {
+		return nil, malformedError{fmt.Errorf("go-temper: failed to create filter from data: %w", err)}
+	}
+	if err != nil {
+		// Keep the previous data for whichever segment failed to decode,
+		// and install the rest.
+		c.opt.Logger.Printf("go-temper: partially failed to create filter from data: %s", err.Error())
+		f.inherit(prev, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("go-temper: filter fetch abandoned: %w", err)
+	}
+
+	return f, nil
+}
+
+// maxSnippetBytes is the most of an unexpected response body that's included
+// in the error describing it.
+const maxSnippetBytes = 128
+
+// maxDrainBytes is the most of a filter response body that's left unread
+// that's drained, so that its connection can be reused.
+const maxDrainBytes = 64 << 10
+
+// checkContentType returns an error including a snippet of the body if the
+// content type isn't JSON, such as an HTML error page from a misconfigured
+// proxy.
+func checkContentType(contentType string, body io.Reader) error {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/json" {
+		return nil
+	}
+
+	snippet := make([]byte, maxSnippetBytes)
+	n, _ := io.ReadFull(body, snippet)
+	return fmt.Errorf("content type is %q instead of application/json, body starts with %q", contentType, snippet[:n])
+}
+
+// A malformedError is returned from fetch when a response was received, but
+// its data couldn't be decoded.
+type malformedError struct {
+	err error
+}
+
+func (e malformedError) Error() string {
+	return e.err.Error()
+}
+
+func (e malformedError) Unwrap() error {
+	return e.err
+}
+
+// Healthy returns false once the number of fetches in a row that received a
+// filter that failed to decode reaches the MaxDecodeFailures option, which
+// means the backend has been sending bad data for a while, rather than only
+// briefly. The last good filter is still used while unhealthy. It's meant for
+// readiness probes.
+func Healthy() bool {
+	return c.Healthy()
+}
+
+func (c *Client) Healthy() bool {
+	return c.decodeFailures.Load() < int64(c.opt.MaxDecodeFailures)
+}
+
+// LastUpdated returns when the filter was last fetched successfully, or the
+// zero time if it's never been fetched.
+func LastUpdated() time.Time {
+	return c.LastUpdated()
+}
+
+func (c *Client) LastUpdated() time.Time {
+	updated := c.updated.Load()
+	if updated == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, updated)
+}
+
+// stale returns true if the filter is older than the MaxFilterAge option, in
+// which case its data isn't trusted.
+func (c *Client) stale() bool {
+	if c.opt.MaxFilterAge <= 0 {
+		return false
+	}
+	updated := c.updated.Load()
+	return updated == 0 || time.Since(time.Unix(0, updated)) > c.opt.MaxFilterAge
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// A FetchTrace describes the connection used to fetch the filter.
+type FetchTrace struct {
+	// Reused is true if the connection had been used for a previous
+	// request.
+	Reused bool
+
+	// WasIdle is true if the connection was reused from the idle pool, and
+	// IdleTime is how long it was idle for.
+	WasIdle  bool
+	IdleTime time.Duration
+
+	// DNS, Connect, and TLSHandshake are how long each step of establishing
+	// a new connection took. They're zero when the connection was reused.
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+}
+
+// fetchTracer records a FetchTrace from the httptrace hooks of a single
+// request. The hooks may be called concurrently, so access is guarded by mu.
+type fetchTracer struct {
+	mu  sync.Mutex
+	got bool
+	ft  FetchTrace
+
+	dnsStart, connectStart, tlsStart time.Time
+}
+
+func (t *fetchTracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.got = true
+			t.ft.Reused = info.Reused
+			t.ft.WasIdle = info.WasIdle
+			t.ft.IdleTime = info.IdleTime
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.ft.DNS = time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.ft.Connect = time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.ft.TLSHandshake = time.Since(t.tlsStart)
+		},
+	}
+}
+
+// trace returns the recorded trace, and whether a connection was obtained.
+func (t *fetchTracer) trace() (FetchTrace, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ft, t.got
+}
+
+// fetchOverrides gets the forced values from the QA overrides service.
+func (c *Client) fetchOverrides(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.opt.OverridesURL, nil)
+	if err != nil {
+		return fmt.Errorf("go-temper: failed to create overrides request: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("go-temper: failed to fetch overrides: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("go-temper: failed to fetch overrides: unexpected status %s", resp.Status)
+	}
+
+	overrides := make(map[string]bool)
+	if err := json.NewDecoder(resp.Body).Decode(&overrides); err != nil {
+		return fmt.Errorf("go-temper: failed to decode overrides response: %w", err)
+	}
+	c.overrides.Store(&overrides)
+	c.notifyWatchers()
+
+	return nil
+}
+
+// maxQueuedRefactorResults is the most refactor results that are queued for
+// submission, past which further results are dropped.
+const maxQueuedRefactorResults = 256
+
+// refactorResultTimeout is how long the submission of a single refactor
+// result can take.
+const refactorResultTimeout = 10 * time.Second
+
+// queueRefactorResult queues the result of a refactor run for submission to
+// the backend, dropping it if the client isn't polling, since nothing would
+// submit it, or if the queue is full, which is logged.
+func (c *Client) queueRefactorResult(result *addRefactorResultRequest) {
+	if !c.polling.Load() {
+		return
+	}
+	select {
+	case c.results <- result:
+	default:
+		c.opt.Logger.Printf("go-temper: dropped result for refactor %s, %d results are already queued", result.Key, maxQueuedRefactorResults)
+	}
+}
+
+// submitRefactorResults submits the queued refactor results to the backend
+// one at a time, until ctx is done, logging any errors.
+func (c *Client) submitRefactorResults(ctx context.Context) {
+	for {
+		var result *addRefactorResultRequest
+		select {
+		case <-ctx.Done():
+			return
+		case result = <-c.results:
+		}
+
+		submitCtx, cancel := context.WithTimeout(ctx, refactorResultTimeout)
+		err := c.submitRefactorResult(submitCtx, result)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			c.opt.Logger.Printf("go-temper: failed to submit result for refactor %s: %s", result.Key, err.Error())
+		}
+	}
+}
+
+// submitRefactorResult submits the result of a refactor run to the backend.
+func (c *Client) submitRefactorResult(ctx context.Context, result *addRefactorResultRequest) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("go-temper: failed to encode refactor result: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+c.opt.RefactorResultsPath, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("go-temper: failed to create refactor result request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, result.IdempotencyKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("go-temper: failed to submit refactor result: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("go-temper: failed to submit refactor result: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Watch calls fn whenever the result of checking the given key changes after
+// the filter or overrides are polled, where the key is the one that would be
+// passed to Check, such as `maintenance`, or a representative actor's fully
+// qualified key. Polls that don't change the result don't call fn. The
+// callbacks are called from the polling goroutine, so they must not block.
+func Watch(feature string, fn func(enabled bool)) {
+	c.Watch(feature, fn)
+}
+
+func (c *Client) Watch(feature string, fn func(enabled bool)) {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	c.watchers = append(c.watchers, &watcher{
+		key:     feature,
+		fn:      fn,
+		enabled: c.watch(feature).enabled,
+	})
+}
+
+// HasChanged reports whether the result of checking the given key differs
+// after the last poll of the filter or overrides from the result after the
+// poll before it. The key is evaluated after every poll from the first time
+// it's passed to HasChanged or Watch, so the first call always returns false.
+func HasChanged(feature string) bool {
+	return c.HasChanged(feature)
+}
+
+func (c *Client) HasChanged(feature string) bool {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	return c.watch(feature).changed
+}
+
+// watch returns the result of a watched key, and starts watching it if it
+// isn't already. It must be called with watchMu held.
+func (c *Client) watch(key string) *watchedResult {
+	if r, ok := c.watched[key]; ok {
+		return r
+	}
+	if c.watched == nil {
+		c.watched = make(map[string]*watchedResult)
+	}
+	r := &watchedResult{enabled: c.Check(key)}
+	c.watched[key] = r
+	return r
+}
+
+// notifyWatchers re-evaluates every watched key, and calls the callbacks of
+// the ones whose result changed.
+func (c *Client) notifyWatchers() {
+	for _, call := range c.changedWatchers() {
+		c.callback("Watch", call)
+	}
+}
+
+// changedWatchers re-evaluates every watched key, returning a call of the
+// callback of each watcher whose result changed, with the result captured
+// while watchMu is held.
+func (c *Client) changedWatchers() []func() {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+
+	for key, r := range c.watched {
+		enabled := c.Check(key)
+		r.changed = enabled != r.enabled
+		r.enabled = enabled
+	}
+	var calls []func()
+	for _, w := range c.watchers {
+		if enabled := c.watched[w.key].enabled; enabled != w.enabled {
+			w.enabled = enabled
+			fn := w.fn
+			calls = append(calls, func() { fn(enabled) })
+		}
+	}
+	return calls
+}
+
+// callback calls fn, which calls a user supplied callback, recovering from
+// and logging any panic, so that a buggy callback can't stop polling.
+func (c *Client) callback(name string, fn func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.opt.Logger.Printf("go-temper: recovered from panic in %s callback: %v\n%s", name, err, debug.Stack())
+		}
+	}()
+	fn()
+}
+
+// poll calls fetch once every poll interval until ctx is done, logging any
+// errors. Fetches are skipped while polling is paused.
+func (c *Client) poll(ctx context.Context, what string, fetch func(ctx context.Context) error) {
+	failures := &pollFailures{what: what, interval: c.opt.LogInterval, logger: c.opt.Logger}
+
+	ticker := time.NewTicker(c.opt.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if c.paused.Load() {
+			c.opt.Logger.Printf("go-temper: polling is paused, skipped %s poll at %s", what, time.Now().String())
+			continue
+		}
+
+		if err := fetch(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures.failed(time.Now(), err)
+		} else {
+			failures.succeeded(time.Now())
+		}
+	}
+}
+
+// pollFailures logs the failures of a single poll loop, rate-limited by the
+// LogInterval option.
+type pollFailures struct {
+	what     string
+	interval time.Duration
+	logger   Logger
+
+	count  int
+	since  time.Time // when the first of the current failures happened.
+	logged time.Time // when a failure was last logged.
+}
+
+// failed logs a failed poll, unless a failure has already been logged within
+// the interval.
+func (p *pollFailures) failed(now time.Time, err error) {
+	p.count++
+	if p.count == 1 {
+		p.since = now
+	} else if p.interval > 0 && now.Sub(p.logged) < p.interval {
+		return
+	}
+	p.logged = now
+
+	if p.count == 1 || p.interval <= 0 {
+		p.logger.Printf("go-temper: latest %s poll failed at %s due to error: %s", p.what, now.String(), err.Error())
+		return
+	}
+	p.logger.Printf("go-temper: latest %s poll failed at %s due to error: %s, %d polls have failed since %s", p.what, now.String(), err.Error(), p.count, p.since.String())
+}
+
+// succeeded logs the recovery of the poll if the previous polls failed.
+func (p *pollFailures) succeeded(now time.Time) {
+	if p.count == 0 {
+		return
+	}
+	p.logger.Printf("go-temper: %s poll recovered at %s after %d failed polls since %s", p.what, now.String(), p.count, p.since.String())
+	p.count = 0
+}
+
+// PausePolling stops the filter, the filters for scopes, and the overrides
+// from being fetched by polling, which holds the state of every feature
+// constant, for example, during a measurement window, until ResumePolling is
+// called. Every skipped poll is logged, so that polling isn't left paused by
+// mistake.
+func PausePolling() {
+	c.PausePolling()
+}
+
+func (c *Client) PausePolling() {
+	if !c.paused.Swap(true) {
+		c.opt.Logger.Printf("go-temper: polling paused, features won't change until polling is resumed")
+	}
+}
+
+// ResumePolling resumes polling after PausePolling. The next fetch happens at
+// the next poll interval.
+func ResumePolling() {
+	c.ResumePolling()
+}
+
+func (c *Client) ResumePolling() {
+	if c.paused.Swap(false) {
+		c.opt.Logger.Printf("go-temper: polling resumed")
+	}
+}
+
+// Check looks up a single feature, returning true if it's enabled, and false
+// otherwise.
+func Check(feature string) bool {
+	return c.Check(feature)
+}
+
+// Check looks up a single feature, returning true if it's enabled, and false
+// otherwise.
+func (c *Client) Check(feature string) bool {
+	return c.CheckCtx(context.Background(), feature)
+}
+
+// CheckSeeded is like Check, but mixes the given seed into the hash that
+// decides whether the key falls within a percentage rollout, so that starting
+// a new generation of an experiment with a new seed reshuffles which actors
+// are enabled without changing their keys. Actors enabled explicitly are
+// unaffected by the seed, and an empty seed is the same as Check.
+func CheckSeeded(feature, seed string) bool {
+	return c.CheckSeeded(feature, seed)
+}
+
+func (c *Client) CheckSeeded(feature, seed string) bool {
+	if v, ok := c.override(feature); ok {
+		return v
+	}
+	if v, ok := c.localDefault(feature); ok {
+		return v
+	}
+	if v, ok := c.preReady(feature); ok {
+		return v
+	}
+	if c.stale() {
+		return false
+	}
+
+	data := []byte(feature)
+
+	c.checkKnown(feature, data)
+
+	f := c.filter.Load()
+	if c.inherits(f, data) {
+		return c.opt.Parent.CheckSeeded(feature, seed)
+	}
+	if c.alwaysOnActor(data) {
+		return !f.isKilled(hash(featureSegment(data)))
+	}
+	if c.opt.StickyStore != nil {
+		return c.lookupSticky(f, data, c.seed(seed))
+	}
+
+	if c.negative == nil || seed != "" || c.opt.RolloutSalt != nil {
+		return f.lookupSeeded(data, c.seed(seed))
+	}
+	now := time.Now()
+	if c.negative.disabled(feature, f, now) {
+		return false
+	}
+	enabled := f.lookupSeeded(data, nil)
+	if !enabled {
+		c.negative.add(feature, f, now)
+	}
+	return enabled
+}
+
+// seed returns the seed that's mixed into the hash of a full key, which is
+// the given seed combined with the salt from the RolloutSalt option.
+func (c *Client) seed(seed string) []byte {
+	if c.opt.RolloutSalt == nil {
+		return []byte(seed)
+	}
+
+	salt := c.opt.RolloutSalt()
+	if seed == "" {
+		return []byte(salt)
+	}
+	return []byte(salt + "\x00" + seed)
+}
+
+// CheckOr is like Check, but returns def when the filter is empty, for
+// example, because it couldn't be fetched, so that a feature can fail open
+// rather than be disabled. Overrides and local defaults still take
+// precedence.
+func CheckOr(feature string, def bool) bool {
+	return c.CheckOr(feature, def)
+}
+
+func (c *Client) CheckOr(feature string, def bool) bool {
+	if v, ok := c.override(feature); ok {
+		return v
+	}
+	if v, ok := c.localDefault(feature); ok {
+		return v
+	}
+	if c.filter.Load().empty() {
+		return def
+	}
+	return c.Check(feature)
+}
+
+// CheckFirst checks each of the given keys in order, from the most to the
+// least specific, returning true as soon as one of them is enabled, and false
+// if none of them are. For example, `feature:user:123`, then `feature:org:45`,
+// then `feature`.
+func CheckFirst(keys ...string) bool {
+	return c.CheckFirst(keys...)
+}
+
+func (c *Client) CheckFirst(keys ...string) bool {
+	for _, key := range keys {
+		if c.Check(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnabledActors checks the feature for each of the given actors of a
+// resource, for example, "user", and returns the IDs of only the actors it's
+// enabled for, in the same order. The work that's shared by every actor, like
+// hashing the feature name, is only done once, so it's cheaper than calling
+// Check for each actor.
+func EnabledActors(feature, resource string, actorIDs []string) []string {
+	return c.EnabledActors(feature, resource, actorIDs)
+}
+
+func (c *Client) EnabledActors(feature, resource string, actorIDs []string) []string {
+	hfeat := hash([]byte(feature))
+	prefix := feature + ":" + resource + ":"
+	seed := c.seed("")
+
+	var enabled []string
+	for _, id := range actorIDs {
+		if c.checkActor(hfeat, prefix+id, seed) {
+			enabled = append(enabled, id)
+		}
+	}
+	return enabled
+}
+
+// checkActor checks a fully qualified key the same way as Check, given the
+// hash of its feature segment, and the seed from seed.
+func (c *Client) checkActor(hfeat uint64, key string, seed []byte) bool {
+	if v, ok := c.override(key); ok {
+		return v
+	}
+	if v, ok := c.localDefault(key); ok {
+		return v
+	}
+	if v, ok := c.preReady(key); ok {
+		return v
+	}
+	if c.stale() {
+		return false
+	}
+
+	data := []byte(key)
+
+	c.checkKnown(key, data)
+
+	f := c.filter.Load()
+	if c.inherits(f, data) {
+		return c.opt.Parent.Check(key)
+	}
+	if len(f.killed) > 0 && f.isKilled(hfeat) {
+		return false
+	}
+	if c.alwaysOnActor(data) {
+		return true
+	}
+	if c.opt.StickyStore != nil {
+		return c.lookupSticky(f, data, seed)
+	}
+	if f.lookupRolloutHash(hfeat, f.seededHash(data, seed)) {
+		return true
+	}
+	return f.lookupFilter(data)
+}
+
+// CheckIn looks up a single feature in the filter for the given scope,
+// returning true if it's enabled, and false otherwise. Features in scopes that
+// aren't configured by the Scopes option are always false.
+func CheckIn(scope, feature string) bool {
+	return c.CheckIn(scope, feature)
+}
+
+// CheckIn looks up a single feature in the filter for the given scope.
+func (c *Client) CheckIn(scope, feature string) bool {
+	s, ok := c.scopes[scope]
+	if !ok {
+		return false
+	}
+
+	f := s.filter.Load()
+	if f == nil {
+		return false
+	}
+	return f.lookup([]byte(feature))
+}
+
+// CheckGlobal looks up a global feature that isn't targeted at individual
+// actors, returning true if it's enabled, and false otherwise. Unlike Check,
+// the whole of feature is used as the feature name, even if it contains a
+// `:`.
+func CheckGlobal(feature string) bool {
+	return c.CheckGlobal(feature)
+}
+
+// CheckGlobal looks up a global feature that isn't targeted at individual
+// actors, returning true if it's enabled, and false otherwise.
+func (c *Client) CheckGlobal(feature string) bool {
+	if v, ok := c.override(feature); ok {
+		return v
+	}
+	if _, ok := c.testOverrides[feature]; ok {
+		return true
+	}
+	if v, ok := c.defaults[feature]; ok {
+		return v
+	}
+	if c.stale() {
+		return false
+	}
+
+	data := []byte(feature)
+
+	f := c.filter.Load()
+	if c.devMode && c.opt.StrictUnknownFeatures && !f.knownGlobal(data) {
+		c.unknownFeature(feature)
+	}
+	if c.inheritsGlobal(f, data) {
+		return c.opt.Parent.CheckGlobal(feature)
+	}
+	return f.lookupGlobal(data)
+}
+
+// An AuditResult is the result of a check made with CheckAudited, which is
+// traceable to why the feature evaluated the way it did, and the filter it
+// was evaluated against.
+type AuditResult struct {
+	Feature string
+	Enabled bool
+
+	// Reason is why the feature evaluated the way it did, which is one of
+	// "override", "default", "pre_ready", "stale", "killed", "always_on",
+	// "sticky", "rollout", "filter", or "no_match", where "sticky" is only
+	// used for features with a rollout percentage when the StickyStore
+	// option is set. Checks delegated to the Parent option's client have the
+	// parent's reason.
+	Reason string
+
+	// FilterVersion identifies the data of the filter the feature was
+	// evaluated against, as returned by Filter.Version, which is the
+	// parent's filter for checks delegated to the Parent option's client.
+	FilterVersion string
+
+	EvaluatedAt time.Time
+}
+
+// CheckAudited checks a feature the same way as Check, but returns why it
+// evaluated the way it did and the version of the filter it was evaluated
+// against, and passes the result to the OnAudit callback. It's meant for
+// features whose every evaluation must be traceable, and is slower than
+// Check.
+func CheckAudited(feature string) AuditResult {
+	return c.CheckAudited(feature)
+}
+
+func (c *Client) CheckAudited(feature string) AuditResult {
+	enabled, reason, version := c.explain(c.filter.Load(), feature)
+	res := AuditResult{
+		Feature:       feature,
+		Enabled:       enabled,
+		Reason:        reason,
+		FilterVersion: version,
+		EvaluatedAt:   time.Now(),
+	}
+
+	if c.opt.OnAudit != nil {
+		c.callback("OnAudit", func() {
+			c.opt.OnAudit(res)
+		})
+	}
+	return res
+}
+
+// explain checks a feature the same way as Check, but against the given
+// filter, which is the client's current filter, and returns the reason for
+// the result, and the version of the filter that decided it, which is the
+// parent's when the check is delegated to the Parent option's client.
+func (c *Client) explain(f *filter, feature string) (enabled bool, reason, version string) {
+	version = f.version()
+	if v, ok := c.override(feature); ok {
+		return v, "override", version
+	}
+	if v, ok := c.localDefault(feature); ok {
+		return v, "default", version
+	}
+	if v, ok := c.preReady(feature); ok {
+		return v, "pre_ready", version
+	}
+	if c.stale() {
+		return false, "stale", version
+	}
+
+	data := []byte(feature)
+
+	c.checkKnown(feature, data)
+
+	if c.inherits(f, data) {
+		return c.opt.Parent.explain(c.opt.Parent.filter.Load(), feature)
+	}
+	seed := c.seed("")
+	if len(f.killed) > 0 && f.isKilled(hash(featureSegment(data))) {
+		return false, "killed", version
+	}
+	if c.alwaysOnActor(data) {
+		return true, "always_on", version
+	}
+	if c.opt.StickyStore != nil {
+		// Only rollouts are sticky, so any other feature falls through
+		// to its real reason, the same way as in lookupSticky.
+		if _, ok := f.rollout(rolloutKey(hash(featureSegment(data)))); ok {
+			return c.lookupSticky(f, data, seed), "sticky", version
+		}
+	}
+	if f.lookupRollout(data, seed) {
+		return true, "rollout", version
+	}
+	if f.lookupFilter(data) {
+		return true, "filter", version
+	}
+	return false, "no_match", version
+}
+
+// Cohort returns which of the given number of equally sized cohorts the key
+// falls into for a feature, where key is everything after the feature in a
+// fully qualified key, for example, `user:1`. It uses the same hash as
+// percentage rollouts, including the rollout hash chosen by the backend and
+// the RolloutSalt option, so with 100 cohorts, a key is enabled by a rollout
+// of n percent when its cohort is at most n. Before Init is called, it uses
+// the default fnv-1a hash.
+//
+// Cohort returns 0 if buckets is less than 1.
+func Cohort(feature, key string, buckets int) int {
+	return c.Cohort(feature, key, buckets)
+}
+
+func (c *Client) Cohort(feature, key string, buckets int) int {
+	if buckets < 1 {
+		return 0
+	}
+
+	f, seed := &filter{}, []byte(nil)
+	if c != nil {
+		if loaded := c.filter.Load(); loaded != nil {
+			f = loaded
+		}
+		seed = c.seed("")
+	}
+	return int(f.seededHash([]byte(feature+":"+key), seed) % uint64(buckets))
+}
+
+// featuresResponse is the response from the features endpoint.
+type featuresResponse struct {
+	Features []string `json:"features"`
+}
+
+// EvaluateAll gets the name of every feature from the backend, and evaluates
+// each of them for the given actor against the loaded filter, returning a map
+// of feature names to whether they're enabled. Since the filter only contains
+// hashes of feature names, this is the only way to list every feature, and is
+// meant for debugging rather than for use on a hot path.
+//
+// EvaluateAll requires a secret key.
+func EvaluateAll(ctx context.Context, resource, actorID string) (map[string]bool, error) {
+	return c.EvaluateAll(ctx, resource, actorID)
+}
+
+func (c *Client) EvaluateAll(ctx context.Context, resource, actorID string) (map[string]bool, error) {
+	if c.devMode {
+		return nil, fmt.Errorf("go-temper: evaluating all features requires a secret key")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+featuresPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: failed to create features request: %w", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("go-temper: failed to fetch features: %w", err)
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("go-temper: failed to fetch features: unexpected status %s", resp.Status)
+	}
+
+	fr := &featuresResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(fr); err != nil {
+		return nil, fmt.Errorf("go-temper: failed to decode features response: %w", err)
+	}
+
+	evaluation := make(map[string]bool, len(fr.Features))
+	for _, feature := range fr.Features {
+		evaluation[feature] = c.Check(feature + ":" + resource + ":" + actorID)
+	}
+	return evaluation, nil
+}
+
+// FilterContains returns true if the key is in the filter itself, ignoring
+// rollouts, killed features, overrides, and defaults. Since filters are never
+// modified once they're installed, both of the key's candidate buckets are
+// checked against the same filter, even if a poll replaces the filter during
+// the call. Like any lookup in the filter, it can return false positives.
+func FilterContains(key string) bool {
+	return c.FilterContains(key)
+}
+
+func (c *Client) FilterContains(key string) bool {
+	f := c.filter.Load()
+	return f.lookupFilter([]byte(key))
+}
+
+// Variant returns the name of the variant of a multivariate feature that the
+// given fully qualified key is assigned to. Keys are assigned to variants
+// deterministically, by mapping their rollout bucket onto the cumulative
+// weights of the feature's variants, so with variants weighted control 50, A
+// 30, and B 20, buckets 0 to 49 are control, 50 to 79 are A, and 80 to 99 are
+// B. It returns an empty string for features without variants, and for keys
+// that fall outside of the variants when their weights add up to less than
+// 100.
+func Variant(feature string) string {
+	return c.Variant(feature)
+}
+
+func (c *Client) Variant(feature string) string {
+	data := []byte(feature)
+	c.checkKnown(feature, data)
+	f := c.filter.Load()
+	if c.inherits(f, data) {
+		return c.opt.Parent.Variant(feature)
+	}
+	return f.variant(data)
+}
+
+// RolloutBucket returns the bucket, from 0 to 99, that the given fully
+// qualified key falls into for percentage rollouts, using the same hash as
+// Check. A key is enabled by a rollout of n percent when its bucket is at most
+// n. It's useful for auditing the distribution of real keys across a rollout,
+// and for explaining why a specific actor is or isn't in one.
+func RolloutBucket(feature string) uint8 {
+	return c.RolloutBucket(feature)
+}
+
+func (c *Client) RolloutBucket(feature string) uint8 {
+	return rolloutBucket(c.filter.Load().seededHash([]byte(feature), c.seed("")))
+}
+
+// FeatureHash returns the 64 bit fnv-1a hash of a feature, which is the same
+// hash that the filter and the backend use. It's useful for correlating a
+// feature with the backend's logs.
+func FeatureHash(feature string) uint64 {
+	return hash([]byte(feature))
+}
+
+// RolloutKey returns the key of a feature's entry in the rollout data, which
+// is its hash with the low 8 bits cleared. Each encoded rollout entry is the
+// rollout key with the percentage stored in the low 8 bits.
+func RolloutKey(feature string) uint64 {
+	return rolloutKey(hash([]byte(feature)))
+}
+
+// FeatureKnown returns true if the filter has any data for the given feature,
+// either a rollout entry, variants, a kill, or an entry in the filter itself.
+//
+// A feature that is only enabled for specific actors can't be told apart from
+// an unknown feature when it's checked for an actor that isn't in the filter,
+// so it needs a rollout entry, even of 0%, to be known for every actor.
+func FeatureKnown(feature string) bool {
+	return c.FeatureKnown(feature)
+}
+
+// FeatureKnown returns true if the filter has any data for the given feature.
+func (c *Client) FeatureKnown(feature string) bool {
+	return c.filter.Load().known([]byte(feature))
+}
+
+// preReady returns the value for the given key according to the
+// PreReadyBehavior option when the filter hasn't been fetched yet, and whether
+// the value should be used rather than evaluating the key against the filter.
+func (c *Client) preReady(key string) (bool, bool) {
+	select {
+	case <-c.ready:
+		return false, false
+	default:
+	}
+
+	switch c.opt.PreReadyBehavior {
+	case Block:
+		var timeout <-chan time.Time
+		if c.opt.PreReadyTimeout > 0 {
+			t := time.NewTimer(c.opt.PreReadyTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case <-c.ready:
+		case <-timeout:
+		}
+	case ReturnDefault:
+		v, _ := lookupKey(c.opt.PreReadyDefaults, key)
+		return v, true
+	}
+	return false, false
+}
+
+// override returns the value forced by the QA overrides service for the
+// given key, and whether there is one.
+func (c *Client) override(key string) (bool, bool) {
+	overrides := c.overrides.Load()
+	if overrides == nil {
+		return false, false
+	}
+	return lookupKey(*overrides, key)
+}
+
+// localDefault returns the local development default for the given key, and
+// whether there is one. Keys in the TestModeOverrides option are always
+// enabled, even if the defaults file disables them.
+func (c *Client) localDefault(key string) (bool, bool) {
+	if _, ok := c.testOverrides[key]; ok {
+		return true, true
+	}
+	return lookupKey(c.defaults, key)
+}
+
+// lookupKey returns the value for the given key in values, and whether there
+// is one. A value for the key's feature segment applies to every actor.
+func lookupKey(values map[string]bool, key string) (bool, bool) {
+	if values == nil {
+		return false, false
+	}
+
+	if v, ok := values[key]; ok {
+		return v, true
+	}
+	v, ok := values[string(featureSegment([]byte(key)))]
+	return v, ok
+}
+
+// alwaysOnActor returns true if the actor segment of the fully qualified key
+// in data, which is everything after the feature, is one of the actors in the
+// AlwaysOnActors option.
+func (c *Client) alwaysOnActor(data []byte) bool {
+	if len(c.alwaysOn) == 0 {
+		return false
+	}
+
+	i := bytes.IndexByte(data, ':')
+	if i <= 0 {
+		return false
+	}
+	_, ok := c.alwaysOn[string(data[i+1:])]
+	return ok
+}
+
+// inherits returns true if the key in data is checked by the Parent option's
+// client, because f has no data for its feature.
+func (c *Client) inherits(f *filter, data []byte) bool {
+	return c.opt.Parent != nil && !f.known(data)
+}
+
+// inheritsGlobal is like inherits, but for a global feature checked with
+// CheckGlobal, whose name is the whole of data.
+func (c *Client) inheritsGlobal(f *filter, data []byte) bool {
+	return c.opt.Parent != nil && !f.knownGlobal(data)
+}
+
+// checkKnown calls the unknown feature handler when strict mode is enabled
+// and the filter has no data for the given feature.
+func (c *Client) checkKnown(feature string, data []byte) {
+	if c.devMode && c.opt.StrictUnknownFeatures && !c.filter.Load().known(data) {
+		c.unknownFeature(feature)
+	}
+}
+
+// unknownFeature is called in strict mode when an unknown feature is checked.
+func (c *Client) unknownFeature(feature string) {
+	if c.opt.UnknownFeatureHandler != nil {
+		c.opt.UnknownFeatureHandler(feature)
+		return
+	}
+	panic("go-temper: unknown feature " + feature)
+}
+
+// Stats returns the size and occupancy of the current filter.
+func Stats() FilterStats {
+	return c.Stats()
+}
+
+// Stats returns the size and occupancy of the current filter.
+func (c *Client) Stats() FilterStats {
+	return c.filter.Load().stats()
+}
+
+// ClearCaches empties all of the lookup caches, so that the next check of
+// every feature is evaluated against the filter. Caches are already emptied
+// whenever a new filter is fetched, so this is only needed when a cache is
+// suspected of serving stale data. It's a no-op when caching is disabled.
+func ClearCaches() {
+	c.ClearCaches()
+}
+
+// ClearCaches empties all of the lookup caches.
+func (c *Client) ClearCaches() {
+	for _, cache := range c.caches {
+		cache.clear()
+	}
+}
+
+// Refactor runs both functions on the given RefactorArgs simultaneously,
+// saving both results in Temper if they don't match. The return value is the
+// result of the given RefactorArgs's `Old` function.
+//
+// If you need to return an error, use `RefactorErr`.
+func Refactor[Args, Ret any](refactor *RefactorArgs[Args, Ret], args Args) Ret {
+	return refactor.run(args)
+}
+
+// RefactorErr is like Refactor, but runs the refactor's `OldErr` and `NewErr`
+// functions, which return an error, and returns the result and error of
+// `OldErr`. The errors are compared along with the results, so a run where
+// only one of them fails, or where they fail with different messages, is a
+// mismatch.
+func RefactorErr[Args, Ret any](refactor *RefactorArgs[Args, Ret], args Args) (Ret, error) {
+	return refactor.runErr(args)
+}
+
+// RefactorWith is like Refactor, but checks the refactor's CompareFeature
+// with the given client rather than the client created by Init.
+func RefactorWith[Args, Ret any](c *Client, refactor *RefactorArgs[Args, Ret], args Args) Ret {
+	return refactor.runOn(c, args)
+}
+
+// RefactorCtx is like Refactor, but runs the `New` function with the profiler
+// labels from ctx, plus a "temper_refactor" label set to the refactor's name,
+// so that its CPU time is attributed to the same labels as the caller in
+// profiles.
+func RefactorCtx[Args, Ret any](ctx context.Context, refactor *RefactorArgs[Args, Ret], args Args) Ret {
+	return refactor.runCtx(ctx, args)
 }
@@ -1,6 +1,8 @@
 package temper_test
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -20,6 +22,9 @@ func mockTemperBackend() http.Handler {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(rawFilterResp)
 	})
+	mux.HandleFunc("/api/refactors/results", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
 
 	return mux
 }
@@ -76,3 +81,83 @@ func TestTemperRefactor(t *testing.T) {
 		t.Fatalf("expected test, got %s", result.V)
 	}
 }
+
+func TestIsPublicPath(t *testing.T) {
+	for p, expected := range map[string]bool{
+		"/api/public":             true,
+		"/api/public/":            true,
+		"/api/public/filter":      true,
+		"api/public/filter":       true,
+		"/api/publicity":          false,
+		"/api/public/../features": false,
+		"/api/features":           false,
+		"/api/refactor":           false,
+		"/":                       false,
+		"":                        false,
+	} {
+		if v := temper.IsPublicPath(p); v != expected {
+			t.Errorf("expected IsPublicPath(%q) to be %v but got %v", p, expected, v)
+		}
+	}
+}
+
+func TestFeatureHash(t *testing.T) {
+	// Test vectors for 64 bit fnv-1a.
+	for feature, expected := range map[string]uint64{
+		"":       0xcbf29ce484222325,
+		"a":      0xaf63dc4c8601ec8c,
+		"foobar": 0x85944171f73967e8,
+	} {
+		if v := temper.FeatureHash(feature); v != expected {
+			t.Errorf("expected hash of %q to be %#x but got %#x", feature, expected, v)
+		}
+		if v := temper.RolloutKey(feature); v != expected&^0xff {
+			t.Errorf("expected rollout key of %q to be %#x but got %#x", feature, expected&^0xff, v)
+		}
+	}
+}
+
+func TestCohort(t *testing.T) {
+	// The full key hashes of test_team_feature:user:1 and
+	// test_team_feature:user:4 mod 100 are 74 and 41.
+	if v := temper.Cohort("test_team_feature", "user:1", 100); v != 74 {
+		t.Errorf("expected cohort 74 but got %d", v)
+	}
+	if v := temper.Cohort("test_team_feature", "user:4", 100); v != 41 {
+		t.Errorf("expected cohort 41 but got %d", v)
+	}
+
+	counts := make([]int, 2)
+	for i := range 1000 {
+		cohort := temper.Cohort("test_team_feature", fmt.Sprintf("user:%d", i), 2)
+		if cohort < 0 || cohort > 1 {
+			t.Fatalf("expected cohort 0 or 1 but got %d", cohort)
+		}
+		counts[cohort]++
+	}
+	if counts[0] < 400 || counts[1] < 400 {
+		t.Errorf("expected cohorts to be roughly equal but got %v", counts)
+	}
+
+	if v := temper.Cohort("test_team_feature", "user:1", 0); v != 0 {
+		t.Errorf("expected cohort 0 for no buckets but got %d", v)
+	}
+}
+
+func TestNewClientWithFilter(t *testing.T) {
+	client := temper.NewClientWithFilter(temper.CurrentFilter())
+	if err := client.Ready(context.Background()); err != nil {
+		t.Fatalf("expected the client to be ready but got %v", err)
+	}
+	if v := client.Check("temper_api_e2e:user:1"); !v {
+		t.Errorf("expected temper_api_e2e:user:1 to be true but got %v", v)
+	}
+	if v := client.Check("temper_api_e2e:user:2"); v {
+		t.Errorf("expected temper_api_e2e:user:2 to be false but got %v", v)
+	}
+
+	client = temper.NewClientWithFilter(nil)
+	if v := client.Check("temper_api_e2e:user:1"); v {
+		t.Errorf("expected temper_api_e2e:user:1 to be false without a filter but got %v", v)
+	}
+}
@@ -0,0 +1,77 @@
+package temperotel
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// refactorKey is the attribute set on refactor metrics to the name of the
+// refactor.
+const refactorKey = attribute.Key("temper.refactor")
+
+// A Meter records the results of refactors as metrics.
+type Meter struct {
+	matches     metric.Int64Counter
+	mismatches  metric.Int64Counter
+	oldDuration metric.Float64Histogram
+	newDuration metric.Float64Histogram
+}
+
+// NewMeter returns a Meter that records metrics with the given meter
+// provider, or with the global meter provider if it's nil. An error is
+// returned if its instruments can't be created.
+func NewMeter(mp metric.MeterProvider) (*Meter, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter(instrumentationName)
+
+	m := &Meter{}
+	var err error
+	if m.matches, err = meter.Int64Counter("temper.refactor.matches",
+		metric.WithDescription("Runs of a refactor whose old and new results matched."),
+	); err != nil {
+		return nil, err
+	}
+	if m.mismatches, err = meter.Int64Counter("temper.refactor.mismatches",
+		metric.WithDescription("Runs of a refactor whose old and new results didn't match."),
+	); err != nil {
+		return nil, err
+	}
+	if m.oldDuration, err = meter.Float64Histogram("temper.refactor.old.duration",
+		metric.WithDescription("How long the old function of a refactor took."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	if m.newDuration, err = meter.Float64Histogram("temper.refactor.new.duration",
+		metric.WithDescription("How long the new function of a refactor took."),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OnRefactor records a run of a refactor, counting it as a match or a
+// mismatch, and recording how long each function took, all with an attribute
+// for the refactor's name. It's meant to be used as the OnRefactor option:
+//
+//	meter, err := temperotel.NewMeter(nil)
+//	temper.Init(publishableKey, secretKey, &temper.Option{OnRefactor: meter.OnRefactor})
+func (m *Meter) OnRefactor(name string, matched bool, olddur, newdur time.Duration) {
+	ctx := context.Background()
+	attrs := metric.WithAttributes(refactorKey.String(name))
+
+	if matched {
+		m.matches.Add(ctx, 1, attrs)
+	} else {
+		m.mismatches.Add(ctx, 1, attrs)
+	}
+	m.oldDuration.Record(ctx, olddur.Seconds(), attrs)
+	m.newDuration.Record(ctx, newdur.Seconds(), attrs)
+}
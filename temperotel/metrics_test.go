@@ -0,0 +1,96 @@
+package temperotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// recordingMeter records the values of its counters and histograms, keyed by
+// instrument name and then by the refactor attribute.
+type recordingMeter struct {
+	noop.Meter
+	counts  map[string]map[string]int64
+	records map[string]map[string][]float64
+}
+
+func (m *recordingMeter) Int64Counter(name string, _ ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return &recordingCounter{name: name, m: m}, nil
+}
+
+func (m *recordingMeter) Float64Histogram(name string, _ ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	return &recordingHistogram{name: name, m: m}, nil
+}
+
+type recordingCounter struct {
+	noop.Int64Counter
+	name string
+	m    *recordingMeter
+}
+
+func (c *recordingCounter) Add(_ context.Context, incr int64, opts ...metric.AddOption) {
+	attrs := metric.NewAddConfig(opts).Attributes()
+	v, _ := attrs.Value(refactorKey)
+	if c.m.counts[c.name] == nil {
+		c.m.counts[c.name] = make(map[string]int64)
+	}
+	c.m.counts[c.name][v.AsString()] += incr
+}
+
+type recordingHistogram struct {
+	noop.Float64Histogram
+	name string
+	m    *recordingMeter
+}
+
+func (h *recordingHistogram) Record(_ context.Context, value float64, opts ...metric.RecordOption) {
+	attrs := metric.NewRecordConfig(opts).Attributes()
+	v, _ := attrs.Value(refactorKey)
+	if h.m.records[h.name] == nil {
+		h.m.records[h.name] = make(map[string][]float64)
+	}
+	h.m.records[h.name][v.AsString()] = append(h.m.records[h.name][v.AsString()], value)
+}
+
+type recordingMeterProvider struct {
+	noop.MeterProvider
+	meter *recordingMeter
+}
+
+func (p recordingMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return p.meter
+}
+
+func TestMeter_OnRefactor(t *testing.T) {
+	rm := &recordingMeter{
+		counts:  make(map[string]map[string]int64),
+		records: make(map[string]map[string][]float64),
+	}
+	meter, err := NewMeter(recordingMeterProvider{meter: rm})
+	if err != nil {
+		t.Fatalf("failed to create meter: %v", err)
+	}
+
+	meter.OnRefactor("abs", true, time.Second, 2*time.Second)
+	meter.OnRefactor("abs", false, time.Second, time.Second)
+	meter.OnRefactor("sum", true, time.Second, time.Second)
+
+	if n := rm.counts["temper.refactor.matches"]["abs"]; n != 1 {
+		t.Errorf("expected 1 match for abs but got %d", n)
+	}
+	if n := rm.counts["temper.refactor.mismatches"]["abs"]; n != 1 {
+		t.Errorf("expected 1 mismatch for abs but got %d", n)
+	}
+	if n := rm.counts["temper.refactor.matches"]["sum"]; n != 1 {
+		t.Errorf("expected 1 match for sum but got %d", n)
+	}
+	if got := rm.records["temper.refactor.new.duration"]["abs"]; len(got) != 2 || got[0] != 2 {
+		t.Errorf("expected the new durations of abs in seconds but got %v", got)
+	}
+	if got := rm.records["temper.refactor.old.duration"]["sum"]; len(got) != 1 || got[0] != 1 {
+		t.Errorf("expected the old duration of sum in seconds but got %v", got)
+	}
+}
@@ -0,0 +1,88 @@
+// Package temperotel provides OpenTelemetry tracing and metrics for the
+// Temper API client, with spans for fetching the filter, and optionally for
+// checking features, and metrics for the results of refactors.
+//
+// It's a separate module so that the core temper-go package stays free of
+// dependencies.
+package temperotel
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/bentranter/temper-go"
+)
+
+// instrumentationName identifies the spans created by this package.
+const instrumentationName = "github.com/bentranter/temper-go/temperotel"
+
+// Attributes set on spans.
+const (
+	statusKey  = attribute.Key("http.response.status_code")
+	bytesKey   = attribute.Key("temper.fetch.bytes")
+	featureKey = attribute.Key("temper.feature")
+	enabledKey = attribute.Key("temper.enabled")
+)
+
+// A Tracer creates spans for operations of the Temper API client.
+type Tracer struct {
+	tracer trace.Tracer
+	check  func(feature string) bool
+}
+
+// NewTracer returns a Tracer that creates spans with the given tracer
+// provider, or with the global tracer provider if it's nil.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{
+		tracer: tp.Tracer(instrumentationName),
+		check:  temper.Check,
+	}
+}
+
+// OnFetch records a fetch of the filter as a span, with attributes for the
+// status code of the response and the number of bytes downloaded, and a
+// duration that matches the fetch. It's meant to be used as the OnFetch
+// option:
+//
+//	tracer := temperotel.NewTracer(nil)
+//	temper.Init(publishableKey, secretKey, &temper.Option{OnFetch: tracer.OnFetch})
+//
+// Fetches happen in the background, so their spans are root spans.
+func (t *Tracer) OnFetch(duration time.Duration, bytes int, status int) {
+	end := time.Now()
+	_, span := t.tracer.Start(context.Background(), "temper.fetch_filter",
+		trace.WithTimestamp(end.Add(-duration)),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(statusKey.Int(status), bytesKey.Int(bytes)),
+	)
+	if status == 0 {
+		span.SetStatus(codes.Error, "no response")
+	} else if status != http.StatusOK {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// CheckCtx checks a feature the same way as temper.Check, in a span that's a
+// child of the active span in ctx. Only the feature segment of the key is
+// recorded, so that actor IDs don't end up in traces.
+func (t *Tracer) CheckCtx(ctx context.Context, feature string) bool {
+	name, _, _ := strings.Cut(feature, ":")
+
+	_, span := t.tracer.Start(ctx, "temper.check", trace.WithAttributes(featureKey.String(name)))
+	defer span.End()
+
+	enabled := t.check(feature)
+	span.SetAttributes(enabledKey.Bool(enabled))
+	return enabled
+}
@@ -0,0 +1,94 @@
+package temperotel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracer(check func(string) bool) (*Tracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	tracer.check = check
+	return tracer, recorder
+}
+
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestTracer_OnFetch(t *testing.T) {
+	tracer, recorder := newTestTracer(nil)
+
+	tracer.OnFetch(250*time.Millisecond, 1024, http.StatusOK)
+	tracer.OnFetch(time.Second, 0, 0)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans but got %d", len(spans))
+	}
+
+	span := spans[0]
+	if span.Name() != "temper.fetch_filter" {
+		t.Errorf("expected span temper.fetch_filter but got %s", span.Name())
+	}
+	if d := span.EndTime().Sub(span.StartTime()); d != 250*time.Millisecond {
+		t.Errorf("expected the span to last 250ms but got %s", d)
+	}
+	attrs := attributes(span.Attributes())
+	if v := attrs[statusKey].AsInt64(); v != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, v)
+	}
+	if v := attrs[bytesKey].AsInt64(); v != 1024 {
+		t.Errorf("expected 1024 bytes but got %d", v)
+	}
+	if span.Status().Code == codes.Error {
+		t.Errorf("expected a successful fetch not to be an error but got %v", span.Status())
+	}
+
+	if spans[1].Status().Code != codes.Error {
+		t.Errorf("expected a failed fetch to be an error but got %v", spans[1].Status())
+	}
+}
+
+func TestTracer_CheckCtx(t *testing.T) {
+	tracer, recorder := newTestTracer(func(feature string) bool {
+		return feature == "feature:user:1"
+	})
+
+	ctx, parent := tracer.tracer.Start(context.Background(), "parent")
+	if v := tracer.CheckCtx(ctx, "feature:user:1"); !v {
+		t.Errorf("expected feature:user:1 to be true but got %v", v)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans but got %d", len(spans))
+	}
+
+	span := spans[0]
+	if span.Name() != "temper.check" {
+		t.Errorf("expected span temper.check but got %s", span.Name())
+	}
+	if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("expected the check span to be a child of the active span")
+	}
+	attrs := attributes(span.Attributes())
+	if v := attrs[featureKey].AsString(); v != "feature" {
+		t.Errorf("expected only the feature segment to be recorded but got %q", v)
+	}
+	if v := attrs[enabledKey].AsBool(); !v {
+		t.Errorf("expected enabled to be recorded as true but got %v", v)
+	}
+}
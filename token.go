@@ -0,0 +1,114 @@
+package temper
+
+// A FeatureToken is a fully qualified key that's been prepared by Prepare, so
+// that checking it with CheckToken skips hashing it. A token is only valid
+// for the client that prepared it.
+type FeatureToken struct {
+	key string
+
+	// hfeat is the hash of the key's feature segment, and hfull is the
+	// hash of the whole key compared against rollout percentages, with
+	// rolloutHash.
+	hfeat       uint64
+	hfull       uint64
+	rolloutHash string
+
+	// hash is the hash of the key that its fingerprint and indexes are
+	// derived from, and index and alt are its candidate buckets in a filter
+	// whose bucketIndexMask is mask.
+	hash        uint64
+	fingerprint uint16
+	index, alt  uint
+	mask        uint
+
+	// alwaysOn is true if the key's actor is in the AlwaysOnActors option.
+	alwaysOn bool
+}
+
+// Prepare hashes a fully qualified key once, for example, at startup, and
+// returns a token that CheckToken checks without hashing it again. It's only
+// worth it for the keys on the very hottest paths.
+func Prepare(feature string) FeatureToken {
+	return c.Prepare(feature)
+}
+
+func (c *Client) Prepare(feature string) FeatureToken {
+	data := []byte(feature)
+	f := c.filter.Load()
+	if f == nil {
+		f = &filter{}
+	}
+
+	t := FeatureToken{
+		key:         feature,
+		hfeat:       hash(featureSegment(data)),
+		hfull:       f.fullHash(data),
+		rolloutHash: f.rolloutHash,
+		hash:        hash(data),
+		alwaysOn:    c.alwaysOnActor(data),
+	}
+	t.fingerprint = fingerprintOf(t.hash)
+	t.index, t.alt = f.candidates(t.fingerprint, t.hash)
+	t.mask = f.bucketIndexMask
+	return t
+}
+
+// CheckToken checks the key of a token prepared by Prepare the same way as
+// Check. When the filter has been resized or uses a different rollout hash
+// since the token was prepared, the parts of the token that no longer apply
+// are recomputed on every check, so it's still correct, but slower, until the
+// token is prepared again.
+func CheckToken(t FeatureToken) bool {
+	return c.CheckToken(t)
+}
+
+func (c *Client) CheckToken(t FeatureToken) bool {
+	if v, ok := c.override(t.key); ok {
+		return v
+	}
+	if v, ok := c.localDefault(t.key); ok {
+		return v
+	}
+	if v, ok := c.preReady(t.key); ok {
+		return v
+	}
+	if c.stale() {
+		return false
+	}
+
+	if c.devMode && c.opt.StrictUnknownFeatures {
+		c.checkKnown(t.key, []byte(t.key))
+	}
+
+	f := c.filter.Load()
+	if c.opt.Parent != nil && c.inherits(f, []byte(t.key)) {
+		return c.opt.Parent.Check(t.key)
+	}
+	if t.alwaysOn {
+		return !f.isKilled(t.hfeat)
+	}
+	if c.opt.StickyStore != nil {
+		return c.lookupSticky(f, []byte(t.key), c.seed(""))
+	}
+
+	if len(f.killed) > 0 && f.isKilled(t.hfeat) {
+		return false
+	}
+
+	hfull := t.hfull
+	if c.opt.RolloutSalt != nil || f.rolloutHash != t.rolloutHash {
+		hfull = f.seededHash([]byte(t.key), c.seed(""))
+	}
+	if f.lookupRolloutHash(t.hfeat, hfull) {
+		return true
+	}
+
+	if f.cap == 0 {
+		return false
+	}
+	index, alt := t.index, t.alt
+	if f.bucketIndexMask != t.mask {
+		index, alt = f.candidates(t.fingerprint, t.hash)
+	}
+	return f.bucketContains(index, t.fingerprint) || f.bucketContains(alt, t.fingerprint)
+}
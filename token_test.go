@@ -0,0 +1,46 @@
+package temper
+
+import "testing"
+
+func TestClientCheckToken(t *testing.T) {
+	c := newTestClient(t, "", nil)
+
+	keys := []string{
+		"temper_api_e2e:user:1",
+		"temper_api_e2e:user:2",
+		"temper_api_e2e_rollout:user:1",
+		"temper_api_e2e_off:user:1",
+		"unknown:user:1",
+	}
+	tokens := make([]FeatureToken, len(keys))
+	for i, key := range keys {
+		tokens[i] = c.Prepare(key)
+	}
+
+	for i, key := range keys {
+		if got, want := c.CheckToken(tokens[i]), c.Check(key); got != want {
+			t.Errorf("expected CheckToken(%q) to be %t, but got %t", key, want, got)
+		}
+	}
+	if !c.CheckToken(tokens[0]) {
+		t.Errorf("expected %q to be enabled", keys[0])
+	}
+
+	// Resize the filter, so the prepared indexes no longer apply.
+	f := newFilter(1024)
+	f.insert([]byte("temper_api_e2e:user:1"))
+	f.insert([]byte("unknown:user:1"))
+	if f.bucketIndexMask == tokens[0].mask {
+		t.Fatalf("expected the filter's mask to change")
+	}
+	c.filter.Store(f)
+
+	for i, key := range keys {
+		if got, want := c.CheckToken(tokens[i]), c.Check(key); got != want {
+			t.Errorf("expected CheckToken(%q) to be %t after a resize, but got %t", key, want, got)
+		}
+	}
+	if !c.CheckToken(tokens[4]) {
+		t.Errorf("expected %q to be enabled after a resize", keys[4])
+	}
+}